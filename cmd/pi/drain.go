@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/go-logr/logr"
+
+	"github.com/laixintao/piccolo/pkg/registry"
+	"github.com/laixintao/piccolo/pkg/sd"
+)
+
+// drainer takes the pi out of its group: peers are refused new blob
+// transfers, state tracking stops and the host and its keys are removed
+// from piccolo. Transfers in flight are not interrupted.
+type drainer struct {
+	once         sync.Once
+	sd           sd.ServiceDiscover
+	piServer     *registry.PiServer
+	stopTracking context.CancelFunc
+	// Closed when state tracking returned.
+	tracking <-chan struct{}
+	log      logr.Logger
+}
+
+func (d *drainer) drain(ctx context.Context) {
+	d.once.Do(func() {
+		d.log.Info("draining pi")
+		d.piServer.Drain()
+		// Tracking has to stop first, otherwise keys are advertised again.
+		d.stopTracking()
+		select {
+		case <-d.tracking:
+		case <-ctx.Done():
+		}
+		if err := d.sd.Deregister(ctx); err != nil {
+			d.log.Error(err, "could not deregister from piccolo, keys are removed when the host is evicted")
+			return
+		}
+		d.log.Info("pi drained")
+	})
+}
+
+// ServeHTTP drains the pi without exiting.
+func (d *drainer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	d.drain(req.Context())
+	rw.WriteHeader(http.StatusOK)
+}
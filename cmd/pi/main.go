@@ -7,13 +7,18 @@ import (
 
 	"context"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/alexflint/go-arg"
 	"github.com/go-logr/logr"
+	"github.com/laixintao/piccolo/internal/tlsconfig"
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
 	"github.com/laixintao/piccolo/pkg/metrics"
 	"github.com/laixintao/piccolo/pkg/oci"
 	"github.com/laixintao/piccolo/pkg/registry"
@@ -21,6 +26,7 @@ import (
 	"github.com/laixintao/piccolo/pkg/state"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/afero"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -30,25 +36,57 @@ var (
 	date    = "unknown"
 )
 
+type ConfigureMirrorsCmd struct {
+	ContainerdRegistryConfigPath string    `arg:"--containerd-registry-config-path,env:CONTAINERD_REGISTRY_CONFIG_PATH" default:"/etc/containerd/certs.d" help:"Directory where mirror configuration is written."`
+	Registries                   []url.URL `arg:"--registries,env:REGISTRIES" help:"registries that are configured to be mirrored, required unless --restore is set."`
+	RegistryAddr                 string    `arg:"--registry-listen-addr,env:REGISTRY_ADDR" help:"address the local pi registry listens on, the mirrors point to this address."`
+	ResolveTags                  bool      `arg:"--resolve-tags,env:RESOLVE_TAGS" default:"true" help:"When true the mirror is allowed to resolve tags."`
+	AppendMirrors                bool      `arg:"--append-mirrors,env:APPEND_MIRRORS" default:"false" help:"When true existing mirror configuration is appended after the pi mirror."`
+	Restore                      bool      `arg:"--restore" default:"false" help:"Remove the mirror configuration and restore the backed up configuration."`
+}
+
 type Arguments struct {
+	ConfigureMirrorsCmd *ConfigureMirrorsCmd `arg:"subcommand:configure-mirrors" help:"write containerd mirror configuration and exit."`
+
 	RegistryAddr string `arg:"--registry-listen-addr,env:REGISTRY_ADDR,required" help:"address to serve image registry (for local containerd, you can use 127.0.0.1, as long as it can be connected for your containerd)"`
 	PiAddr       string `arg:"--pi-listen-addr,env:PI_ADDR,required" help:"address to serve downloading for other pi agents, other agents will download images from this address"`
 	MetricsAddr  string `arg:"--metrics-listen-addr,required,env:METRICS_ADDR" help:"address to serve metrics."`
 
-	ContainerdSock              string        `arg:"--containerd-sock,env:CONTAINERD_SOCK" default:"/run/containerd/containerd.sock" help:"Endpoint of containerd service."`
-	ContainerdNamespace         string        `arg:"--containerd-namespace,env:CONTAINERD_NAMESPACE" default:"k8s.io" help:"Containerd namespace to fetch images from."`
-	ContainerdContentPath       string        `arg:"--containerd-content-path,env:CONTAINERD_CONTENT_PATH" default:"/var/lib/containerd/io.containerd.content.v1.content" help:"Path to Containerd content store"`
-	Registries                  []url.URL     `arg:"--registries,env:REGISTRIES,required" help:"registries that are configured to be mirrored."`
-	LogLevel                    slog.Level    `arg:"--log-level,env:LOG_LEVEL" default:"INFO" help:"Minimum log level to output. Value should be DEBUG, INFO, WARN, or ERROR."`
-	ResolveLatestTag            bool          `arg:"--resolve-latest-tag,env:RESOLVE_LATEST_TAG" default:"true" help:"When true latest tags will be resolved to digests."`
-	PiccoloAddress              url.URL       `arg:"--piccolo-api,env:PICCOLO_ADDRESS" help:"Piccolo API URL for central service discovery"`
-	FullRefreshMinutes          int64         `arg:"--full-refresh-minutes,env:PI_REFRESH_MINUTES" help:"pi will update all image states to piccolo for every X minutes."`
-	MaxUploadConnections        int           `arg:"--max-upload-connections,env:MAX_UPLOAD_CONNECTIONS" default:"5" help:"Max connection used to upload images to other peers."`
-	MaxUploadBlobBytesPerSecond float64       `arg:"--max-upload-blob-bytes-per-second,env:PI_MAX_UPLOAD_BLOB_BYTES_PER_SECOND" default:"1073741824" help:"Max upload speed limition for upload blobs to other pi nodes."`
-	MirrorResolveTimeout        time.Duration `arg:"--mirror-resolve-timeout,env:MIRROR_RESOLVE_TIMEOUT" default:"2s" help:"Max duration spent finding a mirror."`
-	MirrorResolveRetries        int           `arg:"--mirror-resolve-retries,env:MIRROR_RESOLVE_RETRIES" default:"3" help:"Max amount of mirrors to attempt."`
-	Group                       string        `arg:"--group,env:PI_GROUP,required" help:"The pi group name, pi can only discover other Pis in the same group."`
-	Version                     bool          `arg:"-v,--version" help:"show version"`
+	ContainerdSock               string        `arg:"--containerd-sock,env:CONTAINERD_SOCK" default:"/run/containerd/containerd.sock" help:"Endpoint of containerd service."`
+	ContainerdNamespace          string        `arg:"--containerd-namespace,env:CONTAINERD_NAMESPACE" default:"k8s.io" help:"Containerd namespace to fetch images from."`
+	ContainerdContentPath        string        `arg:"--containerd-content-path,env:CONTAINERD_CONTENT_PATH" default:"/var/lib/containerd/io.containerd.content.v1.content" help:"Path to Containerd content store"`
+	Registries                   []url.URL     `arg:"--registries,env:REGISTRIES,required" help:"registries that are configured to be mirrored."`
+	LogLevel                     slog.Level    `arg:"--log-level,env:LOG_LEVEL" default:"INFO" help:"Minimum log level to output. Value should be DEBUG, INFO, WARN, or ERROR."`
+	ResolveLatestTag             bool          `arg:"--resolve-latest-tag,env:RESOLVE_LATEST_TAG" default:"true" help:"When true latest tags will be resolved to digests."`
+	PiccoloAddress               url.URL       `arg:"--piccolo-api,env:PICCOLO_ADDRESS" help:"Piccolo API URL for central service discovery"`
+	FullRefreshMinutes           int64         `arg:"--full-refresh-minutes,env:PI_REFRESH_MINUTES" help:"pi will update all image states to piccolo for every X minutes."`
+	MaxUploadConnections         int           `arg:"--max-upload-connections,env:MAX_UPLOAD_CONNECTIONS" default:"5" help:"Max connection used to upload images to other peers."`
+	MaxUploadBlobBytesPerSecond  float64       `arg:"--max-upload-blob-bytes-per-second,env:PI_MAX_UPLOAD_BLOB_BYTES_PER_SECOND" default:"1073741824" help:"Max upload speed limition for upload blobs to other pi nodes."`
+	MirrorResolveTimeout         time.Duration `arg:"--mirror-resolve-timeout,env:MIRROR_RESOLVE_TIMEOUT" default:"2s" help:"Max duration spent finding a mirror."`
+	MirrorResolveRetries         int           `arg:"--mirror-resolve-retries,env:MIRROR_RESOLVE_RETRIES" default:"3" help:"Max amount of mirrors to attempt."`
+	Group                        string        `arg:"--group,env:PI_GROUP,required" help:"The pi group name, pi can only discover other Pis in the same group."`
+	UpstreamFallback             bool          `arg:"--upstream-fallback,env:UPSTREAM_FALLBACK" default:"false" help:"When true pi pulls content from the original registry if no peer in the group has it."`
+	UpstreamWriteContentStore    bool          `arg:"--upstream-write-content-store,env:UPSTREAM_WRITE_CONTENT_STORE" default:"false" help:"When true content pulled from the original registry is also written into the containerd content store."`
+	SpoolDir                     string        `arg:"--spool-dir,env:PI_SPOOL_DIR" help:"When set concurrent requests for the same blob share one transfer from a peer, buffered in this directory. Only spooled blobs which do not match their digest are fetched again from the next peer, otherwise the client receives a short read."`
+	PrefetchLayers               int           `arg:"--prefetch-layers,env:PI_PREFETCH_LAYERS" default:"0" help:"Number of layers fetched into the spool at once as soon as their manifest is served, so the layer requests are served from local disk. 0 disables prefetching, requires --spool-dir."`
+	ParallelDownloadThreshold    int64         `arg:"--parallel-download-threshold,env:PI_PARALLEL_DOWNLOAD_THRESHOLD" default:"0" help:"Blobs of at least this many bytes are fetched in chunks from several peers at once, 0 disables parallel downloads."`
+	ParallelDownloadChunkSize    int64         `arg:"--parallel-download-chunk-size,env:PI_PARALLEL_DOWNLOAD_CHUNK_SIZE" default:"8388608" help:"Size in bytes of the chunks of a parallel download."`
+	ParallelDownloadPeers        int           `arg:"--parallel-download-peers,env:PI_PARALLEL_DOWNLOAD_PEERS" default:"4" help:"Max amount of peers a blob is fetched from at once."`
+	TLSCertFile                  string        `arg:"--tls-cert-file,env:PI_TLS_CERT_FILE" help:"Certificate of this pi, when set peers are served and contacted over TLS. Peers are dialed by IP, the certificate needs an IP SAN for the address of --pi-listen-addr."`
+	TLSKeyFile                   string        `arg:"--tls-key-file,env:PI_TLS_KEY_FILE" help:"Private key of the certificate set with --tls-cert-file."`
+	TLSCAFile                    string        `arg:"--tls-ca-file,env:PI_TLS_CA_FILE" help:"CA used to verify other pi agents, when set peers have to present a client certificate signed by this CA."`
+	PiccoloTLSCAFile             string        `arg:"--piccolo-tls-ca-file,env:PICCOLO_TLS_CA_FILE" help:"CA used to verify piccolo when the piccolo API is https, the certificate set with --tls-cert-file is presented as client certificate."`
+	TopologyLabels               string        `arg:"--topology-labels,env:PI_TOPOLOGY_LABELS" help:"Labels describing where this pi runs in the form 'region=us-1,zone=a,rack=r1', piccolo ranks holders sharing these labels first."`
+	PiccoloToken                 string        `arg:"--piccolo-token,env:PICCOLO_TOKEN" help:"Bearer token sent to piccolo, required when piccolo is started with --token-file."`
+	IndexPath                    string        `arg:"--index-path,env:PI_INDEX_PATH" help:"File the keys of every local image are persisted in, so deleting an image only withdraws its keys instead of syncing all keys. When empty the index is kept in memory."`
+	PrepullPollInterval          time.Duration `arg:"--prepull-poll-interval,env:PI_PREPULL_POLL_INTERVAL" default:"30s" help:"How often piccolo is asked for images to pull ahead of time, 0 disables prepulls."`
+	LoadReportInterval           time.Duration `arg:"--load-report-interval,env:PI_LOAD_REPORT_INTERVAL" default:"30s" help:"How often the average upload load is reported to piccolo for load balancing, 0 reports it with keepalive only."`
+	DrainTimeout                 time.Duration `arg:"--drain-timeout,env:PI_DRAIN_TIMEOUT" default:"30s" help:"Max duration transfers to other pi agents are given to finish after pi is drained on SIGTERM."`
+	DrainEndpoint                bool          `arg:"--drain-endpoint,env:PI_DRAIN_ENDPOINT" default:"false" help:"When true a POST to /drain on the metrics address drains pi without exiting. The endpoint is not authenticated, only enable it if the metrics address can not be reached from outside the node."`
+	ConfigureMirrors             bool          `arg:"--configure-mirrors,env:CONFIGURE_MIRRORS" default:"false" help:"When true containerd mirror configuration is written on startup."`
+	ContainerdRegistryConfigPath string        `arg:"--containerd-registry-config-path,env:CONTAINERD_REGISTRY_CONFIG_PATH" default:"/etc/containerd/certs.d" help:"Directory where mirror configuration is written."`
+	AppendMirrors                bool          `arg:"--append-mirrors,env:APPEND_MIRRORS" default:"false" help:"When true existing mirror configuration is appended after the pi mirror."`
+	Version                      bool          `arg:"-v,--version" help:"show version"`
 }
 
 func main() {
@@ -62,7 +100,12 @@ func main() {
 	}
 
 	args := &Arguments{}
-	arg.MustParse(args)
+	p, err := arg.NewParser(arg.Config{StrictSubcommands: true}, args)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	p.MustParse(os.Args[1:])
 
 	opts := slog.HandlerOptions{
 		AddSource: true,
@@ -72,41 +115,161 @@ func main() {
 	log := logr.FromSlogHandler(handler)
 	log.Info("log init")
 	ctx := logr.NewContext(context.Background(), log)
-	ociClient, err := oci.NewContainerd(ctx, args.ContainerdSock, args.ContainerdNamespace, args.Registries, oci.WithContentPath(args.ContainerdContentPath))
+
+	if args.ConfigureMirrorsCmd != nil {
+		err := configureMirrors(ctx, args.ConfigureMirrorsCmd)
+		if err != nil {
+			log.Error(err, "configure mirrors failed")
+			os.Exit(1)
+		}
+		return
+	}
+
+	if args.ConfigureMirrors {
+		err := configureMirrors(ctx, &ConfigureMirrorsCmd{
+			ContainerdRegistryConfigPath: args.ContainerdRegistryConfigPath,
+			Registries:                   args.Registries,
+			RegistryAddr:                 args.RegistryAddr,
+			ResolveTags:                  args.ResolveLatestTag,
+			AppendMirrors:                args.AppendMirrors,
+		})
+		if err != nil {
+			log.Error(err, "configure mirrors failed")
+			os.Exit(1)
+		}
+	}
+
+	ociClient, err := oci.NewContainerd(args.ContainerdSock, args.ContainerdNamespace, args.ContainerdRegistryConfigPath, args.Registries, oci.WithContentPath(args.ContainerdContentPath))
 	if err != nil {
 		log.Error(err, "run exit with error")
 		os.Exit(1)
 	}
-	log.Info("containerd sdk init")
+	log.Info("containerd sdk init", "client", ociClient.Name())
+	if args.ConfigureMirrors {
+		if err := ociClient.Verify(ctx); err != nil {
+			log.Error(err, "containerd configuration does not allow pi to act as mirror")
+		}
+	}
 
-	piccoloSD, err := sd.NewPiccoloServiceDiscover(args.PiccoloAddress, log, args.PiAddr, args.Group)
+	sdOpts := []sd.Option{}
+	if args.PiccoloAddress.Scheme == "https" {
+		tlsConfig, err := tlsconfig.Client(args.TLSCertFile, args.TLSKeyFile, args.PiccoloTLSCAFile)
+		if err != nil {
+			log.Error(err, "invalid piccolo TLS configuration")
+			os.Exit(1)
+		}
+		sdOpts = append(sdOpts, sd.WithTLSConfig(tlsConfig))
+	}
+	if args.PiccoloToken != "" {
+		sdOpts = append(sdOpts, sd.WithToken(args.PiccoloToken))
+	}
+	if args.TopologyLabels != "" {
+		labels, err := model.ParseLabels(args.TopologyLabels)
+		if err != nil {
+			log.Error(err, "invalid topology labels")
+			os.Exit(1)
+		}
+		sdOpts = append(sdOpts, sd.WithLabels(labels))
+	}
+	// The pi server is started before the first keepalive.
+	var piServer *registry.PiServer
+	sdOpts = append(sdOpts, sd.WithLoad(func() model.HostLoad {
+		return piServer.Load()
+	}))
+	piccoloSD, err := sd.NewPiccoloServiceDiscover(args.PiccoloAddress, log, args.PiAddr, args.Group, sdOpts...)
 	if err != nil {
 		log.Error(err, "NewPiccoloServiceDiscover error")
 		os.Exit(1)
 	}
 
-	g, ctx := errgroup.WithContext(ctx)
+	// On SIGTERM the pi is drained before the servers are shut down.
+	signalCtx, stopSignals := signal.NotifyContext(ctx, syscall.SIGTERM, syscall.SIGINT)
+	defer stopSignals()
+	serverCtx, cancelServers := context.WithCancel(ctx)
+	defer cancelServers()
+	g, ctx := errgroup.WithContext(serverCtx)
+	trackCtx, stopTracking := context.WithCancel(ctx)
+	defer stopTracking()
+	tracking := make(chan struct{})
+
+	// Pi Server
+	// Peer TLS
+	piServerOpts := []registry.PiServerOption{}
+	registryOpts := []registry.Option{}
+	if args.TLSCertFile != "" {
+		serverTLS, err := tlsconfig.Server(args.TLSCertFile, args.TLSKeyFile, args.TLSCAFile)
+		if err != nil {
+			log.Error(err, "invalid pi server TLS configuration")
+			os.Exit(1)
+		}
+		if err := tlsconfig.VerifyAddr(serverTLS, args.PiAddr); err != nil {
+			log.Info("WARN: peers will reject the pi certificate", "address", args.PiAddr, "error", err.Error())
+		}
+		peerTLS, err := tlsconfig.Client(args.TLSCertFile, args.TLSKeyFile, args.TLSCAFile)
+		if err != nil {
+			log.Error(err, "invalid peer TLS configuration")
+			os.Exit(1)
+		}
+		piServerOpts = append(piServerOpts, registry.WithPiServerTLS(serverTLS))
+		registryOpts = append(registryOpts, registry.WithPeerTLS(peerTLS))
+		log.Info("TLS enabled for peer traffic", "mutual", args.TLSCAFile != "")
+	}
 
-	err = startMetricsServer(ctx, args.MetricsAddr, g)
+	piServer, err = startPiServer(ctx, args.Group, args.MaxUploadConnections, args.MaxUploadBlobBytesPerSecond, args.DrainTimeout, ociClient, piccoloSD, log, args.PiAddr, g, piServerOpts...)
 	if err != nil {
 		log.Error(err, "Error when start Pi Server")
 		os.Exit(1)
 	}
-	log.Info("Metrics server started", "address", args.PiAddr)
+	log.Info("Start Pi server", "address", args.PiAddr, "MaxUploadBlobBytesPerSecond", args.MaxUploadBlobBytesPerSecond)
 
-	// Pi Server
-	err = startPiServer(ctx, args.Group, args.MaxUploadConnections, args.MaxUploadBlobBytesPerSecond, ociClient, piccoloSD, log, args.PiAddr, g)
+	drainer := &drainer{
+		sd:           piccoloSD,
+		piServer:     piServer,
+		stopTracking: stopTracking,
+		tracking:     tracking,
+		log:          log,
+	}
+	var drainHandler http.Handler
+	if args.DrainEndpoint {
+		drainHandler = drainer
+	}
+	peerScores := registry.NewPeerScores()
+	err = startMetricsServer(ctx, args.MetricsAddr, peerScores, drainHandler, g)
 	if err != nil {
 		log.Error(err, "Error when start Pi Server")
 		os.Exit(1)
 	}
-	log.Info("Start Pi server", "address", args.PiAddr, "MaxUploadBlobBytesPerSecond", args.MaxUploadBlobBytesPerSecond)
+	log.Info("Metrics server started", "address", args.PiAddr)
 
 	// Registry
-	registryOpts := []registry.Option{
+	registryOpts = append(registryOpts,
 		registry.WithResolveLatestTag(args.ResolveLatestTag),
 		registry.WithResolveRetries(args.MirrorResolveRetries),
 		registry.WithResolveTimeout(args.MirrorResolveTimeout),
+		registry.WithPeerScores(peerScores),
+	)
+	if args.ParallelDownloadThreshold > 0 {
+		if args.ParallelDownloadChunkSize <= 0 {
+			log.Error(errors.New("chunk size must be positive"), "invalid parallel download configuration")
+			os.Exit(1)
+		}
+		registryOpts = append(registryOpts, registry.WithParallelDownload(args.ParallelDownloadThreshold, args.ParallelDownloadChunkSize, args.ParallelDownloadPeers))
+	}
+	if args.SpoolDir != "" {
+		registryOpts = append(registryOpts, registry.WithSpoolDir(args.SpoolDir))
+	}
+	if args.PrefetchLayers > 0 {
+		if args.SpoolDir == "" {
+			log.Error(errors.New("--prefetch-layers requires --spool-dir"), "invalid prefetch configuration")
+			os.Exit(1)
+		}
+		registryOpts = append(registryOpts, registry.WithLayerPrefetch(args.PrefetchLayers, ociClient))
+	}
+	if args.UpstreamFallback {
+		registryOpts = append(registryOpts, registry.WithUpstreamFallback(args.Registries))
+		if args.UpstreamWriteContentStore {
+			registryOpts = append(registryOpts, registry.WithContentStore(ociClient))
+		}
 	}
 	err = startRegistryServer(ctx, ociClient, piccoloSD, log, args.RegistryAddr, g, registryOpts...)
 	if err != nil {
@@ -117,7 +280,34 @@ func main() {
 
 	// State tracking
 	g.Go(func() error {
-		return state.Track(ctx, ociClient, piccoloSD, args.FullRefreshMinutes, args.ResolveLatestTag)
+		defer close(tracking)
+		return state.Track(trackCtx, ociClient, piccoloSD, args.FullRefreshMinutes, args.ResolveLatestTag, args.IndexPath)
+	})
+	if args.PrepullPollInterval > 0 {
+		g.Go(func() error {
+			return state.Prepull(trackCtx, ociClient, piccoloSD, args.PrepullPollInterval)
+		})
+	}
+	if args.LoadReportInterval > 0 {
+		g.Go(func() error {
+			return state.ReportLoad(trackCtx, piccoloSD, args.LoadReportInterval)
+		})
+	}
+
+	g.Go(func() error {
+		select {
+		case <-signalCtx.Done():
+		case <-ctx.Done():
+			return nil
+		}
+		// A second signal terminates pi right away.
+		stopSignals()
+		log.Info("received signal, drain pi and shut down")
+		drainCtx, cancel := context.WithTimeout(context.Background(), args.DrainTimeout)
+		defer cancel()
+		drainer.drain(logr.NewContext(drainCtx, log))
+		cancelServers()
+		return nil
 	})
 
 	err = g.Wait()
@@ -127,31 +317,66 @@ func main() {
 	}
 }
 
+func configureMirrors(ctx context.Context, args *ConfigureMirrorsCmd) error {
+	fs := afero.NewOsFs()
+	if args.Restore {
+		return oci.RemoveMirrorConfiguration(ctx, fs, args.ContainerdRegistryConfigPath)
+	}
+	if len(args.Registries) == 0 {
+		return errors.New("--registries is required to configure mirrors")
+	}
+	mirror, err := mirrorURL(args.RegistryAddr)
+	if err != nil {
+		return err
+	}
+	return oci.AddMirrorConfiguration(ctx, fs, args.ContainerdRegistryConfigPath, args.Registries, []url.URL{mirror}, args.ResolveTags, args.AppendMirrors)
+}
+
+// mirrorURL returns the url containerd uses to reach the local registry,
+// an address without host is reached through the loopback address.
+func mirrorURL(registryAddr string) (url.URL, error) {
+	host, port, err := net.SplitHostPort(registryAddr)
+	if err != nil {
+		return url.URL{}, fmt.Errorf("invalid registry address %q: %w", registryAddr, err)
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return url.URL{Scheme: "http", Host: net.JoinHostPort(host, port)}, nil
+}
+
 func startPiServer(ctx context.Context, group string, maxConnection int,
-	maxUploadBlobSpeedBytes float64,
-	ociClient oci.Client, sd sd.ServiceDiscover, log logr.Logger, piAddr string, g *errgroup.Group) error {
+	maxUploadBlobSpeedBytes float64, shutdownTimeout time.Duration,
+	ociClient oci.Client, sd sd.ServiceDiscover, log logr.Logger, piAddr string, g *errgroup.Group, opts ...registry.PiServerOption) (*registry.PiServer, error) {
 	piServerOptions := []registry.PiServerOption{
 		registry.WithMaxUploadConnection(maxConnection),
 		registry.WithMaxUploadBlobSpeedBytes(maxUploadBlobSpeedBytes),
 	}
+	piServerOptions = append(piServerOptions, opts...)
 	reg := registry.NewPiServer(ociClient, group, log, sd, piServerOptions...)
 	regSrv, err := reg.Server(piAddr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	g.Go(func() error {
-		if err := regSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		listen := regSrv.ListenAndServe
+		if regSrv.TLSConfig != nil {
+			// Certificates are part of the TLS configuration.
+			listen = func() error { return regSrv.ListenAndServeTLS("", "") }
+		}
+		if err := listen(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			return err
 		}
 		return nil
 	})
 	g.Go(func() error {
 		<-ctx.Done()
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		// Transfers in flight are given time to finish.
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 		defer cancel()
 		return regSrv.Shutdown(shutdownCtx)
 	})
-	return nil
+	return reg, nil
 }
 
 func startRegistryServer(ctx context.Context,
@@ -180,6 +405,8 @@ func startRegistryServer(ctx context.Context,
 
 func startMetricsServer(ctx context.Context,
 	metricsAddr string,
+	peerScores *registry.PeerScores,
+	drainer http.Handler,
 	g *errgroup.Group,
 ) error {
 	metrics.Register()
@@ -196,6 +423,10 @@ func startMetricsServer(ctx context.Context,
 
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.HandlerFor(metrics.DefaultGatherer, promhttp.HandlerOpts{}))
+	mux.Handle("/debug/peers", peerScores)
+	if drainer != nil {
+		mux.Handle("/drain", drainer)
+	}
 	mux.Handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
 	mux.Handle("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
 	mux.Handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
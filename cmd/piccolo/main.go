@@ -1,17 +1,27 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"log/slog"
 
 	"github.com/alexflint/go-arg"
 	"github.com/gin-gonic/gin"
 	"github.com/go-logr/logr"
+	"github.com/laixintao/piccolo/internal/tlsconfig"
 	"github.com/laixintao/piccolo/pkg/distributionapi/evictor"
 	distributionHandler "github.com/laixintao/piccolo/pkg/distributionapi/handler"
 	"github.com/laixintao/piccolo/pkg/distributionapi/metrics"
@@ -20,6 +30,7 @@ import (
 	"github.com/laixintao/piccolo/pkg/distributionapi/storage"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sync/errgroup"
 )
 
 var (
@@ -35,9 +46,18 @@ type GlobalArgs struct {
 
 type ServerCmd struct {
 	GlobalArgs
-	PiccoloAddress string   `arg:"--piccolo-address,env:HOST" default:"0.0.0.0:7789" help:"Piccolo HTTP address"`
-	EnableEvictor  bool     `arg:"--enable-evictor,env:ENABLE_EVICTOR" default:"false" help:"Enable evictor to clean up dead hosts automatically"`
-	DbDsnList      []string `arg:"--db-dsn-list,env:DB_DSN_LIST,required" help:"DB DSN list in format '<group>:<dbtype>:<dsn>'. dbtype can be 'master' or 'slave'. Example: 'default:master:user:pass@tcp(host:3306)/db1' 'us-1:master:user:pass@tcp(host:3306)/db2'"`
+	PiccoloAddress    string        `arg:"--piccolo-address,env:HOST" default:"0.0.0.0:7789" help:"Piccolo HTTP address"`
+	EnableEvictor     bool          `arg:"--enable-evictor,env:ENABLE_EVICTOR" default:"false" help:"Enable evictor to clean up dead hosts automatically"`
+	DbDsnList         []string      `arg:"--db-dsn-list,env:DB_DSN_LIST,required" help:"DB DSN list in format '<group>:<dbtype>:<dsn>'. dbtype can be 'master' or 'slave' for MySQL, 'bolt' for an embedded database file or 'redis' for a redis server shared by all groups. Example: 'default:master:user:pass@tcp(host:3306)/db1' 'us-1:master:user:pass@tcp(host:3306)/db2', 'default:bolt:/var/lib/piccolo/piccolo.db' or 'default:redis:redis://host:6379/0'"`
+	TLSCertFile       string        `arg:"--tls-cert-file,env:PICCOLO_TLS_CERT_FILE" help:"Certificate of piccolo, when set the API is served over TLS."`
+	TLSKeyFile        string        `arg:"--tls-key-file,env:PICCOLO_TLS_KEY_FILE" help:"Private key of the certificate set with --tls-cert-file."`
+	TLSClientCA       string        `arg:"--tls-client-ca-file,env:PICCOLO_TLS_CLIENT_CA_FILE" help:"CA used to verify pi agents, when set pi agents have to present a client certificate signed by this CA."`
+	FindKeyCacheSize  int           `arg:"--findkey-cache-size,env:FINDKEY_CACHE_SIZE" default:"10000" help:"Number of keys whose holders, and of hosts whose labels and utilization, are cached in memory for findkey, 0 disables the cache."`
+	FindKeyCacheTTL   time.Duration `arg:"--findkey-cache-ttl,env:FINDKEY_CACHE_TTL" default:"5s" help:"How long the holders of a key are cached, this bounds how long writes through other piccolo instances are not visible."`
+	TopologyHierarchy string        `arg:"--topology-hierarchy,env:TOPOLOGY_HIERARCHY" default:"region,zone,rack,nodepool" help:"Comma separated label hierarchy holders are ranked by, from the broadest to the narrowest label. Holders sharing more leading labels with the requester are returned first, the IP prefix breaks ties. Empty disables topology ranking."`
+	LoadBalanceWindow int           `arg:"--load-balance-window,env:LOAD_BALANCE_WINDOW" default:"4" help:"Holders are picked with power of two choices by their reported load among this many holders of the locality ranking, below 2 holders are returned in ranking order."`
+	GroupFallbacks    []string      `arg:"--group-fallbacks,env:GROUP_FALLBACKS" help:"Groups whose lookups may return holders of other groups when the group has not enough holders, in format '<group>:<fallback>'. Fallbacks are searched in order, fallbacks of fallbacks after them. Example: 'us-1a:us-1' 'us-1:us'"`
+	TokenFile         string        `arg:"--token-file,env:PICCOLO_TOKEN_FILE" help:"File with one '<group>:<token>' per line, when set write and admin requests need a bearer token allowed for the group. Group '*' allows every group. Tokens are only read from this file, they can not be stored in the database."`
 }
 
 type MigrateCmd struct {
@@ -45,9 +65,19 @@ type MigrateCmd struct {
 	Databases []string `arg:"positional,required" help:"Database DSN(s) to migrate"`
 }
 
+type PrepullCmd struct {
+	GlobalArgs
+	Address string `arg:"--address,env:PICCOLO_ADDRESS" default:"http://127.0.0.1:7789" help:"Piccolo API URL"`
+	Token   string `arg:"--token,env:PICCOLO_TOKEN" help:"Bearer token allowed to write to the group"`
+	Group   string `arg:"--group" default:"default" help:"Group whose pi agents pull the image"`
+	Image   string `arg:"--image" help:"Image to pull on every pi of the group"`
+	ID      uint   `arg:"--id" help:"Show the progress of the prepull with this id instead of creating one"`
+}
+
 type Arguments struct {
 	Server  *ServerCmd  `arg:"subcommand:server" help:"Start Piccolo server"`
 	Migrate *MigrateCmd `arg:"subcommand:migrate-db" help:"Migrate database schema to multiple databases"`
+	Prepull *PrepullCmd `arg:"subcommand:prepull" help:"Ask every pi of a group to pull an image, or show the progress of a prepull"`
 }
 
 func (Arguments) Description() string {
@@ -66,7 +96,7 @@ func main() {
 	parser := arg.MustParse(args)
 
 	// Default to server command if no subcommand specified
-	if args.Server == nil && args.Migrate == nil {
+	if args.Server == nil && args.Migrate == nil && args.Prepull == nil {
 		// Re-parse with server as default
 		oldArgs := os.Args
 		os.Args = append([]string{os.Args[0], "server"}, os.Args[1:]...)
@@ -79,6 +109,11 @@ func main() {
 		runServer(args.Server)
 	} else if args.Migrate != nil {
 		runMigrate(args.Migrate)
+	} else if args.Prepull != nil {
+		if err := runPrepull(args.Prepull); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	} else {
 		parser.WriteHelp(os.Stdout)
 		os.Exit(1)
@@ -94,17 +129,38 @@ func runServer(args *ServerCmd) {
 	log := logr.FromSlogHandler(handler)
 	log.Info("log init, Piccolo started")
 
-	db, groups, masterResolvers, err := storage.InitMySQL(args.DbDsnList)
+	dbm, err := storage.Open(args.DbDsnList)
 	if err != nil {
-		log.Error(err, "failed to connect to MySQL database")
+		log.Error(err, "failed to connect to database")
 		os.Exit(1)
 	}
 
-	log.Info("MySQL database connected", "groups", groups, "masterResolvers", masterResolvers)
+	log.Info("database connected", "groups", dbm.GetGroups(), "masterResolvers", dbm.GetMasterResolvers())
 
-	dbm := storage.NewManager(db, groups, masterResolvers)
-	distributionHandler := distributionHandler.NewDistributionHandler(dbm, log)
-	defer dbm.Close()
+	if args.FindKeyCacheSize > 0 {
+		dbm.Distribution = storage.NewCachedDistributionStore(dbm.Distribution, args.FindKeyCacheSize, args.FindKeyCacheTTL)
+		dbm.Host = storage.NewCachedHostStore(dbm.Host, args.FindKeyCacheSize, args.FindKeyCacheTTL)
+		log.Info("findkey cache enabled", "size", args.FindKeyCacheSize, "ttl", args.FindKeyCacheTTL)
+	}
+	handlerOpts := []distributionHandler.Option{}
+	if hierarchy := splitList(args.TopologyHierarchy); len(hierarchy) > 0 {
+		handlerOpts = append(handlerOpts, distributionHandler.WithTopologyHierarchy(hierarchy))
+		log.Info("topology ranking enabled", "hierarchy", hierarchy)
+	}
+	if args.LoadBalanceWindow > 1 {
+		handlerOpts = append(handlerOpts, distributionHandler.WithLoadBalancing(args.LoadBalanceWindow))
+		log.Info("load balancing enabled", "window", args.LoadBalanceWindow)
+	}
+	if len(args.GroupFallbacks) > 0 {
+		fallbacks, err := distributionHandler.ParseGroupFallbacks(args.GroupFallbacks)
+		if err != nil {
+			log.Error(err, "invalid group fallbacks")
+			os.Exit(1)
+		}
+		handlerOpts = append(handlerOpts, distributionHandler.WithGroupFallbacks(fallbacks))
+		log.Info("group fallbacks enabled", "fallbacks", fallbacks)
+	}
+	distributionHandler := distributionHandler.NewDistributionHandler(dbm, log, handlerOpts...)
 
 	log.Info("image store initialized")
 
@@ -139,36 +195,119 @@ func runServer(args *ServerCmd) {
 	}
 	log.Info("pprof endpoints registered at /debug/pprof")
 
+	var tokens *middleware.Tokens
+	if args.TokenFile != "" {
+		tokens, err = middleware.LoadTokens(args.TokenFile)
+		if err != nil {
+			log.Error(err, "failed to load token file", "path", args.TokenFile)
+			os.Exit(1)
+		}
+		log.Info("token authentication enabled for write and admin requests", "path", args.TokenFile)
+	}
+	requireToken := middleware.GroupTokenAuth(tokens)
+
 	v1 := r.Group("/api/v1")
 	{
-		v1.POST("/keepalive", distributionHandler.KeepAlive)
+		v1.POST("/keepalive", requireToken, distributionHandler.KeepAlive)
+		v1.POST("/deregister", requireToken, distributionHandler.Deregister)
+		v1.POST("/load", requireToken, distributionHandler.ReportLoad)
 		images := v1.Group("/distribution")
 		{
-			images.POST("/advertise", distributionHandler.AdvertiseImage)
+			images.POST("/advertise", requireToken, distributionHandler.AdvertiseImage)
 			images.GET("/findkey", distributionHandler.FindKey)
-			images.POST("/sync", distributionHandler.Sync)
+			images.POST("/findkeys", distributionHandler.FindKeys)
+			images.POST("/sync", requireToken, distributionHandler.Sync)
+			images.POST("/syncdelta", requireToken, distributionHandler.SyncDelta)
+			images.POST("/withdraw", requireToken, distributionHandler.Withdraw)
+			images.POST("/report", requireToken, distributionHandler.ReportBadHolder)
+		}
+		prepull := v1.Group("/prepull")
+		{
+			prepull.POST("", requireToken, distributionHandler.CreatePrepull)
+			prepull.GET("/pending", distributionHandler.PendingPrepulls)
+			prepull.GET("/:id", distributionHandler.GetPrepull)
+			prepull.POST("/status", requireToken, distributionHandler.ReportPrepullStatus)
+		}
+		admin := v1.Group("/admin", requireToken)
+		{
+			admin.GET("/groups", distributionHandler.ListGroups)
+			admin.GET("/hosts", distributionHandler.ListHosts)
+			admin.GET("/keys", distributionHandler.ListKeys)
+			admin.GET("/holders", distributionHandler.ListHolders)
+			admin.GET("/topkeys", distributionHandler.TopKeys)
 		}
 	}
 
 	log.Info("server starting", "piccolo-address", args.PiccoloAddress, "evictor-enabled", args.EnableEvictor)
 
-	ctx := logr.NewContext(context.Background(), log)
-	
+	ctx, stop := signal.NotifyContext(logr.NewContext(context.Background(), log), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	g, ctx := errgroup.WithContext(ctx)
+
 	// Set evictor enabled metric
 	if args.EnableEvictor {
 		metrics.EvictorEnabled.Set(1)
 		log.Info("Evictor enabled, starting background cleanup goroutine")
-		go evictor.StartEvictor(ctx, dbm)
+		g.Go(func() error {
+			return evictor.StartEvictor(ctx, dbm)
+		})
 	} else {
 		metrics.EvictorEnabled.Set(0)
 		log.Info("Evictor disabled, dead hosts will not be cleaned up automatically")
 	}
 
 	// Start server with configured host and port
-	if err := r.Run(args.PiccoloAddress); err != nil {
-		log.Error(err, "server failed to start")
+	srv := &http.Server{
+		Addr:    args.PiccoloAddress,
+		Handler: r,
+	}
+	listen := srv.ListenAndServe
+	if args.TLSCertFile != "" {
+		tlsConfig, err := tlsconfig.Server(args.TLSCertFile, args.TLSKeyFile, args.TLSClientCA)
+		if err != nil {
+			log.Error(err, "invalid TLS configuration")
+			os.Exit(1)
+		}
+		srv.TLSConfig = tlsConfig
+		log.Info("serving with TLS", "mutual", args.TLSClientCA != "")
+		// Certificates are part of the TLS configuration.
+		listen = func() error { return srv.ListenAndServeTLS("", "") }
+	}
+	g.Go(func() error {
+		if err := listen(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	})
+	g.Go(func() error {
+		<-ctx.Done()
+		log.Info("shutting down server")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	})
+
+	err = g.Wait()
+	// The database is closed after requests and the evictor are done with it.
+	if closeErr := dbm.Close(); closeErr != nil {
+		log.Error(closeErr, "failed to close database")
+	}
+	if err != nil {
+		log.Error(err, "server failed")
 		os.Exit(1)
 	}
+	log.Info("server stopped")
+}
+
+// splitList splits a comma separated list, empty items are left out.
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 func runMigrate(args *MigrateCmd) {
@@ -192,7 +331,7 @@ func runMigrate(args *MigrateCmd) {
 		}
 		log.Info("Database connected", "index", i+1)
 
-		if err := storage.AutoMigrate(db, &model.Distribution{}, &model.Host{}); err != nil {
+		if err := storage.AutoMigrate(db, &model.Distribution{}, &model.Host{}, &model.Prepull{}, &model.PrepullHostStatus{}); err != nil {
 			log.Error(err, "failed to migrate database schema", "index", i+1)
 			os.Exit(1)
 		}
@@ -202,6 +341,51 @@ func runMigrate(args *MigrateCmd) {
 	log.Info("All databases migration completed successfully!", "total", len(args.Databases))
 }
 
+// runPrepull creates a prepull, or prints the progress of the prepull with --id.
+func runPrepull(args *PrepullCmd) error {
+	address := strings.TrimSuffix(args.Address, "/")
+	method, target := http.MethodGet, fmt.Sprintf("%s/api/v1/prepull/%d?group=%s", address, args.ID, url.QueryEscape(args.Group))
+	var body []byte
+	if args.ID == 0 {
+		if args.Image == "" {
+			return errors.New("either --image or --id is required")
+		}
+		b, err := json.Marshal(model.CreatePrepullRequest{Image: args.Image, Group: args.Group})
+		if err != nil {
+			return err
+		}
+		method, target, body = http.MethodPost, address+"/api/v1/prepull", b
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if args.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+args.Token)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("piccolo responded with %s: %s", resp.Status, b)
+	}
+	out := bytes.Buffer{}
+	if err := json.Indent(&out, b, "", "  "); err != nil {
+		return err
+	}
+	fmt.Println(out.String())
+	return nil
+}
+
 func registerVersionMetric() {
 	versionMetric := prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -13,7 +13,10 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-var ErrNotFound = errors.New("404 not found")
+var (
+	ErrNotFound = errors.New("404 not found")
+	ErrConflict = errors.New("409 conflict")
+)
 
 const INITIAL_BACKOFF = 200 * time.Millisecond
 const MAX_BACKOFF = 10 * time.Second
@@ -99,6 +102,13 @@ func DoRequestWithRetry(
 					metrics.WithLabelValues("fail").Inc()
 				}
 				return nil, fmt.Errorf("url: %s, err: %w, respBody: %s", url, ErrNotFound, respBody)
+			case resp.StatusCode == http.StatusConflict:
+				respBody, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if metrics != nil {
+					metrics.WithLabelValues("fail").Inc()
+				}
+				return nil, fmt.Errorf("url: %s, err: %w, respBody: %s", url, ErrConflict, respBody)
 			case resp.StatusCode >= 400:
 				respBody, _ := io.ReadAll(resp.Body)
 				resp.Body.Close()
@@ -0,0 +1,132 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	ca := &testCA{cert: cert, key: key, dir: t.TempDir()}
+	ca.write(t, "ca.pem", "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) write(t *testing.T, name, typ string, b []byte) string {
+	t.Helper()
+
+	p := filepath.Join(ca.dir, name)
+	err := os.WriteFile(p, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0o600)
+	require.NoError(t, err)
+	return p
+}
+
+// issue returns the certificate and key file of a new leaf certificate.
+func (ca *testCA) issue(t *testing.T, name string, serial int64) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return ca.write(t, name+".pem", "CERTIFICATE", der), ca.write(t, name+"-key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+func TestMutualTLS(t *testing.T) {
+	t.Parallel()
+
+	ca := newTestCA(t)
+	caFile := filepath.Join(ca.dir, "ca.pem")
+	serverCert, serverKey := ca.issue(t, "server", 2)
+	clientCert, clientKey := ca.issue(t, "client", 3)
+
+	serverCfg, err := Server(serverCert, serverKey, caFile)
+	require.NoError(t, err)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		require.Equal(t, "client", req.TLS.PeerCertificates[0].Subject.CommonName)
+		rw.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = serverCfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	clientCfg, err := Client(clientCert, clientKey, caFile)
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientCfg}}
+	resp, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Clients without certificate are rejected.
+	anonymousCfg, err := Client("", "", caFile)
+	require.NoError(t, err)
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: anonymousCfg}}
+	_, err = client.Get(srv.URL)
+	require.Error(t, err)
+
+	_, err = Server(serverCert, "", caFile)
+	require.EqualError(t, err, "both certificate and key file are required to serve TLS")
+	_, err = Client("", "", serverKey)
+	require.ErrorContains(t, err, "no certificates found in CA file")
+}
+
+func TestVerifyAddr(t *testing.T) {
+	t.Parallel()
+
+	ca := newTestCA(t)
+	cert, key := ca.issue(t, "server", 2)
+	cfg, err := Server(cert, key, "")
+	require.NoError(t, err)
+
+	require.NoError(t, VerifyAddr(cfg, "127.0.0.1:5000"))
+	require.NoError(t, VerifyAddr(cfg, ":5000"))
+	require.ErrorContains(t, VerifyAddr(cfg, "10.0.0.1:5000"), "certificate is valid for 127.0.0.1, not 10.0.0.1")
+}
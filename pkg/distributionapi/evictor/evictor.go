@@ -80,6 +80,10 @@ func evictDeadHosts(ctx context.Context, m *storage.Manager) error {
 
 		log.Info("Found dead hosts", "masterResolver", masterResolver, "count", len(deadHosts))
 		for _, dh := range deadHosts {
+			// Hosts left over are evicted by the next piccolo.
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			metrics.EvictorDeletedHostTotal.WithLabelValues().Inc()
 			log.Info("Evict dead host", "host", dh.HostAddr, "group", dh.Group, "masterResolver", masterResolver)
 			
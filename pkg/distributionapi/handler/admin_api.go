@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/laixintao/piccolo/pkg/distributionapi/middleware"
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
+)
+
+const (
+	// defaultPageLimit is the page size of admin listings without limit.
+	defaultPageLimit = 100
+	// maxPageLimit is the largest page size of admin listings.
+	maxPageLimit = 1000
+)
+
+func pageLimit(req model.PageRequest) int {
+	if req.Limit == 0 {
+		return defaultPageLimit
+	}
+	return min(req.Limit, maxPageLimit)
+}
+
+// ListGroups returns the groups the token may access with their number of hosts
+// GET /api/v1/admin/groups?offset=0&limit=100
+func (h *DistributionHandler) ListGroups(c *gin.Context) {
+	var req model.PageRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Wrong request format: " + err.Error()})
+		return
+	}
+
+	groups := []model.GroupSummary{}
+	seen := map[string]struct{}{}
+	for _, masterResolver := range h.m.GetMasterResolvers() {
+		found, err := h.m.Host.ListGroupsByMasterResolver(masterResolver)
+		if err != nil {
+			h.log.Error(err, "failed to list groups", "masterResolver", masterResolver)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error when listing groups: " + err.Error()})
+			return
+		}
+		for _, group := range found {
+			// Resolvers sharing a database list the same groups.
+			if _, ok := seen[group.Group]; ok {
+				continue
+			}
+			seen[group.Group] = struct{}{}
+			if middleware.GroupAllowed(c, group.Group) {
+				groups = append(groups, group)
+			}
+		}
+	}
+	slices.SortFunc(groups, func(a, b model.GroupSummary) int {
+		return strings.Compare(a.Group, b.Group)
+	})
+
+	total := len(groups)
+	offset := min(req.Offset, total)
+	groups = groups[offset : offset+min(pageLimit(req), total-offset)]
+	c.JSON(http.StatusOK, model.ListGroupsResponse{
+		Groups: groups,
+		Total:  int64(total),
+	})
+}
+
+// ListHosts returns the hosts of the group with their last keepalive
+// GET /api/v1/admin/hosts?group=xxx&offset=0&limit=100
+func (h *DistributionHandler) ListHosts(c *gin.Context) {
+	var req model.ListHostsRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Wrong request format: " + err.Error()})
+		return
+	}
+
+	if !requireGroup(c, req.Group, jsonError) {
+		return
+	}
+
+	hosts, total, err := h.m.Host.ListHosts(req.Group, req.Offset, pageLimit(req.PageRequest))
+	if err != nil {
+		h.log.Error(err, "failed to list hosts", "group", req.Group)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error when listing hosts: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, model.ListHostsResponse{
+		Group: req.Group,
+		Hosts: hosts,
+		Total: total,
+	})
+}
+
+// ListKeys returns the keys held by a host
+// GET /api/v1/admin/keys?group=xxx&holder=xxx&offset=0&limit=100
+func (h *DistributionHandler) ListKeys(c *gin.Context) {
+	var req model.ListKeysRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Wrong request format: " + err.Error()})
+		return
+	}
+
+	if !requireGroup(c, req.Group, jsonError) {
+		return
+	}
+
+	keys, total, err := h.m.Distribution.ListKeysByHolder(req.Group, req.Holder, req.Offset, pageLimit(req.PageRequest))
+	if err != nil {
+		h.log.Error(err, "failed to list keys", "holder", req.Holder, "group", req.Group)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error when listing keys: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, model.ListKeysResponse{
+		Group:  req.Group,
+		Holder: req.Holder,
+		Keys:   keys,
+		Total:  total,
+	})
+}
+
+// ListHolders returns the holders of a key with their last keepalive, labels
+// and utilization
+// GET /api/v1/admin/holders?group=xxx&key=xxx&offset=0&limit=100
+func (h *DistributionHandler) ListHolders(c *gin.Context) {
+	var req model.ListHoldersRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Wrong request format: " + err.Error()})
+		return
+	}
+
+	if !requireGroup(c, req.Group, jsonError) {
+		return
+	}
+
+	distributions, total, err := h.m.Distribution.ListHoldersByKey(req.Group, req.Key, req.Offset, pageLimit(req.PageRequest))
+	if err != nil {
+		h.log.Error(err, "failed to list holders", "key", req.Key, "group", req.Group)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error when listing holders: " + err.Error()})
+		return
+	}
+	holderAddrs := make([]string, 0, len(distributions))
+	for _, d := range distributions {
+		holderAddrs = append(holderAddrs, d.Holder)
+	}
+	hosts, err := h.m.Host.GetHosts(req.Group, holderAddrs)
+	if err != nil {
+		h.log.Error(err, "failed to get holders", "key", req.Key, "group", req.Group)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error when getting holders: " + err.Error()})
+		return
+	}
+
+	holders := make([]model.KeyHolder, 0, len(distributions))
+	for _, d := range distributions {
+		host := hosts[d.Holder]
+		holders = append(holders, model.KeyHolder{
+			Holder:       d.Holder,
+			AdvertisedAt: d.CreatedAt,
+			LastSeen:     host.LastSeen,
+			Labels:       host.Labels,
+			Utilization:  host.Utilization,
+		})
+	}
+	c.JSON(http.StatusOK, model.ListHoldersResponse{
+		Group:   req.Group,
+		Key:     req.Key,
+		Holders: holders,
+		Total:   total,
+	})
+}
+
+// TopKeys returns the keys of the group with the most holders first
+// GET /api/v1/admin/topkeys?group=xxx&offset=0&limit=100
+func (h *DistributionHandler) TopKeys(c *gin.Context) {
+	var req model.TopKeysRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Wrong request format: " + err.Error()})
+		return
+	}
+
+	if !requireGroup(c, req.Group, jsonError) {
+		return
+	}
+
+	keys, total, err := h.m.Distribution.TopKeys(req.Group, req.Offset, pageLimit(req.PageRequest))
+	if err != nil {
+		h.log.Error(err, "failed to find top keys", "group", req.Group)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error when finding top keys: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, model.TopKeysResponse{
+		Group: req.Group,
+		Keys:  keys,
+		Total: total,
+	})
+}
@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/laixintao/piccolo/pkg/distributionapi/middleware"
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
+	"github.com/laixintao/piccolo/pkg/distributionapi/storage"
+)
+
+func getAdmin(t *testing.T, r *gin.Engine, target string, resp any) {
+	t.Helper()
+
+	rw := doJSON(t, r, http.MethodGet, target, nil)
+	require.Equal(t, http.StatusOK, rw.Code, rw.Body.String())
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), resp))
+}
+
+func TestAdminAPI(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter(t)
+	for holder, keys := range map[string][]string{
+		"10.0.0.1:5000": {"foo", "bar"},
+		"10.0.0.2:5000": {"foo"},
+	} {
+		rw := doJSON(t, r, http.MethodPost, "/api/v1/distribution/advertise", model.ImageAdvertiseRequest{
+			Holder: holder,
+			Keys:   keys,
+			Group:  "a",
+		})
+		require.Equal(t, http.StatusCreated, rw.Code)
+	}
+	rw := doJSON(t, r, http.MethodPost, "/api/v1/keepalive", model.KeepAliveRequest{
+		HostAddr: "10.0.0.1:5000",
+		Group:    "a",
+		Labels:   model.Labels{"zone": "a"},
+	})
+	require.Equal(t, http.StatusCreated, rw.Code)
+	rw = doJSON(t, r, http.MethodPost, "/api/v1/keepalive", model.KeepAliveRequest{HostAddr: "10.0.0.2:5000", Group: "a"})
+	require.Equal(t, http.StatusCreated, rw.Code)
+
+	groups := model.ListGroupsResponse{}
+	getAdmin(t, r, "/api/v1/admin/groups", &groups)
+	require.Equal(t, model.ListGroupsResponse{Groups: []model.GroupSummary{{Group: "a", Hosts: 2}}, Total: 1}, groups)
+
+	hosts := model.ListHostsResponse{}
+	getAdmin(t, r, "/api/v1/admin/hosts?group=a&offset=1&limit=1", &hosts)
+	require.Equal(t, int64(2), hosts.Total)
+	require.Len(t, hosts.Hosts, 1)
+	require.Equal(t, "10.0.0.2:5000", hosts.Hosts[0].HostAddr)
+	require.False(t, hosts.Hosts[0].LastSeen.IsZero())
+
+	keys := model.ListKeysResponse{}
+	getAdmin(t, r, "/api/v1/admin/keys?group=a&holder=10.0.0.1:5000", &keys)
+	require.Equal(t, []string{"bar", "foo"}, keys.Keys)
+	require.Equal(t, int64(2), keys.Total)
+
+	holders := model.ListHoldersResponse{}
+	getAdmin(t, r, "/api/v1/admin/holders?group=a&key=foo", &holders)
+	require.Equal(t, int64(2), holders.Total)
+	require.Len(t, holders.Holders, 2)
+	require.Equal(t, "10.0.0.1:5000", holders.Holders[0].Holder)
+	require.Equal(t, model.Labels{"zone": "a"}, holders.Holders[0].Labels)
+	require.False(t, holders.Holders[0].AdvertisedAt.IsZero())
+	require.False(t, holders.Holders[0].LastSeen.IsZero())
+
+	top := model.TopKeysResponse{}
+	getAdmin(t, r, "/api/v1/admin/topkeys?group=a&limit=1", &top)
+	require.Equal(t, model.TopKeysResponse{Group: "a", Keys: []model.KeyReplicas{{Key: "foo", Holders: 2}}, Total: 2}, top)
+
+	// A huge offset is an empty page.
+	groups = model.ListGroupsResponse{}
+	getAdmin(t, r, "/api/v1/admin/groups?offset=9223372036854775800", &groups)
+	require.Equal(t, model.ListGroupsResponse{Groups: []model.GroupSummary{}, Total: 1}, groups)
+	hosts = model.ListHostsResponse{}
+	getAdmin(t, r, "/api/v1/admin/hosts?group=a&offset=9223372036854775800", &hosts)
+	require.Empty(t, hosts.Hosts)
+	require.Equal(t, int64(2), hosts.Total)
+
+	rw = doJSON(t, r, http.MethodGet, "/api/v1/admin/hosts", nil)
+	require.Equal(t, http.StatusBadRequest, rw.Code)
+	rw = doJSON(t, r, http.MethodGet, "/api/v1/admin/topkeys?group=a&offset=-1", nil)
+	require.Equal(t, http.StatusBadRequest, rw.Code)
+}
+
+func TestAdminAPITokens(t *testing.T) {
+	t.Parallel()
+
+	m, err := storage.Open([]string{"default:bolt:" + filepath.Join(t.TempDir(), "piccolo.db")})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+	require.NoError(t, m.Host.RefreshHostAddr("10.0.0.1:5000", "a"))
+	require.NoError(t, m.Host.RefreshHostAddr("10.0.0.2:5000", "b"))
+
+	p := filepath.Join(t.TempDir(), "tokens")
+	require.NoError(t, os.WriteFile(p, []byte("a:foo\n"), 0o600))
+	tokens, err := middleware.LoadTokens(p)
+	require.NoError(t, err)
+	gin.SetMode(gin.TestMode)
+	h := NewDistributionHandler(m, logr.Discard())
+	r := gin.New()
+	admin := r.Group("/api/v1/admin", middleware.GroupTokenAuth(tokens))
+	admin.GET("/groups", h.ListGroups)
+	admin.GET("/hosts", h.ListHosts)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Authorization", "Bearer foo")
+		rw := httptest.NewRecorder()
+		r.ServeHTTP(rw, req)
+		return rw
+	}
+
+	// Only the groups of the token are listed.
+	rw := get("/api/v1/admin/groups")
+	require.Equal(t, http.StatusOK, rw.Code)
+	groups := model.ListGroupsResponse{}
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &groups))
+	require.Equal(t, []model.GroupSummary{{Group: "a", Hosts: 1}}, groups.Groups)
+
+	rw = get("/api/v1/admin/hosts?group=a")
+	require.Equal(t, http.StatusOK, rw.Code)
+	rw = get("/api/v1/admin/hosts?group=b")
+	require.Equal(t, http.StatusForbidden, rw.Code)
+}
@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/laixintao/piccolo/pkg/distributionapi/metrics"
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
+)
+
+// ParseGroupFallbacks parses '<group>:<fallback>' entries, a group falls back
+// to its fallbacks in the order of the entries.
+func ParseGroupFallbacks(entries []string) (map[string][]string, error) {
+	fallbacks := map[string][]string{}
+	for _, entry := range entries {
+		group, fallback, ok := strings.Cut(entry, ":")
+		group = strings.TrimSpace(group)
+		fallback = strings.TrimSpace(fallback)
+		if !ok || group == "" || fallback == "" {
+			return nil, fmt.Errorf("invalid group fallback %q, expected '<group>:<fallback>'", entry)
+		}
+		if group == fallback {
+			return nil, fmt.Errorf("group %s can not fall back to itself", group)
+		}
+		if !slices.Contains(fallbacks[group], fallback) {
+			fallbacks[group] = append(fallbacks[group], fallback)
+		}
+	}
+	return fallbacks, nil
+}
+
+// searchGroups returns the group followed by the groups it may fall back to.
+// Fallbacks of fallbacks are searched after the direct fallbacks.
+func (h *DistributionHandler) searchGroups(group string) []string {
+	groups := []string{group}
+	for i := 0; i < len(groups); i++ {
+		for _, fallback := range h.fallbacks[groups[i]] {
+			if !slices.Contains(groups, fallback) {
+				groups = append(groups, fallback)
+			}
+		}
+	}
+	return groups
+}
+
+// newHolderRankers returns the rankers of the groups searched for holders.
+func (h *DistributionHandler) newHolderRankers(group string, labels model.Labels) map[string]*holderRanker {
+	rankers := map[string]*holderRanker{}
+	for _, g := range h.searchGroups(group) {
+		rankers[g] = h.newHolderRanker(g, labels)
+	}
+	return rankers
+}
+
+// findHoldersWithFallback returns up to count holders of the key, holders of
+// the group first. If the group has fewer holders the fallback groups are
+// searched, the group of the holders found there is returned.
+func (h *DistributionHandler) findHoldersWithFallback(ctx context.Context, group, key, requestHost string, rankers map[string]*holderRanker, count int) ([]string, map[string]string, error) {
+	limit := defaultHolderCount
+	if count > 0 {
+		limit = count
+	}
+	holders := []string{}
+	var holderGroups map[string]string
+	for i, g := range h.searchGroups(group) {
+		found, err := h.findHolders(ctx, g, key, requestHost, rankers[g], limit-len(holders))
+		if err != nil {
+			if i == 0 {
+				return nil, nil, err
+			}
+			// The holders of the group are still useful.
+			h.log.Error(err, "failed to find holders in fallback group", "group", group, "fallback_group", g, "key", key)
+			continue
+		}
+		added := 0
+		for _, holder := range found {
+			if slices.Contains(holders, holder) {
+				continue
+			}
+			holders = append(holders, holder)
+			added++
+			if i > 0 {
+				if holderGroups == nil {
+					holderGroups = map[string]string{}
+				}
+				holderGroups[holder] = g
+			}
+		}
+		if i > 0 && added > 0 {
+			metrics.FindKeyFallbackTotal.WithLabelValues(group, g).Inc()
+		}
+		if len(holders) >= limit {
+			break
+		}
+	}
+	return holders, holderGroups, nil
+}
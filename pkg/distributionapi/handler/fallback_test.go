@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
+)
+
+func TestParseGroupFallbacks(t *testing.T) {
+	t.Parallel()
+
+	fallbacks, err := ParseGroupFallbacks([]string{"us-1a:us-1", "us-1a: us-2", "us-1:us", "us-1a:us-1"})
+	require.NoError(t, err)
+	require.Equal(t, map[string][]string{"us-1a": {"us-1", "us-2"}, "us-1": {"us"}}, fallbacks)
+
+	_, err = ParseGroupFallbacks([]string{"us-1a"})
+	require.EqualError(t, err, `invalid group fallback "us-1a", expected '<group>:<fallback>'`)
+	_, err = ParseGroupFallbacks([]string{"us-1:us-1"})
+	require.EqualError(t, err, "group us-1 can not fall back to itself")
+}
+
+func TestFindKeyFallback(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter(t, WithGroupFallbacks(map[string][]string{
+		"us-1a": {"us-1"},
+		"us-1":  {"us", "us-1a"},
+	}))
+	for holder, group := range map[string]string{
+		"10.0.0.1:5000": "us-1a",
+		"10.1.0.1:5000": "us-1",
+		"10.2.0.1:5000": "us",
+		"10.3.0.1:5000": "eu",
+	} {
+		rw := doJSON(t, r, http.MethodPost, "/api/v1/distribution/advertise", model.ImageAdvertiseRequest{
+			Holder: holder,
+			Keys:   []string{"foo"},
+			Group:  group,
+		})
+		require.Equal(t, http.StatusCreated, rw.Code)
+	}
+
+	rw := doJSON(t, r, http.MethodGet, "/api/v1/distribution/findkey?key=foo&group=us-1a&request_host=10.2.0.2", nil)
+	require.Equal(t, http.StatusOK, rw.Code)
+	resp := model.FindKeyResponse{}
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &resp))
+	require.Equal(t, []string{"10.0.0.1:5000", "10.1.0.1:5000", "10.2.0.1:5000"}, resp.Holders)
+	require.Equal(t, map[string]string{"10.1.0.1:5000": "us-1", "10.2.0.1:5000": "us"}, resp.HolderGroups)
+
+	// Fallback groups are only searched if the group has not enough holders.
+	rw = doJSON(t, r, http.MethodGet, "/api/v1/distribution/findkey?key=foo&group=us-1a&count=1", nil)
+	require.Equal(t, http.StatusOK, rw.Code)
+	resp = model.FindKeyResponse{}
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &resp))
+	require.Equal(t, []string{"10.0.0.1:5000"}, resp.Holders)
+	require.Empty(t, resp.HolderGroups)
+
+	require.Equal(t, []string{"10.2.0.1:5000"}, findHolders(t, r, "/api/v1/distribution/findkey?key=foo&group=us"))
+	require.Equal(t, []string{"10.3.0.1:5000"}, findHolders(t, r, "/api/v1/distribution/findkey?key=foo&group=eu"))
+
+	rw = doJSON(t, r, http.MethodPost, "/api/v1/distribution/findkeys", model.FindKeysRequest{
+		Keys:  []string{"foo"},
+		Group: "us-1",
+	})
+	require.Equal(t, http.StatusOK, rw.Code)
+	keysResp := model.FindKeysResponse{}
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &keysResp))
+	require.Equal(t, map[string][]string{"foo": {"10.1.0.1:5000", "10.2.0.1:5000", "10.0.0.1:5000"}}, keysResp.Holders)
+	require.Equal(t, map[string]string{"10.2.0.1:5000": "us", "10.0.0.1:5000": "us-1a"}, keysResp.HolderGroups)
+}
@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/distribution/reference"
+	"github.com/gin-gonic/gin"
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
+	"github.com/laixintao/piccolo/pkg/distributionapi/storage"
+)
+
+const (
+	// PrepullMaxAge is how long pi agents keep picking up a prepull, hosts
+	// joining the group later do not pull old images.
+	PrepullMaxAge = 24 * time.Hour
+	// prepullMaxMessage is the size of the message column.
+	prepullMaxMessage = 1024
+)
+
+// CreatePrepull asks every pi of the group to pull an image
+// POST /api/v1/prepull
+func (h *DistributionHandler) CreatePrepull(c *gin.Context) {
+	var req model.CreatePrepullRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Wrong request format: " + err.Error()})
+		return
+	}
+
+	if !requireGroup(c, req.Group, jsonError) {
+		return
+	}
+
+	ref, err := reference.ParseDockerRef(req.Image)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image reference: " + err.Error()})
+		return
+	}
+
+	prepull := &model.Prepull{Image: ref.String(), Group: req.Group}
+	if err := h.m.Prepull.CreatePrepull(prepull); err != nil {
+		h.log.Error(err, "failed to create prepull", "image", prepull.Image, "group", prepull.Group)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error when creating prepull: " + err.Error()})
+		return
+	}
+
+	h.log.Info("prepull created", "id", prepull.ID, "image", prepull.Image, "group", prepull.Group)
+	c.JSON(http.StatusOK, model.PrepullResponse{
+		Prepull: *prepull,
+		Hosts:   []model.PrepullHostStatus{},
+	})
+}
+
+// GetPrepull returns a prepull and its progress on every host
+// GET /api/v1/prepull/:id?group=xxx
+func (h *DistributionHandler) GetPrepull(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid prepull id: " + c.Param("id")})
+		return
+	}
+	group := c.DefaultQuery("group", "default")
+
+	prepull, hosts, err := h.m.Prepull.GetPrepull(group, uint(id))
+	if errors.Is(err, storage.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Prepull not found"})
+		return
+	}
+	if err != nil {
+		h.log.Error(err, "failed to get prepull", "id", id, "group", group)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error when getting prepull: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, model.PrepullResponse{
+		Prepull: *prepull,
+		Hosts:   hosts,
+	})
+}
+
+// PendingPrepulls returns the prepulls the host has not finished yet
+// GET /api/v1/prepull/pending?group=xxx&host=xxx
+func (h *DistributionHandler) PendingPrepulls(c *gin.Context) {
+	var req model.PendingPrepullsRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Wrong request format: " + err.Error()})
+		return
+	}
+
+	prepulls, err := h.m.Prepull.PendingPrepulls(req.Group, req.Host, time.Now().Add(-PrepullMaxAge))
+	if err != nil {
+		h.log.Error(err, "failed to find pending prepulls", "host", req.Host, "group", req.Group)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error when finding pending prepulls: " + err.Error()})
+		return
+	}
+	if prepulls == nil {
+		prepulls = []model.Prepull{}
+	}
+
+	c.JSON(http.StatusOK, model.PendingPrepullsResponse{
+		Prepulls: prepulls,
+	})
+}
+
+// ReportPrepullStatus records the progress of a prepull on a host
+// POST /api/v1/prepull/status
+func (h *DistributionHandler) ReportPrepullStatus(c *gin.Context) {
+	var req model.PrepullStatusRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Wrong request format: " + err.Error()})
+		return
+	}
+
+	if !requireGroup(c, req.Group, jsonError) {
+		return
+	}
+
+	if _, _, err := h.m.Prepull.GetPrepull(req.Group, req.PrepullID); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Prepull not found"})
+			return
+		}
+		h.log.Error(err, "failed to get prepull", "id", req.PrepullID, "group", req.Group)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error when getting prepull: " + err.Error()})
+		return
+	}
+
+	message := truncateUTF8(req.Message, prepullMaxMessage)
+	err := h.m.Prepull.UpdatePrepullStatus(&model.PrepullHostStatus{
+		PrepullID: req.PrepullID,
+		Host:      req.Host,
+		Group:     req.Group,
+		Status:    req.Status,
+		Message:   message,
+	})
+	if err != nil {
+		h.log.Error(err, "failed to update prepull status", "id", req.PrepullID, "host", req.Host, "group", req.Group)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error when updating prepull status: " + err.Error()})
+		return
+	}
+
+	h.log.Info("prepull status updated", "id", req.PrepullID, "host", req.Host, "group", req.Group, "status", req.Status)
+	c.JSON(http.StatusOK, gin.H{"message": "Status updated!"})
+}
+
+// truncateUTF8 cuts s to at most size bytes without splitting a rune.
+func truncateUTF8(s string, size int) string {
+	if len(s) <= size {
+		return s
+	}
+	for size > 0 && !utf8.RuneStart(s[size]) {
+		size--
+	}
+	return s[:size]
+}
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
+)
+
+func pendingPrepulls(t *testing.T, r *gin.Engine, host string) []model.Prepull {
+	t.Helper()
+
+	rw := doJSON(t, r, http.MethodGet, "/api/v1/prepull/pending?group=default&host="+host, nil)
+	require.Equal(t, http.StatusOK, rw.Code)
+	resp := model.PendingPrepullsResponse{}
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &resp))
+	return resp.Prepulls
+}
+
+func TestPrepull(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter(t)
+	rw := doJSON(t, r, http.MethodPost, "/api/v1/prepull", model.CreatePrepullRequest{Image: "nginx", Group: "default"})
+	require.Equal(t, http.StatusOK, rw.Code)
+	created := model.PrepullResponse{}
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &created))
+	require.Equal(t, "docker.io/library/nginx:latest", created.Prepull.Image)
+	rw = doJSON(t, r, http.MethodPost, "/api/v1/prepull", model.CreatePrepullRequest{Image: "Invalid:Image", Group: "default"})
+	require.Equal(t, http.StatusBadRequest, rw.Code)
+
+	pending := pendingPrepulls(t, r, "10.0.0.1:5000")
+	require.Len(t, pending, 1)
+	require.Equal(t, created.Prepull.ID, pending[0].ID)
+
+	rw = doJSON(t, r, http.MethodPost, "/api/v1/prepull/status", model.PrepullStatusRequest{
+		PrepullID: created.Prepull.ID,
+		Host:      "10.0.0.1:5000",
+		Group:     "default",
+		Status:    model.PrepullStatusDone,
+	})
+	require.Equal(t, http.StatusOK, rw.Code)
+	rw = doJSON(t, r, http.MethodPost, "/api/v1/prepull/status", model.PrepullStatusRequest{
+		PrepullID: created.Prepull.ID,
+		Host:      "10.0.0.2:5000",
+		Group:     "default",
+		Status:    model.PrepullStatusPulling,
+	})
+	require.Equal(t, http.StatusOK, rw.Code)
+	rw = doJSON(t, r, http.MethodPost, "/api/v1/prepull/status", model.PrepullStatusRequest{
+		PrepullID: created.Prepull.ID + 1,
+		Host:      "10.0.0.2:5000",
+		Group:     "default",
+		Status:    model.PrepullStatusDone,
+	})
+	require.Equal(t, http.StatusNotFound, rw.Code)
+	require.Empty(t, pendingPrepulls(t, r, "10.0.0.1:5000"))
+	require.Len(t, pendingPrepulls(t, r, "10.0.0.2:5000"), 1)
+
+	id := strconv.FormatUint(uint64(created.Prepull.ID), 10)
+	rw = doJSON(t, r, http.MethodGet, "/api/v1/prepull/"+id+"?group=default", nil)
+	require.Equal(t, http.StatusOK, rw.Code)
+	progress := model.PrepullResponse{}
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &progress))
+	require.Len(t, progress.Hosts, 2)
+	rw = doJSON(t, r, http.MethodGet, "/api/v1/prepull/"+id+"?group=other", nil)
+	require.Equal(t, http.StatusNotFound, rw.Code)
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		s        string
+		size     int
+		expected string
+	}{
+		{s: "abc", size: 3, expected: "abc"},
+		{s: "abcd", size: 3, expected: "abc"},
+		// "é" is 2 bytes and "世" 3 bytes, partial runes are dropped.
+		{s: "aé", size: 2, expected: "a"},
+		{s: "a世b", size: 3, expected: "a"},
+		{s: "a世b", size: 4, expected: "a世"},
+		{s: "世", size: 2, expected: ""},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.expected, truncateUTF8(tt.s, tt.size))
+	}
+}
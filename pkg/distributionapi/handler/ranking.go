@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"math/rand/v2"
+	"slices"
+
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
+	"github.com/laixintao/piccolo/pkg/distributionapi/storage"
+)
+
+// holderRanker ranks holders by the labels they share with the requester and
+// spreads requests by the load of the holders. The hosts of holders are
+// looked up once per request.
+type holderRanker struct {
+	hostStore storage.HostStore
+	group     string
+	// Hierarchy and labels are empty if the requester did not send labels.
+	hierarchy []string
+	labels    model.Labels
+	window    int
+	// Hosts of the holders looked up so far, nil for unknown holders.
+	hosts map[string]*model.Host
+}
+
+// newHolderRanker returns nil if holders are neither ranked by topology nor
+// by load.
+func (h *DistributionHandler) newHolderRanker(group string, labels model.Labels) *holderRanker {
+	r := &holderRanker{
+		hostStore: h.m.Host,
+		group:     group,
+		window:    h.loadWindow,
+		hosts:     map[string]*model.Host{},
+	}
+	if len(labels) > 0 {
+		r.hierarchy = h.topology
+		r.labels = labels
+	}
+	if len(r.hierarchy) == 0 && r.window < 2 {
+		return nil
+	}
+	return r
+}
+
+func (r *holderRanker) lookup(holders []string) error {
+	missing := []string{}
+	for _, holder := range holders {
+		if _, ok := r.hosts[holder]; !ok {
+			missing = append(missing, holder)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	hosts, err := r.hostStore.GetHosts(r.group, missing)
+	if err != nil {
+		return err
+	}
+	for _, holder := range missing {
+		if host, ok := hosts[holder]; ok {
+			r.hosts[holder] = &host
+		} else {
+			r.hosts[holder] = nil
+		}
+	}
+	return nil
+}
+
+// topology returns the topology scores of the looked up holders, nil if
+// holders are not ranked by topology.
+func (r *holderRanker) topology(holders []string) map[string]int {
+	if len(r.hierarchy) == 0 {
+		return nil
+	}
+	scores := make(map[string]int, len(holders))
+	for _, holder := range holders {
+		var labels model.Labels
+		if host := r.hosts[holder]; host != nil {
+			labels = host.Labels
+		}
+		scores[holder] = model.TopologyScore(r.hierarchy, r.labels, labels)
+	}
+	return scores
+}
+
+func (r *holderRanker) utilization(holder string) float64 {
+	if host := r.hosts[holder]; host != nil {
+		return host.Utilization
+	}
+	return 0
+}
+
+// balance picks the first count holders with power of two choices: of two
+// random holders among the next window holders of the ranking the less
+// loaded one is picked, the better ranked one on equal load. Locality is
+// kept as holders are only moved up to window-1 places.
+func (r *holderRanker) balance(sorted []string, count int) []string {
+	if r.window < 2 {
+		return sorted
+	}
+	out := slices.Clone(sorted)
+	for i := 0; i < count && i < len(out)-1; i++ {
+		w := min(r.window, len(out)-i)
+		a := i + rand.IntN(w)
+		b := i + rand.IntN(w-1)
+		if b >= a {
+			b++
+		}
+		ua, ub := r.utilization(out[a]), r.utilization(out[b])
+		pick := a
+		if ub < ua || (ub == ua && b < a) {
+			pick = b
+		}
+		holder := out[pick]
+		copy(out[i+1:pick+1], out[i:pick])
+		out[i] = holder
+	}
+	return out
+}
@@ -2,29 +2,107 @@ package handler
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/bits"
 	"net/http"
 	"net/netip"
+	"slices"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-logr/logr"
 	"github.com/laixintao/piccolo/pkg/distributionapi/metrics"
+	"github.com/laixintao/piccolo/pkg/distributionapi/middleware"
 	"github.com/laixintao/piccolo/pkg/distributionapi/model"
 	"github.com/laixintao/piccolo/pkg/distributionapi/storage"
 )
 
+// FindKeysMaxKeys is the maximum number of keys of a findkeys request.
+const FindKeysMaxKeys = 500
+
+// defaultHolderCount is the number of holders returned if the request has no count.
+const defaultHolderCount = 100
+
+var errSortHolders = errors.New("could not sort holders")
+
 type DistributionHandler struct {
 	m   *storage.Manager
 	log logr.Logger
+	// Label hierarchy holders are ranked by, from the broadest to the narrowest label.
+	topology []string
+	// Number of holders of the ranking the load is balanced over.
+	loadWindow int
+	// Groups every group may fall back to, in order.
+	fallbacks map[string][]string
 }
 
-func NewDistributionHandler(m *storage.Manager, log logr.Logger) *DistributionHandler {
-	return &DistributionHandler{
+type Option func(*DistributionHandler)
+
+// WithTopologyHierarchy ranks holders sharing more of the leading labels of
+// the hierarchy with the requester first, the IP prefix breaks ties.
+func WithTopologyHierarchy(hierarchy []string) Option {
+	return func(h *DistributionHandler) {
+		h.topology = hierarchy
+	}
+}
+
+// WithLoadBalancing spreads requests over the holders by their reported load,
+// holders are picked with power of two choices among the next window holders
+// of the ranking. A window below 2 returns holders in ranking order.
+func WithLoadBalancing(window int) Option {
+	return func(h *DistributionHandler) {
+		h.loadWindow = window
+	}
+}
+
+// WithGroupFallbacks lets lookups of a group return holders of its fallback
+// groups when the group has not enough holders, e.g. a new group us-1a can
+// use the holders of us-1. Fallbacks of fallbacks are searched as well.
+func WithGroupFallbacks(fallbacks map[string][]string) Option {
+	return func(h *DistributionHandler) {
+		h.fallbacks = fallbacks
+	}
+}
+
+// requireGroup returns true if the request is allowed to access the group,
+// otherwise it responds with 403 and the body built by forbidden, so every
+// endpoint keeps its response type.
+func requireGroup(c *gin.Context, group string, forbidden func(message string) any) bool {
+	if !middleware.GroupAllowed(c, group) {
+		c.JSON(http.StatusForbidden, forbidden("Not allowed to access group "+group))
+		return false
+	}
+	return true
+}
+
+func advertiseError(message string) any {
+	return model.ImageAdvertiseResponse{Success: false, Message: message}
+}
+
+func syncDeltaError(message string) any {
+	return model.SyncDeltaResponse{Success: false, Message: message}
+}
+
+func keepAliveError(message string) any {
+	return model.KeepAliveResponse{Success: false, Message: message}
+}
+
+func jsonError(message string) any {
+	return gin.H{"error": message}
+}
+
+func NewDistributionHandler(m *storage.Manager, log logr.Logger, opts ...Option) *DistributionHandler {
+	h := &DistributionHandler{
 		m:   m,
 		log: log,
 	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
 // AdvertiseImage hanle advertise request
@@ -40,6 +118,10 @@ func (h *DistributionHandler) AdvertiseImage(c *gin.Context) {
 		return
 	}
 
+	if !requireGroup(c, req.Group, advertiseError) {
+		return
+	}
+
 	if req.Holder == "" {
 		c.JSON(http.StatusBadRequest, model.ImageAdvertiseResponse{
 			Success: false,
@@ -76,6 +158,16 @@ func (h *DistributionHandler) AdvertiseImage(c *gin.Context) {
 		})
 		return
 	}
+	if len(req.Labels) > 0 {
+		if err := h.m.Host.SetHostLabels(req.Holder, req.Group, req.Labels); err != nil {
+			h.log.Error(err, "failed to set host labels", "holder", req.Holder)
+			c.JSON(http.StatusInternalServerError, model.ImageAdvertiseResponse{
+				Success: false,
+				Message: "Error when set host labels: " + err.Error(),
+			})
+			return
+		}
+	}
 
 	h.log.Info("distributions created successfully", "holder", req.Holder, "count", len(distributions))
 	c.JSON(http.StatusCreated, model.ImageAdvertiseResponse{
@@ -106,7 +198,21 @@ func (h *DistributionHandler) FindKey(c *gin.Context) {
 		return
 	}
 
-	holders, err := h.m.Distribution.GetHolderByKey(ctx, req.Group, req.Key)
+	labels, err := model.ParseLabels(req.Labels)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Wrong request format: " + err.Error(),
+		})
+		return
+	}
+
+	holders, holderGroups, err := h.findHoldersWithFallback(ctx, req.Group, req.Key, req.RequestHost, h.newHolderRankers(req.Group, labels), req.Count)
+	if errors.Is(err, errSortHolders) {
+		c.JSON(http.StatusNotFound,
+			gin.H{"message": "error when sort holder's order", "err": err.Error()},
+		)
+		return
+	}
 	if err != nil {
 		h.log.Error(err, "failed to get holders by key", "key", req.Key)
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -115,8 +221,6 @@ func (h *DistributionHandler) FindKey(c *gin.Context) {
 		return
 	}
 
-	metrics.FindKeyHolderCountBucket.Observe(float64(len(holders)))
-
 	if len(holders) == 0 {
 		c.JSON(http.StatusNotFound,
 			gin.H{"message": fmt.Sprintf("Didn't find the key %s in piccolo", req.Key)},
@@ -124,37 +228,122 @@ func (h *DistributionHandler) FindKey(c *gin.Context) {
 		return
 	}
 
-	// sort by IP closing to the holder
-	sorted := holders
-	start := time.Now()
-	sortDuration := time.Since(start).Seconds()
+	c.JSON(http.StatusOK, model.FindKeyResponse{
+		Key:          req.Key,
+		Holders:      holders,
+		Group:        req.Group,
+		HolderGroups: holderGroups,
+	})
+}
 
-	if req.RequestHost != "" {
-		sorted, err = sortByLCPv4HostPort(holders, req.RequestHost)
-		if err != nil {
+// FindKeys finds holders for many keys at once, e.g. all layers of an image
+// POST /api/v1/distribution/findkeys
+func (h *DistributionHandler) FindKeys(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	var req model.FindKeysRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.log.Error(err, "failed to bind JSON request")
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Wrong request format: " + err.Error(),
+		})
+		return
+	}
+
+	if len(req.Keys) > FindKeysMaxKeys {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("At most %d keys can be requested at once", FindKeysMaxKeys),
+		})
+		return
+	}
+
+	resp := model.FindKeysResponse{
+		Group:   req.Group,
+		Holders: map[string][]string{},
+	}
+	// The hosts of holders are looked up once for all keys.
+	rankers := h.newHolderRankers(req.Group, req.Labels)
+	for _, key := range req.Keys {
+		if key == "" {
+			continue
+		}
+		holders, holderGroups, err := h.findHoldersWithFallback(ctx, req.Group, key, req.RequestHost, rankers, req.Count)
+		if errors.Is(err, errSortHolders) {
 			c.JSON(http.StatusNotFound,
 				gin.H{"message": "error when sort holder's order", "err": err.Error()},
 			)
 			return
 		}
+		if err != nil {
+			h.log.Error(err, "failed to get holders by key", "key", key)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Error when finding holders: " + err.Error(),
+			})
+			return
+		}
+		if len(holders) == 0 {
+			continue
+		}
+		resp.Holders[key] = holders
+		for holder, g := range holderGroups {
+			if resp.HolderGroups == nil {
+				resp.HolderGroups = map[string]string{}
+			}
+			resp.HolderGroups[holder] = g
+		}
 	}
 
-	h.log.Info("found holders for key", "group", req.Group, "key", req.Key, "queryed_from_db", len(holders), "sort_cost_seconds", sortDuration)
+	h.log.Info("found holders for keys", "group", req.Group, "requested", len(req.Keys), "found", len(resp.Holders))
+	c.JSON(http.StatusOK, resp)
+}
+
+// findHolders returns up to count holders of the key, the holders closest to
+// the requester first when requestHost or ranker is set.
+func (h *DistributionHandler) findHolders(ctx context.Context, group, key, requestHost string, ranker *holderRanker, count int) ([]string, error) {
+	holders, err := h.m.Distribution.GetHolderByKey(ctx, group, key)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics.FindKeyHolderCountBucket.Observe(float64(len(holders)))
+
+	if len(holders) == 0 {
+		return nil, nil
+	}
+
+	// sort by IP closing to the holder
+	sorted := holders
+	start := time.Now()
+	var topology map[string]int
+	if ranker != nil {
+		if err := ranker.lookup(holders); err != nil {
+			return nil, err
+		}
+		topology = ranker.topology(holders)
+	}
+	if requestHost != "" || topology != nil {
+		sorted, err = sortHolders(holders, requestHost, topology)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errSortHolders, err)
+		}
+	}
+	sortDuration := time.Since(start).Seconds()
+
+	h.log.Info("found holders for key", "group", group, "key", key, "queryed_from_db", len(holders), "sort_cost_seconds", sortDuration)
 
 	// Get limited holders if count is specified
-	limit := 100
-	if req.Count > 0 {
-		limit = req.Count
+	limit := defaultHolderCount
+	if count > 0 {
+		limit = count
 	}
 	if limit > len(sorted) {
 		limit = len(sorted)
 	}
-
-	c.JSON(http.StatusOK, model.FindKeyResponse{
-		Key:     req.Key,
-		Holders: sorted[:limit],
-		Group:   req.Group,
-	})
+	if ranker != nil {
+		sorted = ranker.balance(sorted, limit)
+	}
+	return sorted[:limit], nil
 }
 
 // sync api will delete all the holder's key, and then insert the current keys
@@ -171,6 +360,10 @@ func (h *DistributionHandler) Sync(c *gin.Context) {
 		return
 	}
 
+	if !requireGroup(c, req.Group, advertiseError) {
+		return
+	}
+
 	if req.Holder == "" {
 		c.JSON(http.StatusBadRequest, model.ImageAdvertiseResponse{
 			Success: false,
@@ -181,10 +374,12 @@ func (h *DistributionHandler) Sync(c *gin.Context) {
 
 	existingKeys, err := h.m.Distribution.GetKeysByHolder(req.Group, req.Holder)
 	if err != nil {
+		h.log.Error(err, "failed to get keys of holder", "holder", req.Holder)
 		c.JSON(http.StatusInternalServerError, model.ImageAdvertiseResponse{
 			Success: false,
-			Message: "Error when delete keys from DB",
+			Message: "Error when get keys from DB: " + err.Error(),
 		})
+		return
 	}
 
 	currentKeys := req.Keys
@@ -224,12 +419,34 @@ func (h *DistributionHandler) Sync(c *gin.Context) {
 		}
 	}
 
+	// Deltas of the holder are based on this generation from now on.
+	if err := h.m.Host.SetSyncGeneration(req.Holder, req.Group, req.Generation); err != nil {
+		h.log.Error(err, "failed to set sync generation", "holder", req.Holder, "generation", req.Generation)
+		c.JSON(http.StatusInternalServerError, model.ImageAdvertiseResponse{
+			Success: false,
+			Message: "Error when set sync generation: " + err.Error(),
+		})
+		return
+	}
+	if len(req.Labels) > 0 {
+		if err := h.m.Host.SetHostLabels(req.Holder, req.Group, req.Labels); err != nil {
+			h.log.Error(err, "failed to set host labels", "holder", req.Holder)
+			c.JSON(http.StatusInternalServerError, model.ImageAdvertiseResponse{
+				Success: false,
+				Message: "Error when set host labels: " + err.Error(),
+			})
+			return
+		}
+	}
+	metrics.SyncRequestsTotal.WithLabelValues("full").Inc()
+
 	duration := time.Since(start).Seconds()
 	h.log.Info("distributions created successfully",
 		"holder", req.Holder,
 		"duration_seconds", duration,
 		"delete_from_db", len(onlyInDB),
 		"add_to_db", len(onlyInRequest),
+		"generation", req.Generation,
 	)
 	c.JSON(http.StatusCreated, model.ImageAdvertiseResponse{
 		Success: true,
@@ -237,6 +454,215 @@ func (h *DistributionHandler) Sync(c *gin.Context) {
 	})
 }
 
+// SyncDelta applies the keys added and removed by the holder since the last
+// acknowledged generation, the holder has to do a full sync if the
+// generations diverged
+// POST /api/v1/distribution/syncdelta
+func (h *DistributionHandler) SyncDelta(c *gin.Context) {
+	start := time.Now()
+	var req model.SyncDeltaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.log.Error(err, "failed to bind JSON request")
+		c.JSON(http.StatusBadRequest, model.SyncDeltaResponse{
+			Success: false,
+			Message: "Wrong request format: " + err.Error(),
+		})
+		return
+	}
+
+	if !requireGroup(c, req.Group, syncDeltaError) {
+		return
+	}
+
+	generation, err := h.m.Host.GetSyncGeneration(req.Holder, req.Group)
+	if err != nil {
+		h.log.Error(err, "failed to get sync generation", "holder", req.Holder)
+		c.JSON(http.StatusInternalServerError, model.SyncDeltaResponse{
+			Success: false,
+			Message: "Error when get sync generation: " + err.Error(),
+		})
+		return
+	}
+	if generation != req.BaseGeneration {
+		metrics.SyncRequestsTotal.WithLabelValues("conflict").Inc()
+		h.log.Info("sync generation diverged, full sync required",
+			"holder", req.Holder, "generation", generation, "base_generation", req.BaseGeneration)
+		c.JSON(http.StatusConflict, model.SyncDeltaResponse{
+			Success:          false,
+			Message:          "Base generation does not match, full sync required",
+			Generation:       generation,
+			FullSyncRequired: true,
+		})
+		return
+	}
+
+	removed := slices.DeleteFunc(req.Removed, func(key string) bool { return key == "" })
+	if len(removed) != 0 {
+		if err := h.m.Distribution.DeleteKeysByHolder(removed, req.Holder, req.Group); err != nil {
+			h.log.Error(err, "failed to delete distributions", "holder", req.Holder, "count", len(removed))
+			c.JSON(http.StatusInternalServerError, model.SyncDeltaResponse{
+				Success: false,
+				Message: "Error when delete keys from DB: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	distributions := make([]*model.Distribution, 0, len(req.Added))
+	for _, key := range req.Added {
+		if key == "" {
+			continue
+		}
+		distributions = append(distributions, &model.Distribution{
+			Key:    key,
+			Holder: req.Holder,
+			Group:  req.Group,
+		})
+	}
+	if len(distributions) != 0 {
+		if err := h.m.Distribution.CreateDistributions(distributions, req.Group); err != nil {
+			h.log.Error(err, "failed to create distributions", "holder", req.Holder, "count", len(distributions))
+			c.JSON(http.StatusInternalServerError, model.SyncDeltaResponse{
+				Success: false,
+				Message: "Error when create distribution in batch: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	if err := h.m.Host.SetSyncGeneration(req.Holder, req.Group, req.Generation); err != nil {
+		h.log.Error(err, "failed to set sync generation", "holder", req.Holder, "generation", req.Generation)
+		c.JSON(http.StatusInternalServerError, model.SyncDeltaResponse{
+			Success: false,
+			Message: "Error when set sync generation: " + err.Error(),
+		})
+		return
+	}
+	metrics.SyncRequestsTotal.WithLabelValues("delta").Inc()
+
+	h.log.Info("sync delta applied",
+		"holder", req.Holder,
+		"duration_seconds", time.Since(start).Seconds(),
+		"delete_from_db", len(removed),
+		"add_to_db", len(distributions),
+		"generation", req.Generation,
+	)
+	c.JSON(http.StatusOK, model.SyncDeltaResponse{
+		Success:    true,
+		Message:    "Delta applied!",
+		Generation: req.Generation,
+	})
+}
+
+// Withdraw removes keys the holder no longer has
+// POST /api/v1/distribution/withdraw
+func (h *DistributionHandler) Withdraw(c *gin.Context) {
+	var req model.WithdrawRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.log.Error(err, "failed to bind JSON request")
+		c.JSON(http.StatusBadRequest, model.ImageAdvertiseResponse{
+			Success: false,
+			Message: "Wrong request format: " + err.Error(),
+		})
+		return
+	}
+
+	if !requireGroup(c, req.Group, advertiseError) {
+		return
+	}
+
+	keys := slices.DeleteFunc(req.Keys, func(key string) bool { return key == "" })
+	if len(keys) == 0 {
+		c.JSON(http.StatusBadRequest, model.ImageAdvertiseResponse{
+			Success: false,
+			Message: "keys are empty!",
+		})
+		return
+	}
+
+	if err := h.m.Distribution.DeleteKeysByHolder(keys, req.Holder, req.Group); err != nil {
+		h.log.Error(err, "failed to withdraw keys", "holder", req.Holder, "group", req.Group, "count", len(keys))
+		c.JSON(http.StatusInternalServerError, model.ImageAdvertiseResponse{
+			Success: false,
+			Message: "Error when delete keys from DB: " + err.Error(),
+		})
+		return
+	}
+
+	h.log.Info("keys withdrawn", "holder", req.Holder, "group", req.Group, "count", len(keys))
+	c.JSON(http.StatusOK, model.ImageAdvertiseResponse{
+		Success: true,
+		Message: "Keys withdrawn!",
+	})
+}
+
+// ReportBadHolder removes a holder from a key after a pi received content
+// from it that did not match the key. Only hosts of the group may report other
+// holders. The sync generation of the holder is reset, so the holder
+// advertises the key again with its next full refresh if it still has it.
+// POST /api/v1/distribution/report
+func (h *DistributionHandler) ReportBadHolder(c *gin.Context) {
+	var req model.ReportBadHolderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.log.Error(err, "failed to bind JSON request")
+		c.JSON(http.StatusBadRequest, model.ImageAdvertiseResponse{
+			Success: false,
+			Message: "Wrong request format: " + err.Error(),
+		})
+		return
+	}
+
+	if !requireGroup(c, req.Group, advertiseError) {
+		return
+	}
+
+	if req.Reporter == req.Holder {
+		c.JSON(http.StatusBadRequest, model.ImageAdvertiseResponse{
+			Success: false,
+			Message: "A holder can not report itself",
+		})
+		return
+	}
+	registered, err := h.m.Host.HostExists(req.Reporter, req.Group)
+	if err != nil {
+		h.log.Error(err, "failed to find reporter", "reporter", req.Reporter, "group", req.Group)
+		c.JSON(http.StatusInternalServerError, model.ImageAdvertiseResponse{
+			Success: false,
+			Message: "Error when get reporter from DB: " + err.Error(),
+		})
+		return
+	}
+	if !registered {
+		c.JSON(http.StatusForbidden, model.ImageAdvertiseResponse{
+			Success: false,
+			Message: "Reporter " + req.Reporter + " is not a host of group " + req.Group,
+		})
+		return
+	}
+
+	metrics.BadHolderReportsTotal.WithLabelValues(req.Group).Inc()
+	if err := h.m.Distribution.DeleteKeysByHolder([]string{req.Key}, req.Holder, req.Group); err != nil {
+		h.log.Error(err, "failed to delete reported holder", "key", req.Key, "holder", req.Holder, "group", req.Group)
+		c.JSON(http.StatusInternalServerError, model.ImageAdvertiseResponse{
+			Success: false,
+			Message: "Error when delete key from DB: " + err.Error(),
+		})
+		return
+	}
+
+	// The holder still counts the key as acknowledged, a delta would never
+	// advertise it again.
+	if err := h.m.Host.SetSyncGeneration(req.Holder, req.Group, 0); err != nil {
+		h.log.Error(err, "failed to reset sync generation of reported holder", "holder", req.Holder, "group", req.Group)
+	}
+
+	h.log.Info("removed reported holder", "key", req.Key, "holder", req.Holder, "group", req.Group, "reporter", req.Reporter)
+	c.JSON(http.StatusOK, model.ImageAdvertiseResponse{
+		Success: true,
+		Message: "Holder removed!",
+	})
+}
+
 func diffSets(a, b []string) (onlyA, onlyB []string) {
 	setA := make(map[string]struct{}, len(a))
 	setB := make(map[string]struct{}, len(b))
@@ -265,49 +691,66 @@ func diffSets(a, b []string) (onlyA, onlyB []string) {
 	return
 }
 
-// lcpBits4 returns the number of leading equal bits between two IPv4 addrs.
-// Both a and b must be IPv4.
-func lcpBits4(a, b netip.Addr) int {
-	ba := a.As4()
-	bb := b.As4()
+// lcpBits returns the number of leading equal bits between two addrs of the
+// same family, -1 if the families differ so that holders reachable over the
+// family of the requester are ranked first.
+func lcpBits(a, b netip.Addr) int {
+	if a.Is4() != b.Is4() {
+		return -1
+	}
+	ba := a.As16()
+	bb := b.As16()
 
 	lcp := 0
-	for i := 0; i < 4; i++ {
+	for i := range ba {
 		x := ba[i] ^ bb[i]
 		if x == 0 {
 			lcp += 8
 			continue
 		}
-		// Count leading zeros in the first differing byte
-		for bit := 7; bit >= 0; bit-- {
-			if (x>>uint(bit))&1 == 0 {
-				lcp++
-			} else {
-				return lcp
-			}
-		}
+		lcp += bits.LeadingZeros8(x)
+		break
+	}
+	if a.Is4() {
+		// IPv4 addrs share the 96 bits of the IPv4-mapped prefix.
+		lcp -= 96
 	}
 	return lcp
 }
 
-// sortByLCPv4HostPort sorts "ip:port" strings by the longest common prefix (bits)
-// of their IPv4 address with the given target IPv4 address.
-// Ports are ignored for ranking, but returned strings keep the original "ip:port" form.
-func sortByLCPv4HostPort(hostports []string, target string) ([]string, error) {
-	// Parse and validate target as IPv4
-	t, err := netip.ParseAddr(target)
+// parseRequestHost parses the address of the requester, given as addr or
+// host:port, IPv6 addrs may be bracketed.
+func parseRequestHost(target string) (netip.Addr, error) {
+	if ap, err := netip.ParseAddrPort(target); err == nil {
+		return ap.Addr().Unmap(), nil
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(target, "["), "]"))
 	if err != nil {
-		return nil, fmt.Errorf("parse target %q: %w", target, err)
+		return netip.Addr{}, fmt.Errorf("parse target %q: %w", target, err)
 	}
-	t = t.Unmap()
-	if !t.Is4() {
-		return nil, fmt.Errorf("target %q is not IPv4", target)
+	return addr.Unmap(), nil
+}
+
+// sortHolders sorts "ip:port" strings by their topology score, then by the
+// longest common prefix (bits) of their address with the given target
+// address. IPv4 and IPv6 holders can be mixed, holders of the other family
+// than the target are ranked last. The prefix is ignored if target is empty.
+// Ports are ignored for ranking, but returned strings keep the original "ip:port" form.
+func sortHolders(hostports []string, target string, topology map[string]int) ([]string, error) {
+	var t netip.Addr
+	if target != "" {
+		var err error
+		t, err = parseRequestHost(target)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Parse inputs and precompute LCP
 	type item struct {
 		hostport string // original "ip:port"
 		ip       netip.Addr
+		topology int
 		lcp      int
 	}
 
@@ -318,18 +761,22 @@ func sortByLCPv4HostPort(hostports []string, target string) ([]string, error) {
 			return nil, fmt.Errorf("parse %q: %w", hp, err)
 		}
 		ip := ap.Addr().Unmap()
-		if !ip.Is4() {
-			return nil, fmt.Errorf("%q is not IPv4", hp)
-		}
-		items = append(items, item{
+		it := item{
 			hostport: hp,
 			ip:       ip,
-			lcp:      lcpBits4(ip, t),
-		})
+			topology: topology[hp],
+		}
+		if t.IsValid() {
+			it.lcp = lcpBits(ip, t)
+		}
+		items = append(items, it)
 	}
 
-	// Sort by LCP desc; tie-breaker by numeric IP, then by port string for stability
+	// Sort by topology and LCP desc; tie-breaker by numeric IP, then by port string for stability
 	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].topology != items[j].topology {
+			return items[i].topology > items[j].topology
+		}
 		if items[i].lcp != items[j].lcp {
 			return items[i].lcp > items[j].lcp
 		}
@@ -358,6 +805,10 @@ func (h *DistributionHandler) KeepAlive(c *gin.Context) {
 		return
 	}
 
+	if !requireGroup(c, req.Group, advertiseError) {
+		return
+	}
+
 	if err := h.m.Host.RefreshHostAddr(req.HostAddr, req.Group); err != nil {
 		h.log.Error(err, "Failed to refresh host Addr!", "host_addr", req.HostAddr)
 		c.JSON(http.StatusInternalServerError, model.KeepAliveResponse{
@@ -366,6 +817,26 @@ func (h *DistributionHandler) KeepAlive(c *gin.Context) {
 		})
 		return
 	}
+	if len(req.Labels) > 0 {
+		if err := h.m.Host.SetHostLabels(req.HostAddr, req.Group, req.Labels); err != nil {
+			h.log.Error(err, "Failed to set host labels!", "host_addr", req.HostAddr)
+			c.JSON(http.StatusInternalServerError, model.KeepAliveResponse{
+				Success: false,
+				Message: "Failed to keepalive",
+			})
+			return
+		}
+	}
+	if req.Load != nil {
+		if err := h.m.Host.SetHostUtilization(req.HostAddr, req.Group, req.Load.Utilization()); err != nil {
+			h.log.Error(err, "Failed to set host utilization!", "host_addr", req.HostAddr)
+			c.JSON(http.StatusInternalServerError, model.KeepAliveResponse{
+				Success: false,
+				Message: "Failed to keepalive",
+			})
+			return
+		}
+	}
 
 	h.log.Info("Keepalive for host success", "host_addr", req.HostAddr)
 	c.JSON(http.StatusCreated, model.KeepAliveResponse{
@@ -374,3 +845,79 @@ func (h *DistributionHandler) KeepAlive(c *gin.Context) {
 	})
 
 }
+
+// ReportLoad stores the upload load of a host, pis report it more often than
+// keepalive so that findkey balances by recent load
+// POST /api/v1/load
+func (h *DistributionHandler) ReportLoad(c *gin.Context) {
+	var req model.ReportLoadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.log.Error(err, "report load failed to bind JSON request")
+		c.JSON(http.StatusBadRequest, model.KeepAliveResponse{
+			Success: false,
+			Message: "Wrong request format: " + err.Error(),
+		})
+		return
+	}
+
+	if !requireGroup(c, req.Group, keepAliveError) {
+		return
+	}
+
+	if err := h.m.Host.SetHostUtilization(req.HostAddr, req.Group, req.Load.Utilization()); err != nil {
+		h.log.Error(err, "Failed to set host utilization!", "host_addr", req.HostAddr)
+		c.JSON(http.StatusInternalServerError, model.KeepAliveResponse{
+			Success: false,
+			Message: "Failed to report load",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, model.KeepAliveResponse{
+		Success: true,
+		Message: "report load success",
+	})
+}
+
+// Deregister removes a host and all of its keys, e.g. when the pi drains
+// before the node shuts down
+// POST /api/v1/deregister
+func (h *DistributionHandler) Deregister(c *gin.Context) {
+	var req model.DeregisterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.log.Error(err, "deregister failed to bind JSON request")
+		c.JSON(http.StatusBadRequest, model.ImageAdvertiseResponse{
+			Success: false,
+			Message: "Wrong request format: " + err.Error(),
+		})
+		return
+	}
+
+	if !requireGroup(c, req.Group, advertiseError) {
+		return
+	}
+
+	host := model.Host{HostAddr: req.HostAddr, Group: req.Group}
+	if err := h.m.Distribution.DeleteByHolder(host); err != nil {
+		h.log.Error(err, "failed to delete keys of host", "host_addr", req.HostAddr, "group", req.Group)
+		c.JSON(http.StatusInternalServerError, model.ImageAdvertiseResponse{
+			Success: false,
+			Message: "Error when delete keys from DB: " + err.Error(),
+		})
+		return
+	}
+	if err := h.m.Host.DeleteHost(host); err != nil {
+		h.log.Error(err, "failed to delete host", "host_addr", req.HostAddr, "group", req.Group)
+		c.JSON(http.StatusInternalServerError, model.ImageAdvertiseResponse{
+			Success: false,
+			Message: "Error when delete host from DB: " + err.Error(),
+		})
+		return
+	}
+
+	h.log.Info("host deregistered", "host_addr", req.HostAddr, "group", req.Group)
+	c.JSON(http.StatusOK, model.ImageAdvertiseResponse{
+		Success: true,
+		Message: "Host deregistered!",
+	})
+}
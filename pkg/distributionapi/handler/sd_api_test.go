@@ -0,0 +1,514 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/laixintao/piccolo/pkg/distributionapi/middleware"
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
+	"github.com/laixintao/piccolo/pkg/distributionapi/storage"
+)
+
+func newTestRouter(t *testing.T, opts ...Option) *gin.Engine {
+	t.Helper()
+
+	m, err := storage.Open([]string{"default:bolt:" + filepath.Join(t.TempDir(), "piccolo.db")})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+
+	gin.SetMode(gin.TestMode)
+	h := NewDistributionHandler(m, logr.Discard(), opts...)
+	r := gin.New()
+	r.POST("/api/v1/keepalive", h.KeepAlive)
+	r.POST("/api/v1/deregister", h.Deregister)
+	r.POST("/api/v1/load", h.ReportLoad)
+	r.POST("/api/v1/distribution/advertise", h.AdvertiseImage)
+	r.GET("/api/v1/distribution/findkey", h.FindKey)
+	r.POST("/api/v1/distribution/findkeys", h.FindKeys)
+	r.POST("/api/v1/distribution/sync", h.Sync)
+	r.POST("/api/v1/distribution/syncdelta", h.SyncDelta)
+	r.POST("/api/v1/distribution/withdraw", h.Withdraw)
+	r.POST("/api/v1/distribution/report", h.ReportBadHolder)
+	r.POST("/api/v1/prepull", h.CreatePrepull)
+	r.GET("/api/v1/prepull/pending", h.PendingPrepulls)
+	r.GET("/api/v1/prepull/:id", h.GetPrepull)
+	r.POST("/api/v1/prepull/status", h.ReportPrepullStatus)
+	r.GET("/api/v1/admin/groups", h.ListGroups)
+	r.GET("/api/v1/admin/hosts", h.ListHosts)
+	r.GET("/api/v1/admin/keys", h.ListKeys)
+	r.GET("/api/v1/admin/holders", h.ListHolders)
+	r.GET("/api/v1/admin/topkeys", h.TopKeys)
+	return r
+}
+
+func doJSON(t *testing.T, r *gin.Engine, method, target string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if body != nil {
+		require.NoError(t, json.NewEncoder(&buf).Encode(body))
+	}
+	req := httptest.NewRequest(method, target, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, req)
+	return rw
+}
+
+func findHolders(t *testing.T, r *gin.Engine, target string) []string {
+	t.Helper()
+
+	rw := doJSON(t, r, http.MethodGet, target, nil)
+	if rw.Code == http.StatusNotFound {
+		return nil
+	}
+	require.Equal(t, http.StatusOK, rw.Code)
+	resp := model.FindKeyResponse{}
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &resp))
+	return resp.Holders
+}
+
+func TestAdvertiseAndFindKey(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter(t)
+	for _, holder := range []string{"10.0.0.1:5000", "10.1.0.1:5000", "10.0.0.2:5000"} {
+		rw := doJSON(t, r, http.MethodPost, "/api/v1/distribution/advertise", model.ImageAdvertiseRequest{
+			Holder: holder,
+			Keys:   []string{"foo", ""},
+			Group:  "default",
+		})
+		require.Equal(t, http.StatusCreated, rw.Code)
+	}
+	rw := doJSON(t, r, http.MethodPost, "/api/v1/distribution/advertise", model.ImageAdvertiseRequest{
+		Holder: "10.0.0.1:5000",
+		Keys:   []string{""},
+		Group:  "default",
+	})
+	require.Equal(t, http.StatusBadRequest, rw.Code)
+
+	holders := findHolders(t, r, "/api/v1/distribution/findkey?key=foo&group=default&request_host=10.0.0.3")
+	require.Equal(t, []string{"10.0.0.2:5000", "10.0.0.1:5000", "10.1.0.1:5000"}, holders)
+	holders = findHolders(t, r, "/api/v1/distribution/findkey?key=foo&group=default&count=1&request_host=10.1.0.3")
+	require.Equal(t, []string{"10.1.0.1:5000"}, holders)
+	holders = findHolders(t, r, "/api/v1/distribution/findkey?key=foo&group=other")
+	require.Empty(t, holders)
+
+	rw = doJSON(t, r, http.MethodGet, "/api/v1/distribution/findkey?key=foo", nil)
+	require.Equal(t, http.StatusBadRequest, rw.Code)
+}
+
+func TestAdvertiseForbidden(t *testing.T) {
+	t.Parallel()
+
+	m, err := storage.Open([]string{"default:bolt:" + filepath.Join(t.TempDir(), "piccolo.db")})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+	p := filepath.Join(t.TempDir(), "tokens")
+	require.NoError(t, os.WriteFile(p, []byte("a:foo\n"), 0o600))
+	tokens, err := middleware.LoadTokens(p)
+	require.NoError(t, err)
+	gin.SetMode(gin.TestMode)
+	h := NewDistributionHandler(m, logr.Discard())
+	r := gin.New()
+	r.POST("/api/v1/distribution/advertise", middleware.GroupTokenAuth(tokens), h.AdvertiseImage)
+
+	body, err := json.Marshal(model.ImageAdvertiseRequest{Holder: "10.0.0.1:5000", Keys: []string{"foo"}, Group: "b"})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/distribution/advertise", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer foo")
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusForbidden, rw.Code)
+	resp := model.ImageAdvertiseResponse{}
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &resp))
+	require.Equal(t, model.ImageAdvertiseResponse{Success: false, Message: "Not allowed to access group b"}, resp)
+}
+
+func TestFindKeys(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter(t)
+	rw := doJSON(t, r, http.MethodPost, "/api/v1/distribution/advertise", model.ImageAdvertiseRequest{
+		Holder: "10.0.0.1:5000",
+		Keys:   []string{"foo", "bar"},
+		Group:  "default",
+	})
+	require.Equal(t, http.StatusCreated, rw.Code)
+	rw = doJSON(t, r, http.MethodPost, "/api/v1/distribution/advertise", model.ImageAdvertiseRequest{
+		Holder: "10.1.0.1:5000",
+		Keys:   []string{"foo"},
+		Group:  "default",
+	})
+	require.Equal(t, http.StatusCreated, rw.Code)
+
+	rw = doJSON(t, r, http.MethodPost, "/api/v1/distribution/findkeys", model.FindKeysRequest{
+		Keys:        []string{"foo", "bar", "missing", ""},
+		Group:       "default",
+		RequestHost: "10.1.0.2",
+	})
+	require.Equal(t, http.StatusOK, rw.Code)
+	resp := model.FindKeysResponse{}
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &resp))
+	expected := map[string][]string{
+		"foo": {"10.1.0.1:5000", "10.0.0.1:5000"},
+		"bar": {"10.0.0.1:5000"},
+	}
+	require.Equal(t, expected, resp.Holders)
+
+	keys := make([]string, FindKeysMaxKeys+1)
+	rw = doJSON(t, r, http.MethodPost, "/api/v1/distribution/findkeys", model.FindKeysRequest{Keys: keys, Group: "default"})
+	require.Equal(t, http.StatusBadRequest, rw.Code)
+}
+
+func TestSync(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter(t)
+	rw := doJSON(t, r, http.MethodPost, "/api/v1/distribution/advertise", model.ImageAdvertiseRequest{
+		Holder: "10.0.0.1:5000",
+		Keys:   []string{"foo", "bar"},
+		Group:  "default",
+	})
+	require.Equal(t, http.StatusCreated, rw.Code)
+
+	rw = doJSON(t, r, http.MethodPost, "/api/v1/distribution/sync", model.ImageAdvertiseRequest{
+		Holder: "10.0.0.1:5000",
+		Keys:   []string{"bar", "baz"},
+		Group:  "default",
+	})
+	require.Equal(t, http.StatusCreated, rw.Code)
+
+	require.Empty(t, findHolders(t, r, "/api/v1/distribution/findkey?key=foo&group=default"))
+	require.Equal(t, []string{"10.0.0.1:5000"}, findHolders(t, r, "/api/v1/distribution/findkey?key=bar&group=default"))
+	require.Equal(t, []string{"10.0.0.1:5000"}, findHolders(t, r, "/api/v1/distribution/findkey?key=baz&group=default"))
+}
+
+func TestSyncDelta(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter(t)
+	delta := model.SyncDeltaRequest{
+		Holder:         "10.0.0.1:5000",
+		Group:          "default",
+		BaseGeneration: 1,
+		Generation:     2,
+		Added:          []string{"baz"},
+		Removed:        []string{"foo"},
+	}
+	rw := doJSON(t, r, http.MethodPost, "/api/v1/distribution/syncdelta", delta)
+	require.Equal(t, http.StatusConflict, rw.Code)
+	resp := model.SyncDeltaResponse{}
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &resp))
+	require.True(t, resp.FullSyncRequired)
+	require.Equal(t, uint64(0), resp.Generation)
+
+	rw = doJSON(t, r, http.MethodPost, "/api/v1/distribution/sync", model.ImageAdvertiseRequest{
+		Holder:     "10.0.0.1:5000",
+		Keys:       []string{"foo", "bar"},
+		Group:      "default",
+		Generation: 1,
+	})
+	require.Equal(t, http.StatusCreated, rw.Code)
+
+	rw = doJSON(t, r, http.MethodPost, "/api/v1/distribution/syncdelta", delta)
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Empty(t, findHolders(t, r, "/api/v1/distribution/findkey?key=foo&group=default"))
+	require.Equal(t, []string{"10.0.0.1:5000"}, findHolders(t, r, "/api/v1/distribution/findkey?key=bar&group=default"))
+	require.Equal(t, []string{"10.0.0.1:5000"}, findHolders(t, r, "/api/v1/distribution/findkey?key=baz&group=default"))
+
+	// Replaying the delta conflicts as piccolo acknowledged generation 2.
+	rw = doJSON(t, r, http.MethodPost, "/api/v1/distribution/syncdelta", delta)
+	require.Equal(t, http.StatusConflict, rw.Code)
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &resp))
+	require.Equal(t, uint64(2), resp.Generation)
+}
+
+func TestWithdraw(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter(t)
+	for _, holder := range []string{"10.0.0.1:5000", "10.0.0.2:5000"} {
+		rw := doJSON(t, r, http.MethodPost, "/api/v1/distribution/advertise", model.ImageAdvertiseRequest{
+			Holder: holder,
+			Keys:   []string{"foo", "bar"},
+			Group:  "default",
+		})
+		require.Equal(t, http.StatusCreated, rw.Code)
+	}
+
+	rw := doJSON(t, r, http.MethodPost, "/api/v1/distribution/withdraw", model.WithdrawRequest{
+		Holder: "10.0.0.1:5000",
+		Keys:   []string{"foo"},
+		Group:  "default",
+	})
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, []string{"10.0.0.2:5000"}, findHolders(t, r, "/api/v1/distribution/findkey?key=foo&group=default"))
+	require.ElementsMatch(t, []string{"10.0.0.1:5000", "10.0.0.2:5000"}, findHolders(t, r, "/api/v1/distribution/findkey?key=bar&group=default"))
+
+	rw = doJSON(t, r, http.MethodPost, "/api/v1/distribution/withdraw", model.WithdrawRequest{
+		Holder: "10.0.0.1:5000",
+		Keys:   []string{""},
+		Group:  "default",
+	})
+	require.Equal(t, http.StatusBadRequest, rw.Code)
+}
+
+func TestReportBadHolder(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter(t)
+	rw := doJSON(t, r, http.MethodPost, "/api/v1/distribution/sync", model.ImageAdvertiseRequest{
+		Holder:     "10.0.0.1:5000",
+		Keys:       []string{"foo", "bar"},
+		Group:      "default",
+		Generation: 1,
+	})
+	require.Equal(t, http.StatusCreated, rw.Code)
+
+	report := model.ReportBadHolderRequest{
+		Key:      "foo",
+		Holder:   "10.0.0.1:5000",
+		Group:    "default",
+		Reporter: "10.0.0.2:5000",
+	}
+	// Only hosts of the group may report a holder.
+	rw = doJSON(t, r, http.MethodPost, "/api/v1/distribution/report", report)
+	require.Equal(t, http.StatusForbidden, rw.Code)
+	require.Equal(t, []string{"10.0.0.1:5000"}, findHolders(t, r, "/api/v1/distribution/findkey?key=foo&group=default"))
+	rw = doJSON(t, r, http.MethodPost, "/api/v1/distribution/report", model.ReportBadHolderRequest{
+		Key:      "foo",
+		Holder:   "10.0.0.1:5000",
+		Group:    "default",
+		Reporter: "10.0.0.1:5000",
+	})
+	require.Equal(t, http.StatusBadRequest, rw.Code)
+
+	rw = doJSON(t, r, http.MethodPost, "/api/v1/keepalive", model.KeepAliveRequest{HostAddr: "10.0.0.2:5000", Group: "default"})
+	require.Equal(t, http.StatusCreated, rw.Code)
+	rw = doJSON(t, r, http.MethodPost, "/api/v1/distribution/report", report)
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Empty(t, findHolders(t, r, "/api/v1/distribution/findkey?key=foo&group=default"))
+	require.Equal(t, []string{"10.0.0.1:5000"}, findHolders(t, r, "/api/v1/distribution/findkey?key=bar&group=default"))
+
+	// The holder has to sync all of its keys again.
+	rw = doJSON(t, r, http.MethodPost, "/api/v1/distribution/syncdelta", model.SyncDeltaRequest{
+		Holder:         "10.0.0.1:5000",
+		Group:          "default",
+		BaseGeneration: 1,
+		Generation:     2,
+	})
+	require.Equal(t, http.StatusConflict, rw.Code)
+}
+
+func TestKeepAlive(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter(t)
+	rw := doJSON(t, r, http.MethodPost, "/api/v1/keepalive", model.KeepAliveRequest{HostAddr: "10.0.0.1:5000", Group: "default"})
+	require.Equal(t, http.StatusCreated, rw.Code)
+	rw = doJSON(t, r, http.MethodPost, "/api/v1/keepalive", map[string]string{"group": "default"})
+	require.Equal(t, http.StatusBadRequest, rw.Code)
+}
+
+func TestDeregister(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter(t)
+	for _, holder := range []string{"10.0.0.1:5000", "10.0.0.2:5000"} {
+		rw := doJSON(t, r, http.MethodPost, "/api/v1/distribution/advertise", model.ImageAdvertiseRequest{
+			Holder: holder,
+			Keys:   []string{"foo", "bar"},
+			Group:  "default",
+		})
+		require.Equal(t, http.StatusCreated, rw.Code)
+	}
+	rw := doJSON(t, r, http.MethodPost, "/api/v1/distribution/sync", model.ImageAdvertiseRequest{
+		Holder:     "10.0.0.1:5000",
+		Keys:       []string{"foo", "bar"},
+		Group:      "default",
+		Generation: 1,
+	})
+	require.Equal(t, http.StatusCreated, rw.Code)
+
+	rw = doJSON(t, r, http.MethodPost, "/api/v1/deregister", model.DeregisterRequest{HostAddr: "10.0.0.1:5000", Group: "default"})
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, []string{"10.0.0.2:5000"}, findHolders(t, r, "/api/v1/distribution/findkey?key=foo&group=default"))
+	require.Equal(t, []string{"10.0.0.2:5000"}, findHolders(t, r, "/api/v1/distribution/findkey?key=bar&group=default"))
+
+	// The host has to sync all keys when it comes back.
+	rw = doJSON(t, r, http.MethodPost, "/api/v1/distribution/syncdelta", model.SyncDeltaRequest{
+		Holder:         "10.0.0.1:5000",
+		Group:          "default",
+		BaseGeneration: 1,
+		Generation:     2,
+	})
+	require.Equal(t, http.StatusConflict, rw.Code)
+}
+
+func TestSortHolders(t *testing.T) {
+	t.Parallel()
+
+	holders := []string{"10.0.0.1:5000", "[fd00::1]:5000", "10.1.0.1:5000", "[fd00:1::1]:5000", "[::ffff:10.0.0.2]:5000"}
+	tests := []struct {
+		name     string
+		target   string
+		expected []string
+	}{
+		{
+			name:     "IPv4",
+			target:   "10.0.0.3",
+			expected: []string{"[::ffff:10.0.0.2]:5000", "10.0.0.1:5000", "10.1.0.1:5000", "[fd00::1]:5000", "[fd00:1::1]:5000"},
+		},
+		{
+			name:     "IPv4 with port",
+			target:   "10.1.0.3:5000",
+			expected: []string{"10.1.0.1:5000", "10.0.0.1:5000", "[::ffff:10.0.0.2]:5000", "[fd00::1]:5000", "[fd00:1::1]:5000"},
+		},
+		{
+			name:     "IPv6",
+			target:   "fd00:1::2",
+			expected: []string{"[fd00:1::1]:5000", "[fd00::1]:5000", "10.0.0.1:5000", "[::ffff:10.0.0.2]:5000", "10.1.0.1:5000"},
+		},
+		{
+			name:     "bracketed IPv6 with port",
+			target:   "[fd00::2]:5000",
+			expected: []string{"[fd00::1]:5000", "[fd00:1::1]:5000", "10.0.0.1:5000", "[::ffff:10.0.0.2]:5000", "10.1.0.1:5000"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			sorted, err := sortHolders(holders, tt.target, nil)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, sorted)
+		})
+	}
+
+	_, err := sortHolders(holders, "example.com", nil)
+	require.ErrorContains(t, err, `parse target "example.com"`)
+	_, err = sortHolders([]string{"fd00::1"}, "fd00::2", nil)
+	require.ErrorContains(t, err, `parse "fd00::1"`)
+}
+
+func TestFindKeyDualStack(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter(t)
+	for _, holder := range []string{"10.0.0.1:5000", "[fd00::1]:5000", "[fd00:0:0:1:ffff:ffff:ffff:ffff%eth0]:5000"} {
+		rw := doJSON(t, r, http.MethodPost, "/api/v1/distribution/advertise", model.ImageAdvertiseRequest{
+			Holder: holder,
+			Keys:   []string{"foo"},
+			Group:  "default",
+		})
+		require.Equal(t, http.StatusCreated, rw.Code)
+	}
+
+	holders := findHolders(t, r, "/api/v1/distribution/findkey?key=foo&group=default&request_host=fd00::2")
+	require.Equal(t, []string{"[fd00::1]:5000", "[fd00:0:0:1:ffff:ffff:ffff:ffff%eth0]:5000", "10.0.0.1:5000"}, holders)
+	holders = findHolders(t, r, "/api/v1/distribution/findkey?key=foo&group=default&request_host=10.0.0.2")
+	require.Equal(t, []string{"10.0.0.1:5000", "[fd00::1]:5000", "[fd00:0:0:1:ffff:ffff:ffff:ffff%eth0]:5000"}, holders)
+}
+
+func TestFindKeyTopology(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter(t, WithTopologyHierarchy([]string{"region", "zone", "rack"}))
+	hosts := map[string]model.Labels{
+		"10.0.0.1:5000": {"region": "us", "zone": "b", "rack": "r1"},
+		"10.9.0.1:5000": {"region": "us", "zone": "a", "rack": "r2"},
+		"10.8.0.1:5000": {"region": "us", "zone": "a", "rack": "r1"},
+		"10.7.0.1:5000": nil,
+	}
+	for holder, labels := range hosts {
+		target := "/api/v1/distribution/sync"
+		// Labels are reported with advertise too.
+		if holder == "10.9.0.1:5000" {
+			target = "/api/v1/distribution/advertise"
+		}
+		rw := doJSON(t, r, http.MethodPost, target, model.ImageAdvertiseRequest{
+			Holder:     holder,
+			Keys:       []string{"foo"},
+			Group:      "default",
+			Generation: 1,
+			Labels:     labels,
+		})
+		require.Equal(t, http.StatusCreated, rw.Code)
+	}
+	// Labels reported with keepalive replace the labels of the sync.
+	rw := doJSON(t, r, http.MethodPost, "/api/v1/keepalive", model.KeepAliveRequest{
+		HostAddr: "10.8.0.1:5000",
+		Group:    "default",
+		Labels:   model.Labels{"region": "us", "zone": "a", "rack": "r3"},
+	})
+	require.Equal(t, http.StatusCreated, rw.Code)
+
+	holders := findHolders(t, r, "/api/v1/distribution/findkey?key=foo&group=default&request_host=10.0.0.2&labels=region%3Dus,zone%3Da,rack%3Dr2")
+	require.Equal(t, []string{"10.9.0.1:5000", "10.8.0.1:5000", "10.0.0.1:5000", "10.7.0.1:5000"}, holders)
+	// The IP prefix breaks ties.
+	holders = findHolders(t, r, "/api/v1/distribution/findkey?key=foo&group=default&request_host=10.8.0.2&labels=region%3Dus,zone%3Da")
+	require.Equal(t, []string{"10.8.0.1:5000", "10.9.0.1:5000", "10.0.0.1:5000", "10.7.0.1:5000"}, holders)
+	holders = findHolders(t, r, "/api/v1/distribution/findkey?key=foo&group=default&request_host=10.0.0.2")
+	require.Equal(t, []string{"10.0.0.1:5000", "10.7.0.1:5000", "10.8.0.1:5000", "10.9.0.1:5000"}, holders)
+
+	rw = doJSON(t, r, http.MethodPost, "/api/v1/distribution/findkeys", model.FindKeysRequest{
+		Keys:   []string{"foo"},
+		Group:  "default",
+		Labels: model.Labels{"region": "us", "zone": "b"},
+	})
+	require.Equal(t, http.StatusOK, rw.Code)
+	resp := model.FindKeysResponse{}
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &resp))
+	require.Equal(t, []string{"10.0.0.1:5000", "10.8.0.1:5000", "10.9.0.1:5000", "10.7.0.1:5000"}, resp.Holders["foo"])
+
+	rw = doJSON(t, r, http.MethodGet, "/api/v1/distribution/findkey?key=foo&group=default&labels=zone", nil)
+	require.Equal(t, http.StatusBadRequest, rw.Code)
+}
+
+func TestFindKeyLoadBalancing(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter(t, WithLoadBalancing(2))
+	loads := map[string]*model.HostLoad{
+		"10.0.0.1:5000": {Uploads: 5, MaxUploads: 5},
+		"10.0.0.2:5000": nil,
+		"10.0.1.1:5000": {Uploads: 1, MaxUploads: 5, UploadBytesPerSecond: 50, MaxUploadBytesPerSecond: 100},
+	}
+	for holder, load := range loads {
+		rw := doJSON(t, r, http.MethodPost, "/api/v1/distribution/advertise", model.ImageAdvertiseRequest{
+			Holder: holder,
+			Keys:   []string{"foo"},
+			Group:  "default",
+		})
+		require.Equal(t, http.StatusCreated, rw.Code)
+		rw = doJSON(t, r, http.MethodPost, "/api/v1/keepalive", model.KeepAliveRequest{
+			HostAddr: holder,
+			Group:    "default",
+			Load:     load,
+		})
+		require.Equal(t, http.StatusCreated, rw.Code)
+	}
+	// Load reports replace the load of the keepalive.
+	rw := doJSON(t, r, http.MethodPost, "/api/v1/load", model.ReportLoadRequest{
+		HostAddr: "10.0.0.1:5000",
+		Group:    "default",
+		Load:     model.HostLoad{Uploads: 0.5, MaxUploads: 5},
+	})
+	require.Equal(t, http.StatusCreated, rw.Code)
+
+	// With a window of two the less loaded of the next two holders is picked.
+	holders := findHolders(t, r, "/api/v1/distribution/findkey?key=foo&group=default&request_host=10.0.0.3")
+	require.Equal(t, []string{"10.0.0.2:5000", "10.0.0.1:5000", "10.0.1.1:5000"}, holders)
+	holders = findHolders(t, r, "/api/v1/distribution/findkey?key=foo&group=default&request_host=10.0.0.3&count=1")
+	require.Equal(t, []string{"10.0.0.2:5000"}, holders)
+}
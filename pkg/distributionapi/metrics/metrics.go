@@ -33,6 +33,36 @@ var (
 		},
 	)
 
+	FindKeyCacheTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "piccolo_api_findkey_cache_total",
+		Help: "Total number of findkey cache lookups by result, hit or miss.",
+	}, []string{"result"})
+
+	FindKeyCacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "piccolo_api_findkey_cache_entries",
+		Help: "Number of keys in the findkey cache.",
+	})
+
+	HostCacheTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "piccolo_api_host_cache_total",
+		Help: "Total number of hosts looked up in the host cache by result, hit or miss.",
+	}, []string{"result"})
+
+	FindKeyFallbackTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "piccolo_api_findkey_fallback_total",
+		Help: "Total number of lookups which returned holders of a fallback group.",
+	}, []string{"group", "fallback_group"})
+
+	BadHolderReportsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "piccolo_api_bad_holder_reports_total",
+		Help: "Total number of holders reported for serving content not matching the key.",
+	}, []string{"group"})
+
+	SyncRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "piccolo_api_sync_requests_total",
+		Help: "Total number of syncs by type, full, delta or conflict when a delta did not match the acknowledged generation.",
+	}, []string{"type"})
+
 	EvictorRunTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "piccolo_evictor_run_total",
 		Help: "Total number of evictor has been triggered",
@@ -57,6 +87,12 @@ func Register() {
 	DefaultRegisterer.MustRegister(DBQueryTotal)
 	DefaultRegisterer.MustRegister(DBQueryDuration)
 	DefaultRegisterer.MustRegister(FindKeyHolderCountBucket)
+	DefaultRegisterer.MustRegister(FindKeyCacheTotal)
+	DefaultRegisterer.MustRegister(FindKeyCacheEntries)
+	DefaultRegisterer.MustRegister(HostCacheTotal)
+	DefaultRegisterer.MustRegister(FindKeyFallbackTotal)
+	DefaultRegisterer.MustRegister(BadHolderReportsTotal)
+	DefaultRegisterer.MustRegister(SyncRequestsTotal)
 	DefaultRegisterer.MustRegister(EvictorRunTotal)
 	DefaultRegisterer.MustRegister(EvictorDuration)
 	DefaultRegisterer.MustRegister(EvictorDeletedHostTotal)
@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// AllGroups grants a token access to every group.
+	AllGroups = "*"
+
+	allowedGroupsKey = "piccolo.allowed_groups"
+)
+
+// Tokens maps bearer tokens to the groups they are allowed to write to.
+// Tokens are stored hashed so that lookups do not depend on the token content.
+type Tokens struct {
+	groups map[[sha256.Size]byte]map[string]struct{}
+}
+
+// LoadTokens reads a token file with one '<group>:<token>' entry per line.
+// A token can be listed for several groups, the group '*' grants access to
+// every group. Empty lines and lines starting with '#' are ignored.
+func LoadTokens(path string) (*Tokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t := &Tokens{groups: map[[sha256.Size]byte]map[string]struct{}{}}
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		group, token, ok := strings.Cut(line, ":")
+		group = strings.TrimSpace(group)
+		token = strings.TrimSpace(token)
+		if !ok || group == "" || token == "" {
+			return nil, fmt.Errorf("invalid token entry on line %d of %s, expected '<group>:<token>'", lineNo, path)
+		}
+		t.add(group, token)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Tokens) add(group, token string) {
+	h := sha256.Sum256([]byte(token))
+	if _, ok := t.groups[h]; !ok {
+		t.groups[h] = map[string]struct{}{}
+	}
+	t.groups[h][group] = struct{}{}
+}
+
+func (t *Tokens) lookup(token string) (map[string]struct{}, bool) {
+	groups, ok := t.groups[sha256.Sum256([]byte(token))]
+	return groups, ok
+}
+
+// GroupTokenAuth rejects requests without a valid bearer token and stores the
+// groups of the token in the context, handlers check the group of the
+// request with GroupAllowed. Every request is allowed when tokens is nil.
+func GroupTokenAuth(tokens *Tokens) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if tokens == nil {
+			c.Next()
+			return
+		}
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing bearer token"})
+			return
+		}
+		groups, ok := tokens.lookup(token)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid bearer token"})
+			return
+		}
+		c.Set(allowedGroupsKey, groups)
+		c.Next()
+	}
+}
+
+// GroupAllowed returns true if the request is allowed to write to the group.
+func GroupAllowed(c *gin.Context, group string) bool {
+	v, ok := c.Get(allowedGroupsKey)
+	if !ok {
+		// Authentication is disabled.
+		return true
+	}
+	groups := v.(map[string]struct{})
+	if _, ok := groups[AllGroups]; ok {
+		return true
+	}
+	_, ok = groups[group]
+	return ok
+}
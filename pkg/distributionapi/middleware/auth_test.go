@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadTokens(t *testing.T) {
+	t.Parallel()
+
+	p := filepath.Join(t.TempDir(), "tokens")
+	err := os.WriteFile(p, []byte("# comment\n\ngroup-a:foo\ngroup-b: foo\n*:admin\n"), 0o600)
+	require.NoError(t, err)
+	tokens, err := LoadTokens(p)
+	require.NoError(t, err)
+	groups, ok := tokens.lookup("foo")
+	require.True(t, ok)
+	require.Len(t, groups, 2)
+	_, ok = tokens.lookup("bar")
+	require.False(t, ok)
+
+	err = os.WriteFile(p, []byte("group-a:foo\nbar\n"), 0o600)
+	require.NoError(t, err)
+	_, err = LoadTokens(p)
+	require.EqualError(t, err, "invalid token entry on line 2 of "+p+", expected '<group>:<token>'")
+}
+
+func TestGroupTokenAuth(t *testing.T) {
+	t.Parallel()
+
+	gin.SetMode(gin.TestMode)
+	tokens := &Tokens{groups: map[[32]byte]map[string]struct{}{}}
+	tokens.add("group-a", "foo")
+	tokens.add(AllGroups, "admin")
+
+	tests := []struct {
+		name          string
+		tokens        *Tokens
+		authorization string
+		expected      int
+	}{
+		{
+			name:     "auth disabled",
+			expected: http.StatusOK,
+		},
+		{
+			name:     "missing token",
+			tokens:   tokens,
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:          "invalid token",
+			tokens:        tokens,
+			authorization: "Bearer bar",
+			expected:      http.StatusUnauthorized,
+		},
+		{
+			name:          "other group",
+			tokens:        tokens,
+			authorization: "Bearer foo",
+			expected:      http.StatusForbidden,
+		},
+		{
+			name:          "all groups",
+			tokens:        tokens,
+			authorization: "Bearer admin",
+			expected:      http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := gin.New()
+			r.POST("/", GroupTokenAuth(tt.tokens), func(c *gin.Context) {
+				if !GroupAllowed(c, "group-b") {
+					c.Status(http.StatusForbidden)
+					return
+				}
+				c.Status(http.StatusOK)
+			})
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rw := httptest.NewRecorder()
+			r.ServeHTTP(rw, req)
+			require.Equal(t, tt.expected, rw.Code)
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package model
+
+import (
+	"time"
+)
+
+// PageRequest selects a page of a listing, a limit of 0 selects the default
+// page size.
+type PageRequest struct {
+	Offset int `form:"offset" binding:"min=0"`
+	Limit  int `form:"limit" binding:"min=0"`
+}
+
+// GroupSummary is a group and the number of its hosts.
+type GroupSummary struct {
+	Group string `json:"group"`
+	Hosts int64  `json:"hosts"`
+}
+
+type ListGroupsResponse struct {
+	Groups []GroupSummary `json:"groups"`
+	Total  int64          `json:"total"`
+}
+
+type ListHostsRequest struct {
+	Group string `form:"group" binding:"required"`
+	PageRequest
+}
+
+type ListHostsResponse struct {
+	Group string `json:"group"`
+	Hosts []Host `json:"hosts"`
+	Total int64  `json:"total"`
+}
+
+type ListKeysRequest struct {
+	Group  string `form:"group" binding:"required"`
+	Holder string `form:"holder" binding:"required"`
+	PageRequest
+}
+
+type ListKeysResponse struct {
+	Group  string   `json:"group"`
+	Holder string   `json:"holder"`
+	Keys   []string `json:"keys"`
+	Total  int64    `json:"total"`
+}
+
+type ListHoldersRequest struct {
+	Group string `form:"group" binding:"required"`
+	Key   string `form:"key" binding:"required"`
+	PageRequest
+}
+
+// KeyHolder is a holder of a key and what is known about the holder.
+type KeyHolder struct {
+	Holder string `json:"holder"`
+	// AdvertisedAt is when the holder advertised the key, unknown for redis.
+	AdvertisedAt time.Time `json:"advertised_at,omitzero"`
+	// LastSeen is the last keepalive of the holder, unknown if the host
+	// has not sent a keepalive yet.
+	LastSeen    time.Time `json:"last_seen,omitzero"`
+	Labels      Labels    `json:"labels,omitempty"`
+	Utilization float64   `json:"utilization"`
+}
+
+type ListHoldersResponse struct {
+	Group   string      `json:"group"`
+	Key     string      `json:"key"`
+	Holders []KeyHolder `json:"holders"`
+	Total   int64       `json:"total"`
+}
+
+type TopKeysRequest struct {
+	Group string `form:"group" binding:"required"`
+	PageRequest
+}
+
+// KeyReplicas is a key and the number of its holders.
+type KeyReplicas struct {
+	Key     string `json:"key"`
+	Holders int64  `json:"holders"`
+}
+
+type TopKeysResponse struct {
+	Group string        `json:"group"`
+	Keys  []KeyReplicas `json:"keys"`
+	Total int64         `json:"total"`
+}
@@ -7,7 +7,7 @@ import (
 type Distribution struct {
 	ID        uint      `gorm:"primaryKey;autoIncrement" json:"id"`
 	Key       string    `gorm:"size:255;uniqueIndex:uniq_idx_group_key_holder_uniq,priority:2" json:"key"`
-	Holder    string    `gorm:"size:24;uniqueIndex:uniq_idx_group_key_holder_uniq,priority:3;index:idx_holder" json:"holder"`
+	Holder    string    `gorm:"size:64;uniqueIndex:uniq_idx_group_key_holder_uniq,priority:3;index:idx_holder" json:"holder"`
 	Group     string    `gorm:"size:64;uniqueIndex:uniq_idx_group_key_holder_uniq,priority:1" json:"group"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
@@ -19,11 +19,19 @@ func (Distribution) TableName() string {
 
 type Host struct {
 	ID        uint      `gorm:"primaryKey;autoIncrement" json:"id"`
-	HostAddr  string    `gorm:"size:24;uniqueIndex:uniq_idx_group_host,priority:2" json:"host_addr"`
+	HostAddr  string    `gorm:"size:64;uniqueIndex:uniq_idx_group_host,priority:2" json:"host_addr"`
 	Group     string    `gorm:"size:64;uniqueIndex:uniq_idx_group_host,priority:1" json:"group"`
 	LastSeen  time.Time `json:"last_seen"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+	// SyncGeneration is the generation of the keys of the host acknowledged
+	// by the last sync, 0 if the host has to send all of its keys.
+	SyncGeneration uint64 `gorm:"default:0" json:"sync_generation"`
+	// Labels is the topology of the host reported with keepalive and sync.
+	Labels Labels `gorm:"size:1024;serializer:json" json:"labels,omitempty"`
+	// Utilization is the upload load of the host reported with keepalive and
+	// load reports, from 0 for idle to 1 for fully loaded.
+	Utilization float64 `gorm:"default:0" json:"utilization"`
 }
 
 func (Host) TableName() string {
@@ -34,6 +42,31 @@ type ImageAdvertiseRequest struct {
 	Holder string   `json:"holder" binding:"required"`
 	Keys   []string `json:"keys" binding:"required"`
 	Group  string   `json:"group" binding:"required"`
+	// Generation of the keys, only used by sync.
+	Generation uint64 `json:"generation,omitempty"`
+	// Labels of the holder.
+	Labels Labels `json:"labels,omitempty"`
+}
+
+// SyncDeltaRequest contains the keys added and removed by the holder since
+// BaseGeneration, the generation acknowledged by the last sync.
+type SyncDeltaRequest struct {
+	Holder         string   `json:"holder" binding:"required"`
+	Group          string   `json:"group" binding:"required"`
+	BaseGeneration uint64   `json:"base_generation" binding:"required"`
+	Generation     uint64   `json:"generation" binding:"required"`
+	Added          []string `json:"added"`
+	Removed        []string `json:"removed"`
+}
+
+type SyncDeltaResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	// Generation acknowledged by piccolo.
+	Generation uint64 `json:"generation"`
+	// FullSyncRequired is set when the base generation does not match, the
+	// holder has to sync all of its keys.
+	FullSyncRequired bool `json:"full_sync_required"`
 }
 
 type ImageAdvertiseResponse struct {
@@ -51,6 +84,8 @@ type FindKeyRequest struct {
 	Group       string `form:"group" binding:"required"`
 	Count       int    `form:"count"`
 	RequestHost string `form:"request_host"`
+	// Labels of the requester in the form 'key=value,key=value'.
+	Labels string `form:"labels"`
 }
 
 type FindKeyResponse struct {
@@ -58,9 +93,82 @@ type FindKeyResponse struct {
 	Group   string   `form:"group" binding:"required"`
 	Holders []string `json:"holders"`
 	Total   int      `json:"total"`
+	// HolderGroups is the group of every holder found in a fallback group,
+	// holders of the requested group are left out.
+	HolderGroups map[string]string `json:"holder_groups,omitempty"`
 }
 
-type KeepAliveRequest struct {
+type FindKeysRequest struct {
+	Keys        []string `json:"keys" binding:"required"`
+	Group       string   `json:"group" binding:"required"`
+	Count       int      `json:"count"`
+	RequestHost string   `json:"request_host"`
+	Labels      Labels   `json:"labels,omitempty"`
+}
+
+// FindKeysResponse contains the holders of every requested key which has
+// holders, keys without holders are left out.
+type FindKeysResponse struct {
+	Group   string              `json:"group"`
+	Holders map[string][]string `json:"holders"`
+	// HolderGroups is the group of every holder found in a fallback group,
+	// holders of the requested group are left out.
+	HolderGroups map[string]string `json:"holder_groups,omitempty"`
+}
+
+// WithdrawRequest removes keys the holder no longer has.
+type WithdrawRequest struct {
+	Holder string   `json:"holder" binding:"required"`
+	Keys   []string `json:"keys" binding:"required"`
+	Group  string   `json:"group" binding:"required"`
+}
+
+type ReportBadHolderRequest struct {
+	Key      string `json:"key" binding:"required"`
+	Holder   string `json:"holder" binding:"required"`
+	Group    string `json:"group" binding:"required"`
+	Reporter string `json:"reporter" binding:"required"`
+}
+
+// DeregisterRequest removes a host and all of its keys.
+type DeregisterRequest struct {
 	HostAddr string `json:"host" binding:"required"`
-	Group    string `form:"group" binding:"required"`
+	Group    string `json:"group" binding:"required"`
+}
+
+type KeepAliveRequest struct {
+	HostAddr string    `json:"host" binding:"required"`
+	Group    string    `form:"group" binding:"required"`
+	Labels   Labels    `json:"labels,omitempty"`
+	Load     *HostLoad `json:"load,omitempty"`
+}
+
+// ReportLoadRequest reports the upload load of a host more often than
+// keepalive.
+type ReportLoadRequest struct {
+	HostAddr string   `json:"host" binding:"required"`
+	Group    string   `json:"group" binding:"required"`
+	Load     HostLoad `json:"load"`
+}
+
+// HostLoad is the upload load of a host.
+type HostLoad struct {
+	// Uploads is the average number of uploads since the last report.
+	Uploads                 float64 `json:"uploads"`
+	MaxUploads              int     `json:"max_uploads"`
+	UploadBytesPerSecond    float64 `json:"upload_bytes_per_second"`
+	MaxUploadBytesPerSecond float64 `json:"max_upload_bytes_per_second"`
+}
+
+// Utilization returns the higher of the used share of the upload connections
+// and of the upload bandwidth, between 0 and 1.
+func (l HostLoad) Utilization() float64 {
+	u := 0.0
+	if l.MaxUploads > 0 {
+		u = l.Uploads / float64(l.MaxUploads)
+	}
+	if l.MaxUploadBytesPerSecond > 0 {
+		u = max(u, l.UploadBytesPerSecond/l.MaxUploadBytesPerSecond)
+	}
+	return min(max(u, 0), 1)
 }
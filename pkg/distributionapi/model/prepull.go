@@ -0,0 +1,65 @@
+package model
+
+import (
+	"time"
+)
+
+const (
+	PrepullStatusPulling = "pulling"
+	PrepullStatusDone    = "done"
+	PrepullStatusFailed  = "failed"
+)
+
+// Prepull asks every pi of the group to pull the image.
+type Prepull struct {
+	ID        uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	Image     string    `gorm:"size:512" json:"image"`
+	Group     string    `gorm:"size:64;index:idx_group_created_at,priority:1" json:"group"`
+	CreatedAt time.Time `gorm:"index:idx_group_created_at,priority:2" json:"created_at"`
+}
+
+func (Prepull) TableName() string {
+	return "prepull_tab"
+}
+
+// PrepullHostStatus is the progress of a prepull on one host.
+type PrepullHostStatus struct {
+	ID        uint      `gorm:"primaryKey;autoIncrement" json:"-"`
+	PrepullID uint      `gorm:"uniqueIndex:uniq_idx_prepull_host,priority:1" json:"prepull_id"`
+	Host      string    `gorm:"size:64;uniqueIndex:uniq_idx_prepull_host,priority:2" json:"host"`
+	Group     string    `gorm:"size:64" json:"group"`
+	Status    string    `gorm:"size:16" json:"status"`
+	Message   string    `gorm:"size:1024" json:"message"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (PrepullHostStatus) TableName() string {
+	return "prepull_host_tab"
+}
+
+type CreatePrepullRequest struct {
+	Image string `json:"image" binding:"required"`
+	Group string `json:"group" binding:"required"`
+}
+
+type PendingPrepullsRequest struct {
+	Group string `form:"group" binding:"required"`
+	Host  string `form:"host" binding:"required"`
+}
+
+type PrepullStatusRequest struct {
+	PrepullID uint   `json:"prepull_id" binding:"required"`
+	Host      string `json:"host" binding:"required"`
+	Group     string `json:"group" binding:"required"`
+	Status    string `json:"status" binding:"required,oneof=pulling done failed"`
+	Message   string `json:"message"`
+}
+
+type PrepullResponse struct {
+	Prepull Prepull             `json:"prepull"`
+	Hosts   []PrepullHostStatus `json:"hosts"`
+}
+
+type PendingPrepullsResponse struct {
+	Prepulls []Prepull `json:"prepulls"`
+}
@@ -0,0 +1,57 @@
+package model
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Labels describe where a host is located, e.g. region, zone and rack.
+type Labels map[string]string
+
+// ParseLabels parses labels in the form 'key=value,key=value'.
+func ParseLabels(s string) (Labels, error) {
+	labels := Labels{}
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid label %q, expected 'key=value'", kv)
+		}
+		labels[k] = strings.TrimSpace(v)
+	}
+	return labels, nil
+}
+
+// String returns the labels in the form parsed by ParseLabels, sorted by key.
+func (l Labels) String() string {
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	kvs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		kvs = append(kvs, k+"="+l[k])
+	}
+	return strings.Join(kvs, ",")
+}
+
+// TopologyScore returns the number of leading labels of the hierarchy which
+// are set and equal on both hosts. The hierarchy is ordered from the
+// broadest to the narrowest label, e.g. region, zone, rack.
+func TopologyScore(hierarchy []string, a, b Labels) int {
+	score := 0
+	for _, k := range hierarchy {
+		v, ok := a[k]
+		if !ok || v == "" || b[k] != v {
+			break
+		}
+		score++
+	}
+	return score
+}
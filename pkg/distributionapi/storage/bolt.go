@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The bolt database uses nested buckets, so keys, holders and groups do not
+// need to be escaped:
+//
+//	distribution_tab/<group>/<key>/<holder> = created at
+//	holder_index/<group>/<holder>/<key>
+//	host_tab/<group>/<host_addr> = JSON encoded model.Host
+//	prepull_tab/<group>/<id> = JSON encoded model.Prepull
+//	prepull_host_tab/<group>/<id>/<host> = JSON encoded model.PrepullHostStatus
+var (
+	distributionBucket = []byte("distribution_tab")
+	holderIndexBucket  = []byte("holder_index")
+	hostBucket         = []byte("host_tab")
+	prepullBucket      = []byte("prepull_tab")
+	prepullHostBucket  = []byte("prepull_host_tab")
+)
+
+// InitBolt opens the bolt database at path and creates the buckets.
+func InitBolt(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt database %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{distributionBucket, holderIndexBucket, hostBucket, prepullBucket, prepullHostBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create buckets in bolt database %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// nestedBucket returns the bucket at the path below root, nil if it does not exist.
+func nestedBucket(tx *bolt.Tx, root []byte, path ...string) *bolt.Bucket {
+	b := tx.Bucket(root)
+	for _, name := range path {
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket([]byte(name))
+	}
+	return b
+}
+
+// createNestedBucket returns the bucket at the path below root, creating missing buckets.
+func createNestedBucket(tx *bolt.Tx, root []byte, path ...string) (*bolt.Bucket, error) {
+	b := tx.Bucket(root)
+	for _, name := range path {
+		var err error
+		b, err = b.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// deleteIfEmpty removes the child bucket name from parent if it has no keys left.
+func deleteIfEmpty(parent *bolt.Bucket, name string) error {
+	b := parent.Bucket([]byte(name))
+	if b == nil {
+		return nil
+	}
+	if k, _ := b.Cursor().First(); k != nil {
+		return nil
+	}
+	return parent.DeleteBucket([]byte(name))
+}
+
+// countKeys returns the number of keys of the bucket, nil buckets are empty.
+func countKeys(b *bolt.Bucket) int64 {
+	if b == nil {
+		return 0
+	}
+	n := int64(0)
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n++
+	}
+	return n
+}
+
+// forEachInPage calls fn for the keys of the bucket from offset up to limit
+// keys in key order and returns the number of keys of the bucket.
+func forEachInPage(b *bolt.Bucket, offset, limit int, fn func(k, v []byte) error) (int64, error) {
+	if b == nil {
+		return 0, nil
+	}
+	i := 0
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if i >= offset && i-offset < limit {
+			if err := fn(k, v); err != nil {
+				return 0, err
+			}
+		}
+		i++
+	}
+	return int64(i), nil
+}
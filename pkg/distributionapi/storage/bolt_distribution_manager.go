@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
+	bolt "go.etcd.io/bbolt"
+)
+
+type BoltDistributionManager struct {
+	db *bolt.DB
+}
+
+func NewBoltDistributionManager(db *bolt.DB) *BoltDistributionManager {
+	return &BoltDistributionManager{db: db}
+}
+
+func (m *BoltDistributionManager) CreateDistributions(distributions []*model.Distribution, group string) (retErr error) {
+	if len(distributions) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	defer func() { observeQuery("distribution_tab", "insert", group, start, retErr) }()
+
+	createdAt, err := time.Now().MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return m.db.Update(func(tx *bolt.Tx) error {
+		for _, d := range distributions {
+			keyBucket, err := createNestedBucket(tx, distributionBucket, d.Group, d.Key)
+			if err != nil {
+				return err
+			}
+			// Existing distributions are ignored like INSERT IGNORE.
+			if keyBucket.Get([]byte(d.Holder)) != nil {
+				continue
+			}
+			if err := keyBucket.Put([]byte(d.Holder), createdAt); err != nil {
+				return err
+			}
+			holderBucket, err := createNestedBucket(tx, holderIndexBucket, d.Group, d.Holder)
+			if err != nil {
+				return err
+			}
+			if err := holderBucket.Put([]byte(d.Key), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *BoltDistributionManager) GetHolderByKey(ctx context.Context, group string, key string) (holders []string, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("distribution_tab", "get_holder_by_key", group, start, retErr) }()
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get holders by key %s: %w", key, err)
+	}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := nestedBucket(tx, distributionBucket, group, key)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && len(holders) < FindKeyMaxResults; k, _ = c.Next() {
+			holders = append(holders, string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get holders by key %s: %w", key, err)
+	}
+	return holders, nil
+}
+
+func (m *BoltDistributionManager) GetKeysByHolder(group, holder string) (keys []string, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("distribution_tab", "get_keys_by_holder", group, start, retErr) }()
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := nestedBucket(tx, holderIndexBucket, group, holder)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (m *BoltDistributionManager) DeleteKeysByHolder(keys []string, holder, group string) (retErr error) {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	defer func() { observeQuery("distribution_tab", "delete_by_keys", group, start, retErr) }()
+
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return deleteDistributions(tx, group, holder, keys)
+	})
+}
+
+func (m *BoltDistributionManager) DeleteByHolder(host model.Host) (retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("distribution_tab", "delete_by_holder", host.Group, start, retErr) }()
+
+	if err := m.deleteByHolder(host); err != nil {
+		return fmt.Errorf("failed to delete distributions for holder %s (group=%s): %w",
+			host.HostAddr, host.Group, err)
+	}
+	return nil
+}
+
+// DeleteByHolderByMasterResolver deletes distributions of the holder, all
+// groups share the same bolt database so the resolver is only used for metrics.
+func (m *BoltDistributionManager) DeleteByHolderByMasterResolver(host model.Host, masterResolver string) (retErr error) {
+	start := time.Now()
+	defer func() {
+		observeQuery("distribution_tab", "delete_by_holder_by_master", masterResolver, start, retErr)
+	}()
+
+	if err := m.deleteByHolder(host); err != nil {
+		return fmt.Errorf("failed to delete distributions for holder %s (group=%s) from master %s: %w",
+			host.HostAddr, host.Group, masterResolver, err)
+	}
+	return nil
+}
+
+func (m *BoltDistributionManager) deleteByHolder(host model.Host) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		b := nestedBucket(tx, holderIndexBucket, host.Group, host.HostAddr)
+		if b == nil {
+			return nil
+		}
+		keys := []string{}
+		err := b.ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return deleteDistributions(tx, host.Group, host.HostAddr, keys)
+	})
+}
+
+// deleteDistributions removes the holder from the keys and drops buckets which became empty.
+func deleteDistributions(tx *bolt.Tx, group, holder string, keys []string) error {
+	groupBucket := nestedBucket(tx, distributionBucket, group)
+	holderGroupBucket := nestedBucket(tx, holderIndexBucket, group)
+	if groupBucket == nil || holderGroupBucket == nil {
+		return nil
+	}
+	holderBucket := holderGroupBucket.Bucket([]byte(holder))
+	for _, key := range keys {
+		if keyBucket := groupBucket.Bucket([]byte(key)); keyBucket != nil {
+			if err := keyBucket.Delete([]byte(holder)); err != nil {
+				return err
+			}
+			if err := deleteIfEmpty(groupBucket, key); err != nil {
+				return err
+			}
+		}
+		if holderBucket != nil {
+			if err := holderBucket.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+	}
+	return deleteIfEmpty(holderGroupBucket, holder)
+}
+
+func (m *BoltDistributionManager) ListKeysByHolder(group, holder string, offset, limit int) (keys []string, total int64, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("distribution_tab", "list_keys_by_holder", group, start, retErr) }()
+
+	keys = []string{}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		var err error
+		total, err = forEachInPage(nestedBucket(tx, holderIndexBucket, group, holder), offset, limit, func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list keys of holder %s (group=%s): %w", holder, group, err)
+	}
+	return keys, total, nil
+}
+
+func (m *BoltDistributionManager) ListHoldersByKey(group, key string, offset, limit int) (distributions []model.Distribution, total int64, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("distribution_tab", "list_holders_by_key", group, start, retErr) }()
+
+	distributions = []model.Distribution{}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		var err error
+		total, err = forEachInPage(nestedBucket(tx, distributionBucket, group, key), offset, limit, func(k, v []byte) error {
+			d := model.Distribution{Key: key, Holder: string(k), Group: group}
+			if err := d.CreatedAt.UnmarshalBinary(v); err != nil {
+				return err
+			}
+			d.UpdatedAt = d.CreatedAt
+			distributions = append(distributions, d)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list holders of key %s (group=%s): %w", key, group, err)
+	}
+	return distributions, total, nil
+}
+
+// TopKeys counts the holders of every key of the group.
+func (m *BoltDistributionManager) TopKeys(group string, offset, limit int) (_ []model.KeyReplicas, _ int64, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("distribution_tab", "top_keys", group, start, retErr) }()
+
+	keys := []model.KeyReplicas{}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := nestedBucket(tx, distributionBucket, group)
+		if b == nil {
+			return nil
+		}
+		return b.ForEachBucket(func(k []byte) error {
+			keys = append(keys, model.KeyReplicas{Key: string(k), Holders: countKeys(b.Bucket(k))})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to find top keys (group=%s): %w", group, err)
+	}
+	return pageTopKeys(keys, offset, limit), int64(len(keys)), nil
+}
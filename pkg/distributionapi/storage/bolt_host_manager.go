@@ -0,0 +1,293 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
+	bolt "go.etcd.io/bbolt"
+)
+
+type BoltHostManager struct {
+	db *bolt.DB
+}
+
+func NewBoltHostManager(db *bolt.DB) *BoltHostManager {
+	return &BoltHostManager{db: db}
+}
+
+func (m *BoltHostManager) RefreshHostAddr(hostAddr, group string) (retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "refresh_host_addr", group, start, retErr) }()
+
+	return m.updateHost(hostAddr, group, func(host *model.Host) {
+		host.LastSeen = host.UpdatedAt
+	})
+}
+
+func (m *BoltHostManager) GetSyncGeneration(hostAddr, group string) (generation uint64, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "get_sync_generation", group, start, retErr) }()
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := nestedBucket(tx, hostBucket, group)
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(hostAddr))
+		if v == nil {
+			return nil
+		}
+		var host model.Host
+		if err := json.Unmarshal(v, &host); err != nil {
+			return err
+		}
+		generation = host.SyncGeneration
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get sync generation of host %s (group=%s): %w", hostAddr, group, err)
+	}
+	return generation, nil
+}
+
+func (m *BoltHostManager) SetSyncGeneration(hostAddr, group string, generation uint64) (retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "set_sync_generation", group, start, retErr) }()
+
+	return m.updateHost(hostAddr, group, func(host *model.Host) {
+		if host.LastSeen.IsZero() {
+			host.LastSeen = host.UpdatedAt
+		}
+		host.SyncGeneration = generation
+	})
+}
+
+func (m *BoltHostManager) SetHostLabels(hostAddr, group string, labels model.Labels) (retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "set_host_labels", group, start, retErr) }()
+
+	return m.updateHost(hostAddr, group, func(host *model.Host) {
+		if host.LastSeen.IsZero() {
+			host.LastSeen = host.UpdatedAt
+		}
+		host.Labels = labels
+	})
+}
+
+func (m *BoltHostManager) SetHostUtilization(hostAddr, group string, utilization float64) (retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "set_host_utilization", group, start, retErr) }()
+
+	return m.updateHost(hostAddr, group, func(host *model.Host) {
+		if host.LastSeen.IsZero() {
+			host.LastSeen = host.UpdatedAt
+		}
+		host.Utilization = utilization
+	})
+}
+
+func (m *BoltHostManager) GetHosts(group string, hostAddrs []string) (hosts map[string]model.Host, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "get_hosts", group, start, retErr) }()
+
+	hosts = map[string]model.Host{}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := nestedBucket(tx, hostBucket, group)
+		if b == nil {
+			return nil
+		}
+		for _, hostAddr := range hostAddrs {
+			v := b.Get([]byte(hostAddr))
+			if v == nil {
+				continue
+			}
+			var host model.Host
+			if err := json.Unmarshal(v, &host); err != nil {
+				return err
+			}
+			hosts[hostAddr] = host
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hosts (group=%s): %w", group, err)
+	}
+	return hosts, nil
+}
+
+// updateHost applies update to the host, the host is created if it does not exist.
+func (m *BoltHostManager) updateHost(hostAddr, group string, update func(host *model.Host)) error {
+	now := time.Now()
+	return m.db.Update(func(tx *bolt.Tx) error {
+		b, err := createNestedBucket(tx, hostBucket, group)
+		if err != nil {
+			return err
+		}
+		host := model.Host{
+			HostAddr:  hostAddr,
+			Group:     group,
+			CreatedAt: now,
+		}
+		if v := b.Get([]byte(hostAddr)); v != nil {
+			if err := json.Unmarshal(v, &host); err != nil {
+				return err
+			}
+		}
+		host.UpdatedAt = now
+		update(&host)
+		v, err := json.Marshal(host)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(hostAddr), v)
+	})
+}
+
+func (m *BoltHostManager) HostExists(hostAddr, group string) (exists bool, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "host_exists", group, start, retErr) }()
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := nestedBucket(tx, hostBucket, group)
+		exists = b != nil && b.Get([]byte(hostAddr)) != nil
+		return nil
+	})
+	return exists, err
+}
+
+func (m *BoltHostManager) FindDeadHosts(group string) (deadHosts []model.Host, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "find_dead_hosts", group, start, retErr) }()
+
+	threshold := time.Now().Add(-DEADTIMEOUT)
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := nestedBucket(tx, hostBucket, group)
+		if b == nil {
+			return nil
+		}
+		hosts, err := findDeadHosts(b, threshold)
+		deadHosts = hosts
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find dead hosts: %w", err)
+	}
+	return deadHosts, nil
+}
+
+// FindDeadHostsByMasterResolver finds the dead hosts of all groups, all
+// groups share the same bolt database so the resolver is only used for metrics.
+func (m *BoltHostManager) FindDeadHostsByMasterResolver(masterResolver string) (deadHosts []model.Host, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "find_dead_hosts_by_master", masterResolver, start, retErr) }()
+
+	threshold := time.Now().Add(-DEADTIMEOUT)
+	err := m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(hostBucket).ForEachBucket(func(group []byte) error {
+			hosts, err := findDeadHosts(tx.Bucket(hostBucket).Bucket(group), threshold)
+			deadHosts = append(deadHosts, hosts...)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find dead hosts from master resolver %s: %w", masterResolver, err)
+	}
+	return deadHosts, nil
+}
+
+func findDeadHosts(b *bolt.Bucket, threshold time.Time) ([]model.Host, error) {
+	var deadHosts []model.Host
+	err := b.ForEach(func(_, v []byte) error {
+		var host model.Host
+		if err := json.Unmarshal(v, &host); err != nil {
+			return err
+		}
+		if host.LastSeen.Before(threshold) {
+			deadHosts = append(deadHosts, host)
+		}
+		return nil
+	})
+	return deadHosts, err
+}
+
+func (m *BoltHostManager) DeleteHost(host model.Host) (retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "delete_host", host.Group, start, retErr) }()
+
+	if err := m.deleteHost(host); err != nil {
+		return fmt.Errorf("failed to delete host %s (group=%s): %w",
+			host.HostAddr, host.Group, err)
+	}
+	return nil
+}
+
+// DeleteHostByMasterResolver deletes the host, all groups share the same
+// bolt database so the resolver is only used for metrics.
+func (m *BoltHostManager) DeleteHostByMasterResolver(host model.Host, masterResolver string) (retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "delete_host_by_master", masterResolver, start, retErr) }()
+
+	if err := m.deleteHost(host); err != nil {
+		return fmt.Errorf("failed to delete host %s (group=%s) from master %s: %w",
+			host.HostAddr, host.Group, masterResolver, err)
+	}
+	return nil
+}
+
+func (m *BoltHostManager) deleteHost(host model.Host) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		groupBucket := nestedBucket(tx, hostBucket, host.Group)
+		if groupBucket == nil {
+			return nil
+		}
+		if err := groupBucket.Delete([]byte(host.HostAddr)); err != nil {
+			return err
+		}
+		return deleteIfEmpty(tx.Bucket(hostBucket), host.Group)
+	})
+}
+
+func (m *BoltHostManager) ListHosts(group string, offset, limit int) (hosts []model.Host, total int64, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "list_hosts", group, start, retErr) }()
+
+	hosts = []model.Host{}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		var err error
+		total, err = forEachInPage(nestedBucket(tx, hostBucket, group), offset, limit, func(_, v []byte) error {
+			var host model.Host
+			if err := json.Unmarshal(v, &host); err != nil {
+				return err
+			}
+			hosts = append(hosts, host)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list hosts (group=%s): %w", group, err)
+	}
+	return hosts, total, nil
+}
+
+// ListGroupsByMasterResolver lists all groups, all groups share the same
+// bolt database so the resolver is only used for metrics.
+func (m *BoltHostManager) ListGroupsByMasterResolver(masterResolver string) (groups []model.GroupSummary, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "list_groups_by_master", masterResolver, start, retErr) }()
+
+	groups = []model.GroupSummary{}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(hostBucket)
+		return b.ForEachBucket(func(group []byte) error {
+			groups = append(groups, model.GroupSummary{Group: string(group), Hosts: countKeys(b.Bucket(group))})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list groups from master resolver %s: %w", masterResolver, err)
+	}
+	return groups, nil
+}
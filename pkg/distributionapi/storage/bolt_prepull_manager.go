@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
+	bolt "go.etcd.io/bbolt"
+)
+
+type BoltPrepullManager struct {
+	db *bolt.DB
+}
+
+func NewBoltPrepullManager(db *bolt.DB) *BoltPrepullManager {
+	return &BoltPrepullManager{db: db}
+}
+
+func prepullKey(id uint) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(id))
+}
+
+func (m *BoltPrepullManager) CreatePrepull(prepull *model.Prepull) (retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("prepull_tab", "create_prepull", prepull.Group, start, retErr) }()
+
+	return m.db.Update(func(tx *bolt.Tx) error {
+		b, err := createNestedBucket(tx, prepullBucket, prepull.Group)
+		if err != nil {
+			return err
+		}
+		// Sequences are per bucket, the root bucket makes ids unique across groups.
+		id, err := tx.Bucket(prepullBucket).NextSequence()
+		if err != nil {
+			return err
+		}
+		prepull.ID = uint(id)
+		prepull.CreatedAt = time.Now()
+		v, err := json.Marshal(prepull)
+		if err != nil {
+			return err
+		}
+		return b.Put(prepullKey(prepull.ID), v)
+	})
+}
+
+func (m *BoltPrepullManager) GetPrepull(group string, id uint) (_ *model.Prepull, _ []model.PrepullHostStatus, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("prepull_tab", "get_prepull", group, start, retErr) }()
+
+	var prepull *model.Prepull
+	hosts := []model.PrepullHostStatus{}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := nestedBucket(tx, prepullBucket, group)
+		if b == nil {
+			return ErrNotFound
+		}
+		v := b.Get(prepullKey(id))
+		if v == nil {
+			return ErrNotFound
+		}
+		prepull = &model.Prepull{}
+		if err := json.Unmarshal(v, prepull); err != nil {
+			return err
+		}
+		hostBucket := nestedBucket(tx, prepullHostBucket, group, string(prepullKey(id)))
+		if hostBucket == nil {
+			return nil
+		}
+		return hostBucket.ForEach(func(_, v []byte) error {
+			status := model.PrepullHostStatus{}
+			if err := json.Unmarshal(v, &status); err != nil {
+				return err
+			}
+			hosts = append(hosts, status)
+			return nil
+		})
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil, err
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get prepull %d: %w", id, err)
+	}
+	return prepull, hosts, nil
+}
+
+func (m *BoltPrepullManager) PendingPrepulls(group, host string, since time.Time) (prepulls []model.Prepull, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("prepull_tab", "pending_prepulls", group, start, retErr) }()
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := nestedBucket(tx, prepullBucket, group)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			prepull := model.Prepull{}
+			if err := json.Unmarshal(v, &prepull); err != nil {
+				return err
+			}
+			if !prepull.CreatedAt.After(since) {
+				return nil
+			}
+			if hostBucket := nestedBucket(tx, prepullHostBucket, group, string(k)); hostBucket != nil {
+				if v := hostBucket.Get([]byte(host)); v != nil {
+					status := model.PrepullHostStatus{}
+					if err := json.Unmarshal(v, &status); err != nil {
+						return err
+					}
+					if status.Status == model.PrepullStatusDone || status.Status == model.PrepullStatusFailed {
+						return nil
+					}
+				}
+			}
+			prepulls = append(prepulls, prepull)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find pending prepulls: %w", err)
+	}
+	return prepulls, nil
+}
+
+func (m *BoltPrepullManager) UpdatePrepullStatus(status *model.PrepullHostStatus) (retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("prepull_host_tab", "update_prepull_status", status.Group, start, retErr) }()
+
+	status.UpdatedAt = time.Now()
+	return m.db.Update(func(tx *bolt.Tx) error {
+		b, err := createNestedBucket(tx, prepullHostBucket, status.Group, string(prepullKey(status.PrepullID)))
+		if err != nil {
+			return err
+		}
+		v, err := json.Marshal(status)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(status.Host), v)
+	})
+}
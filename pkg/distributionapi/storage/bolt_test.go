@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
+)
+
+func newTestBoltManager(t *testing.T) *Manager {
+	t.Helper()
+
+	m, err := Open([]string{"default:bolt:" + filepath.Join(t.TempDir(), "piccolo.db")})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func TestOpen(t *testing.T) {
+	t.Parallel()
+
+	_, err := Open([]string{"default:bolt:/tmp/a.db", "default:master:dsn"})
+	require.EqualError(t, err, "bolt database /tmp/a.db can not be combined with other DSNs")
+	_, err = Open([]string{"us-1:bolt:/tmp/a.db"})
+	require.EqualError(t, err, "bolt database must be configured for the default group, got us-1")
+
+	m := newTestBoltManager(t)
+	require.Equal(t, []string{"default"}, m.GetGroups())
+	require.Equal(t, []string{"master_default"}, m.GetMasterResolvers())
+}
+
+func TestBoltDistributions(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	m := newTestBoltManager(t)
+
+	err := m.Distribution.CreateDistributions([]*model.Distribution{
+		{Key: "foo", Holder: "10.0.0.1:5000", Group: "a"},
+		{Key: "foo", Holder: "10.0.0.2:5000", Group: "a"},
+		{Key: "bar", Holder: "10.0.0.1:5000", Group: "a"},
+		{Key: "foo", Holder: "10.0.0.3:5000", Group: "b"},
+	}, "a")
+	require.NoError(t, err)
+	// Inserting an existing distribution is ignored.
+	err = m.Distribution.CreateDistributions([]*model.Distribution{{Key: "foo", Holder: "10.0.0.1:5000", Group: "a"}}, "a")
+	require.NoError(t, err)
+
+	holders, err := m.Distribution.GetHolderByKey(ctx, "a", "foo")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"10.0.0.1:5000", "10.0.0.2:5000"}, holders)
+	holders, err = m.Distribution.GetHolderByKey(ctx, "c", "foo")
+	require.NoError(t, err)
+	require.Empty(t, holders)
+	keys, err := m.Distribution.GetKeysByHolder("a", "10.0.0.1:5000")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"foo", "bar"}, keys)
+
+	err = m.Distribution.DeleteKeysByHolder([]string{"foo", "missing"}, "10.0.0.1:5000", "a")
+	require.NoError(t, err)
+	holders, err = m.Distribution.GetHolderByKey(ctx, "a", "foo")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.2:5000"}, holders)
+	keys, err = m.Distribution.GetKeysByHolder("a", "10.0.0.1:5000")
+	require.NoError(t, err)
+	require.Equal(t, []string{"bar"}, keys)
+
+	err = m.Distribution.DeleteByHolder(model.Host{HostAddr: "10.0.0.2:5000", Group: "a"})
+	require.NoError(t, err)
+	holders, err = m.Distribution.GetHolderByKey(ctx, "a", "foo")
+	require.NoError(t, err)
+	require.Empty(t, holders)
+	holders, err = m.Distribution.GetHolderByKey(ctx, "b", "foo")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.3:5000"}, holders)
+}
+
+func TestBoltHosts(t *testing.T) {
+	t.Parallel()
+
+	m := newTestBoltManager(t)
+	require.NoError(t, m.Host.RefreshHostAddr("10.0.0.1:5000", "a"))
+	require.NoError(t, m.Host.RefreshHostAddr("10.0.0.2:5000", "b"))
+
+	// Age the first host past the dead timeout.
+	db := m.Host.(*BoltHostManager).db
+	err := db.Update(func(tx *bolt.Tx) error {
+		host := model.Host{HostAddr: "10.0.0.1:5000", Group: "a", LastSeen: time.Now().Add(-DEADTIMEOUT - time.Minute)}
+		return putHost(t, tx, host)
+	})
+	require.NoError(t, err)
+
+	dead, err := m.Host.FindDeadHosts("a")
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	require.Equal(t, "10.0.0.1:5000", dead[0].HostAddr)
+	dead, err = m.Host.FindDeadHosts("b")
+	require.NoError(t, err)
+	require.Empty(t, dead)
+	dead, err = m.Host.FindDeadHostsByMasterResolver("master_default")
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+
+	require.NoError(t, m.Host.DeleteHostByMasterResolver(dead[0], "master_default"))
+	dead, err = m.Host.FindDeadHostsByMasterResolver("master_default")
+	require.NoError(t, err)
+	require.Empty(t, dead)
+	exists, err := m.Host.HostExists("10.0.0.1:5000", "a")
+	require.NoError(t, err)
+	require.False(t, exists)
+	exists, err = m.Host.HostExists("10.0.0.2:5000", "b")
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	// Refreshing a host brings it back to life.
+	require.NoError(t, m.Host.RefreshHostAddr("10.0.0.1:5000", "a"))
+	dead, err = m.Host.FindDeadHosts("a")
+	require.NoError(t, err)
+	require.Empty(t, dead)
+}
+
+func putHost(t *testing.T, tx *bolt.Tx, host model.Host) error {
+	t.Helper()
+
+	b, err := createNestedBucket(tx, hostBucket, host.Group)
+	require.NoError(t, err)
+	v, err := json.Marshal(host)
+	require.NoError(t, err)
+	return b.Put([]byte(host.HostAddr), v)
+}
+
+func TestBoltAdminQueries(t *testing.T) {
+	t.Parallel()
+
+	testAdminQueries(t, newTestBoltManager(t))
+}
+
+// testAdminQueries checks the listings shared by all host and distribution stores.
+func testAdminQueries(t *testing.T, m *Manager) {
+	t.Helper()
+
+	err := m.Distribution.CreateDistributions([]*model.Distribution{
+		{Key: "foo", Holder: "10.0.0.1:5000", Group: "a"},
+		{Key: "foo", Holder: "10.0.0.2:5000", Group: "a"},
+		{Key: "foo", Holder: "10.0.0.3:5000", Group: "a"},
+		{Key: "bar", Holder: "10.0.0.1:5000", Group: "a"},
+		{Key: "bar", Holder: "10.0.0.2:5000", Group: "a"},
+		{Key: "baz", Holder: "10.0.0.1:5000", Group: "a"},
+		{Key: "foo", Holder: "10.0.0.4:5000", Group: "b"},
+	}, "a")
+	require.NoError(t, err)
+	for _, host := range []model.Host{
+		{HostAddr: "10.0.0.1:5000", Group: "a"},
+		{HostAddr: "10.0.0.2:5000", Group: "a"},
+		{HostAddr: "10.0.0.3:5000", Group: "a"},
+		{HostAddr: "10.0.0.4:5000", Group: "b"},
+	} {
+		require.NoError(t, m.Host.RefreshHostAddr(host.HostAddr, host.Group))
+	}
+
+	groups, err := m.Host.ListGroupsByMasterResolver("master_default")
+	require.NoError(t, err)
+	require.Equal(t, []model.GroupSummary{{Group: "a", Hosts: 3}, {Group: "b", Hosts: 1}}, groups)
+
+	hosts, total, err := m.Host.ListHosts("a", 1, 1)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), total)
+	require.Len(t, hosts, 1)
+	require.Equal(t, "10.0.0.2:5000", hosts[0].HostAddr)
+	require.WithinDuration(t, time.Now(), hosts[0].LastSeen, time.Minute)
+	found, err := m.Host.GetHosts("a", []string{"10.0.0.1:5000"})
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now(), found["10.0.0.1:5000"].LastSeen, time.Minute)
+
+	keys, total, err := m.Distribution.ListKeysByHolder("a", "10.0.0.1:5000", 0, 2)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), total)
+	require.Equal(t, []string{"bar", "baz"}, keys)
+	keys, _, err = m.Distribution.ListKeysByHolder("a", "10.0.0.1:5000", 2, 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo"}, keys)
+	keys, total, err = m.Distribution.ListKeysByHolder("a", "10.0.0.1:5000", 5, 2)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), total)
+	require.Empty(t, keys)
+
+	distributions, total, err := m.Distribution.ListHoldersByKey("a", "foo", 1, 10)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), total)
+	require.Len(t, distributions, 2)
+	require.Equal(t, "10.0.0.2:5000", distributions[0].Holder)
+	require.Equal(t, "10.0.0.3:5000", distributions[1].Holder)
+
+	top, total, err := m.Distribution.TopKeys("a", 0, 2)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), total)
+	require.Equal(t, []model.KeyReplicas{{Key: "foo", Holders: 3}, {Key: "bar", Holders: 2}}, top)
+	top, total, err = m.Distribution.TopKeys("c", 0, 2)
+	require.NoError(t, err)
+	require.Zero(t, total)
+	require.Empty(t, top)
+}
+
+func TestBoltPrepulls(t *testing.T) {
+	t.Parallel()
+
+	testPrepullStore(t, newTestBoltManager(t).Prepull)
+}
+
+// testPrepullStore checks the behavior shared by all prepull stores.
+func testPrepullStore(t *testing.T, store PrepullStore) {
+	t.Helper()
+
+	since := time.Now().Add(-time.Minute)
+	first := &model.Prepull{Image: "docker.io/library/nginx:latest", Group: "a"}
+	require.NoError(t, store.CreatePrepull(first))
+	second := &model.Prepull{Image: "docker.io/library/redis:latest", Group: "a"}
+	require.NoError(t, store.CreatePrepull(second))
+	other := &model.Prepull{Image: "docker.io/library/nginx:latest", Group: "b"}
+	require.NoError(t, store.CreatePrepull(other))
+	require.NotEqual(t, first.ID, second.ID)
+
+	pending, err := store.PendingPrepulls("a", "10.0.0.1:5000", since)
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	require.Equal(t, first.ID, pending[0].ID)
+	require.Equal(t, "docker.io/library/nginx:latest", pending[0].Image)
+	pending, err = store.PendingPrepulls("a", "10.0.0.1:5000", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.Empty(t, pending)
+
+	require.NoError(t, store.UpdatePrepullStatus(&model.PrepullHostStatus{PrepullID: first.ID, Host: "10.0.0.1:5000", Group: "a", Status: model.PrepullStatusPulling}))
+	pending, err = store.PendingPrepulls("a", "10.0.0.1:5000", since)
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	require.NoError(t, store.UpdatePrepullStatus(&model.PrepullHostStatus{PrepullID: first.ID, Host: "10.0.0.1:5000", Group: "a", Status: model.PrepullStatusDone}))
+	require.NoError(t, store.UpdatePrepullStatus(&model.PrepullHostStatus{PrepullID: first.ID, Host: "10.0.0.2:5000", Group: "a", Status: model.PrepullStatusFailed, Message: "not found"}))
+	pending, err = store.PendingPrepulls("a", "10.0.0.1:5000", since)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	require.Equal(t, second.ID, pending[0].ID)
+
+	prepull, hosts, err := store.GetPrepull("a", first.ID)
+	require.NoError(t, err)
+	require.Equal(t, "docker.io/library/nginx:latest", prepull.Image)
+	require.Len(t, hosts, 2)
+	statuses := map[string]string{}
+	for _, h := range hosts {
+		statuses[h.Host] = h.Status
+	}
+	require.Equal(t, map[string]string{"10.0.0.1:5000": model.PrepullStatusDone, "10.0.0.2:5000": model.PrepullStatusFailed}, statuses)
+
+	_, _, err = store.GetPrepull("b", first.ID)
+	require.ErrorIs(t, err, ErrNotFound)
+	_, _, err = store.GetPrepull("a", 1000)
+	require.ErrorIs(t, err, ErrNotFound)
+}
@@ -0,0 +1,387 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"github.com/laixintao/piccolo/pkg/distributionapi/metrics"
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
+)
+
+type cacheKey struct {
+	group string
+	key   string
+}
+
+type cacheHolder struct {
+	group  string
+	holder string
+}
+
+// pendingReads tracks the reads of keys in flight, a read is only cached if
+// its key was not invalidated while it was read. Must be used with the lock
+// of the cache held.
+type pendingReads[K comparable] map[K]*pendingRead
+
+type pendingRead struct {
+	readers int
+	// Incremented on every invalidation of the key.
+	version uint64
+}
+
+// start returns the version to pass to finish.
+func (p pendingReads[K]) start(k K) uint64 {
+	r, ok := p[k]
+	if !ok {
+		r = &pendingRead{}
+		p[k] = r
+	}
+	r.readers++
+	return r.version
+}
+
+// finish returns true if the key was not invalidated since start.
+func (p pendingReads[K]) finish(k K, version uint64) bool {
+	r := p[k]
+	r.readers--
+	if r.readers == 0 {
+		delete(p, k)
+	}
+	return r.version == version
+}
+
+func (p pendingReads[K]) invalidate(k K) {
+	if r, ok := p[k]; ok {
+		r.version++
+	}
+}
+
+func (p pendingReads[K]) invalidateAll() {
+	for _, r := range p {
+		r.version++
+	}
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	holders []string
+	expires time.Time
+}
+
+// CachedDistributionStore keeps the holders of the most recently requested
+// keys in memory. Writes through the store invalidate the affected keys,
+// entries expire after ttl to bound how long writes through other piccolo
+// instances are not visible.
+type CachedDistributionStore struct {
+	DistributionStore
+
+	mx       sync.Mutex
+	size     int
+	ttl      time.Duration
+	lru      *list.List
+	entries  map[cacheKey]*list.Element
+	byHolder map[cacheHolder]map[cacheKey]struct{}
+	reads    pendingReads[cacheKey]
+	flight   singleflight.Group
+	now      func() time.Time
+}
+
+func NewCachedDistributionStore(store DistributionStore, size int, ttl time.Duration) *CachedDistributionStore {
+	return &CachedDistributionStore{
+		DistributionStore: store,
+		size:              size,
+		ttl:               ttl,
+		lru:               list.New(),
+		entries:           map[cacheKey]*list.Element{},
+		byHolder:          map[cacheHolder]map[cacheKey]struct{}{},
+		reads:             pendingReads[cacheKey]{},
+		now:               time.Now,
+	}
+}
+
+func (c *CachedDistributionStore) GetHolderByKey(ctx context.Context, group string, key string) ([]string, error) {
+	k := cacheKey{group: group, key: key}
+	if holders, ok := c.get(k); ok {
+		metrics.FindKeyCacheTotal.WithLabelValues("hit").Inc()
+		return holders, nil
+	}
+	metrics.FindKeyCacheTotal.WithLabelValues("miss").Inc()
+
+	// Concurrent requests for the same key share one query.
+	v, err, _ := c.flight.Do(group+"\x00"+key, func() (any, error) {
+		c.mx.Lock()
+		version := c.reads.start(k)
+		c.mx.Unlock()
+		holders, err := c.DistributionStore.GetHolderByKey(ctx, group, key)
+		c.add(k, holders, version, err == nil)
+		if err != nil {
+			return nil, err
+		}
+		return holders, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return slices.Clone(v.([]string)), nil
+}
+
+func (c *CachedDistributionStore) CreateDistributions(distributions []*model.Distribution, group string) error {
+	defer func() {
+		c.mx.Lock()
+		defer c.mx.Unlock()
+		for _, d := range distributions {
+			c.invalidateLocked(cacheKey{group: d.Group, key: d.Key})
+		}
+	}()
+	return c.DistributionStore.CreateDistributions(distributions, group)
+}
+
+func (c *CachedDistributionStore) DeleteKeysByHolder(keys []string, holder, group string) error {
+	defer func() {
+		c.mx.Lock()
+		defer c.mx.Unlock()
+		for _, key := range keys {
+			c.invalidateLocked(cacheKey{group: group, key: key})
+		}
+	}()
+	return c.DistributionStore.DeleteKeysByHolder(keys, holder, group)
+}
+
+func (c *CachedDistributionStore) DeleteByHolder(host model.Host) error {
+	defer c.invalidateHolder(host)
+	return c.DistributionStore.DeleteByHolder(host)
+}
+
+func (c *CachedDistributionStore) DeleteByHolderByMasterResolver(host model.Host, masterResolver string) error {
+	defer c.invalidateHolder(host)
+	return c.DistributionStore.DeleteByHolderByMasterResolver(host, masterResolver)
+}
+
+// invalidateHolder removes all cached keys listing the holder. Any key read
+// in flight could list the holder, none of them is cached.
+func (c *CachedDistributionStore) invalidateHolder(host model.Host) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	for k := range c.byHolder[cacheHolder{group: host.Group, holder: host.HostAddr}] {
+		c.removeLocked(k)
+	}
+	c.reads.invalidateAll()
+}
+
+// invalidateLocked must be called with the lock held.
+func (c *CachedDistributionStore) invalidateLocked(k cacheKey) {
+	c.removeLocked(k)
+	c.reads.invalidate(k)
+}
+
+func (c *CachedDistributionStore) get(k cacheKey) ([]string, bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	elem, ok := c.entries[k]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if c.now().After(entry.expires) {
+		c.removeLocked(k)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return slices.Clone(entry.holders), true
+}
+
+func (c *CachedDistributionStore) add(k cacheKey, holders []string, version uint64, ok bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if !c.reads.finish(k, version) || !ok {
+		// The key could have been written while it was read.
+		return
+	}
+	c.removeLocked(k)
+	entry := &cacheEntry{key: k, holders: holders, expires: c.now().Add(c.ttl)}
+	c.entries[k] = c.lru.PushFront(entry)
+	for _, holder := range holders {
+		h := cacheHolder{group: k.group, holder: holder}
+		if c.byHolder[h] == nil {
+			c.byHolder[h] = map[cacheKey]struct{}{}
+		}
+		c.byHolder[h][k] = struct{}{}
+	}
+	for c.lru.Len() > c.size {
+		c.removeLocked(c.lru.Back().Value.(*cacheEntry).key)
+	}
+	metrics.FindKeyCacheEntries.Set(float64(c.lru.Len()))
+}
+
+// removeLocked must be called with the lock held.
+func (c *CachedDistributionStore) removeLocked(k cacheKey) {
+	elem, ok := c.entries[k]
+	if !ok {
+		return
+	}
+	entry := elem.Value.(*cacheEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, k)
+	for _, holder := range entry.holders {
+		h := cacheHolder{group: k.group, holder: holder}
+		delete(c.byHolder[h], k)
+		if len(c.byHolder[h]) == 0 {
+			delete(c.byHolder, h)
+		}
+	}
+	metrics.FindKeyCacheEntries.Set(float64(c.lru.Len()))
+}
+
+type hostCacheEntry struct {
+	key     cacheHolder
+	host    model.Host
+	found   bool
+	expires time.Time
+}
+
+// CachedHostStore keeps the hosts of the most recently looked up holders in
+// memory, so that ranking the holders of a key by their labels and
+// utilization does not query the hosts on every findkey. Writes through the
+// store invalidate the host, entries expire after ttl.
+type CachedHostStore struct {
+	HostStore
+
+	mx      sync.Mutex
+	size    int
+	ttl     time.Duration
+	lru     *list.List
+	entries map[cacheHolder]*list.Element
+	reads   pendingReads[cacheHolder]
+	now     func() time.Time
+}
+
+func NewCachedHostStore(store HostStore, size int, ttl time.Duration) *CachedHostStore {
+	return &CachedHostStore{
+		HostStore: store,
+		size:      size,
+		ttl:       ttl,
+		lru:       list.New(),
+		entries:   map[cacheHolder]*list.Element{},
+		reads:     pendingReads[cacheHolder]{},
+		now:       time.Now,
+	}
+}
+
+func (c *CachedHostStore) GetHosts(group string, hostAddrs []string) (map[string]model.Host, error) {
+	hosts := make(map[string]model.Host, len(hostAddrs))
+	missing := []string{}
+	c.mx.Lock()
+	for _, hostAddr := range hostAddrs {
+		k := cacheHolder{group: group, holder: hostAddr}
+		elem, ok := c.entries[k]
+		if !ok {
+			missing = append(missing, hostAddr)
+			continue
+		}
+		entry := elem.Value.(*hostCacheEntry)
+		if c.now().After(entry.expires) {
+			c.removeLocked(k)
+			missing = append(missing, hostAddr)
+			continue
+		}
+		c.lru.MoveToFront(elem)
+		if entry.found {
+			host := entry.host
+			host.Labels = maps.Clone(host.Labels)
+			hosts[hostAddr] = host
+		}
+	}
+	versions := make([]uint64, len(missing))
+	for i, hostAddr := range missing {
+		versions[i] = c.reads.start(cacheHolder{group: group, holder: hostAddr})
+	}
+	c.mx.Unlock()
+	metrics.HostCacheTotal.WithLabelValues("hit").Add(float64(len(hostAddrs) - len(missing)))
+	if len(missing) == 0 {
+		return hosts, nil
+	}
+	metrics.HostCacheTotal.WithLabelValues("miss").Add(float64(len(missing)))
+
+	found, err := c.HostStore.GetHosts(group, missing)
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	for i, hostAddr := range missing {
+		k := cacheHolder{group: group, holder: hostAddr}
+		// The host could have been written while it was read.
+		unchanged := c.reads.finish(k, versions[i])
+		if err != nil {
+			continue
+		}
+		host, ok := found[hostAddr]
+		if ok {
+			hosts[hostAddr] = host
+			host.Labels = maps.Clone(host.Labels)
+		}
+		if unchanged {
+			c.addLocked(k, host, ok)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+func (c *CachedHostStore) RefreshHostAddr(hostAddr, group string) error {
+	defer c.invalidate(group, hostAddr)
+	return c.HostStore.RefreshHostAddr(hostAddr, group)
+}
+
+func (c *CachedHostStore) DeleteHost(host model.Host) error {
+	defer c.invalidate(host.Group, host.HostAddr)
+	return c.HostStore.DeleteHost(host)
+}
+
+func (c *CachedHostStore) DeleteHostByMasterResolver(host model.Host, masterResolver string) error {
+	defer c.invalidate(host.Group, host.HostAddr)
+	return c.HostStore.DeleteHostByMasterResolver(host, masterResolver)
+}
+
+func (c *CachedHostStore) SetHostLabels(hostAddr, group string, labels model.Labels) error {
+	defer c.invalidate(group, hostAddr)
+	return c.HostStore.SetHostLabels(hostAddr, group, labels)
+}
+
+func (c *CachedHostStore) SetHostUtilization(hostAddr, group string, utilization float64) error {
+	defer c.invalidate(group, hostAddr)
+	return c.HostStore.SetHostUtilization(hostAddr, group, utilization)
+}
+
+func (c *CachedHostStore) invalidate(group, hostAddr string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	k := cacheHolder{group: group, holder: hostAddr}
+	c.removeLocked(k)
+	c.reads.invalidate(k)
+}
+
+// addLocked must be called with the lock held.
+func (c *CachedHostStore) addLocked(k cacheHolder, host model.Host, found bool) {
+	c.removeLocked(k)
+	entry := &hostCacheEntry{key: k, host: host, found: found, expires: c.now().Add(c.ttl)}
+	c.entries[k] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		c.removeLocked(c.lru.Back().Value.(*hostCacheEntry).key)
+	}
+}
+
+// removeLocked must be called with the lock held.
+func (c *CachedHostStore) removeLocked(k cacheHolder) {
+	elem, ok := c.entries[k]
+	if !ok {
+		return
+	}
+	c.lru.Remove(elem)
+	delete(c.entries, k)
+}
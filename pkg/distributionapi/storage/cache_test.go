@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
+)
+
+type countingStore struct {
+	DistributionStore
+	reads int
+}
+
+func (s *countingStore) GetHolderByKey(ctx context.Context, group string, key string) ([]string, error) {
+	s.reads++
+	return s.DistributionStore.GetHolderByKey(ctx, group, key)
+}
+
+func TestCachedDistributionStore(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	store := &countingStore{DistributionStore: newTestBoltManager(t).Distribution}
+	c := NewCachedDistributionStore(store, 2, time.Minute)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	err := c.CreateDistributions([]*model.Distribution{
+		{Key: "foo", Holder: "10.0.0.1:5000", Group: "a"},
+		{Key: "bar", Holder: "10.0.0.2:5000", Group: "a"},
+		{Key: "baz", Holder: "10.0.0.2:5000", Group: "a"},
+	}, "a")
+	require.NoError(t, err)
+
+	for range 3 {
+		holders, err := c.GetHolderByKey(ctx, "a", "foo")
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.0.0.1:5000"}, holders)
+	}
+	require.Equal(t, 1, store.reads)
+
+	// Advertising a key invalidates it.
+	err = c.CreateDistributions([]*model.Distribution{{Key: "foo", Holder: "10.0.0.2:5000", Group: "a"}}, "a")
+	require.NoError(t, err)
+	holders, err := c.GetHolderByKey(ctx, "a", "foo")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"10.0.0.1:5000", "10.0.0.2:5000"}, holders)
+	require.Equal(t, 2, store.reads)
+
+	// Deleting keys of a holder invalidates them.
+	err = c.DeleteKeysByHolder([]string{"foo"}, "10.0.0.1:5000", "a")
+	require.NoError(t, err)
+	holders, err = c.GetHolderByKey(ctx, "a", "foo")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.2:5000"}, holders)
+	require.Equal(t, 3, store.reads)
+
+	// Evicting a holder invalidates all keys listing it.
+	_, err = c.GetHolderByKey(ctx, "a", "bar")
+	require.NoError(t, err)
+	require.Equal(t, 4, store.reads)
+	err = c.DeleteByHolderByMasterResolver(model.Host{HostAddr: "10.0.0.2:5000", Group: "a"}, "master_default")
+	require.NoError(t, err)
+	require.Empty(t, c.entries)
+	holders, err = c.GetHolderByKey(ctx, "a", "foo")
+	require.NoError(t, err)
+	require.Empty(t, holders)
+	require.Equal(t, 5, store.reads)
+
+	// Entries expire after the ttl.
+	now = now.Add(2 * time.Minute)
+	_, err = c.GetHolderByKey(ctx, "a", "foo")
+	require.NoError(t, err)
+	require.Equal(t, 6, store.reads)
+
+	// The least recently used key is dropped.
+	for _, key := range []string{"bar", "baz", "foo"} {
+		_, err = c.GetHolderByKey(ctx, "a", key)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 9, store.reads)
+	require.Len(t, c.entries, 2)
+	require.NotContains(t, c.entries, cacheKey{group: "a", key: "bar"})
+}
+
+type countingHostStore struct {
+	HostStore
+	reads int
+}
+
+func (s *countingHostStore) GetHosts(group string, hostAddrs []string) (map[string]model.Host, error) {
+	s.reads += len(hostAddrs)
+	return s.HostStore.GetHosts(group, hostAddrs)
+}
+
+func TestCachedHostStore(t *testing.T) {
+	t.Parallel()
+
+	store := &countingHostStore{HostStore: newTestBoltManager(t).Host}
+	c := NewCachedHostStore(store, 2, time.Minute)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	require.NoError(t, c.RefreshHostAddr("10.0.0.1:5000", "a"))
+	require.NoError(t, c.SetHostUtilization("10.0.0.1:5000", "a", 0.5))
+
+	// Unknown hosts are cached too.
+	for range 3 {
+		hosts, err := c.GetHosts("a", []string{"10.0.0.1:5000", "10.0.0.2:5000"})
+		require.NoError(t, err)
+		require.Len(t, hosts, 1)
+		require.Equal(t, 0.5, hosts["10.0.0.1:5000"].Utilization)
+	}
+	require.Equal(t, 2, store.reads)
+
+	// Writing a host invalidates it.
+	require.NoError(t, c.SetHostLabels("10.0.0.1:5000", "a", model.Labels{"zone": "a"}))
+	hosts, err := c.GetHosts("a", []string{"10.0.0.1:5000", "10.0.0.2:5000"})
+	require.NoError(t, err)
+	require.Equal(t, model.Labels{"zone": "a"}, hosts["10.0.0.1:5000"].Labels)
+	require.Equal(t, 3, store.reads)
+
+	// Entries expire after the ttl.
+	now = now.Add(2 * time.Minute)
+	_, err = c.GetHosts("a", []string{"10.0.0.1:5000"})
+	require.NoError(t, err)
+	require.Equal(t, 4, store.reads)
+
+	// The least recently used host is dropped.
+	_, err = c.GetHosts("a", []string{"10.0.0.3:5000"})
+	require.NoError(t, err)
+	require.Len(t, c.entries, 2)
+	require.NotContains(t, c.entries, cacheHolder{group: "a", holder: "10.0.0.2:5000"})
+}
+
+type blockingStore struct {
+	DistributionStore
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) GetHolderByKey(ctx context.Context, group string, key string) ([]string, error) {
+	s.reading <- struct{}{}
+	<-s.release
+	return s.DistributionStore.GetHolderByKey(ctx, group, key)
+}
+
+func TestCachedDistributionStoreConcurrentWrites(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	store := &blockingStore{
+		DistributionStore: newTestBoltManager(t).Distribution,
+		reading:           make(chan struct{}),
+		release:           make(chan struct{}),
+	}
+	c := NewCachedDistributionStore(store, 10, time.Minute)
+	hot := cacheKey{group: "a", key: "hot"}
+
+	read := func(write func()) {
+		errs := make(chan error)
+		go func() {
+			_, err := c.GetHolderByKey(ctx, "a", "hot")
+			errs <- err
+		}()
+		<-store.reading
+		write()
+		close(store.release)
+		require.NoError(t, <-errs)
+		store.release = make(chan struct{})
+	}
+
+	// Writes to other keys during the read do not keep the hot key from
+	// being cached.
+	read(func() {
+		err := c.CreateDistributions([]*model.Distribution{{Key: "cold", Holder: "10.0.0.1:5000", Group: "a"}}, "a")
+		require.NoError(t, err)
+		require.NoError(t, c.DeleteKeysByHolder([]string{"other"}, "10.0.0.1:5000", "a"))
+	})
+	require.Contains(t, c.entries, hot)
+
+	// A write to the hot key during the read is not lost.
+	c.mx.Lock()
+	c.removeLocked(hot)
+	c.mx.Unlock()
+	read(func() {
+		err := c.CreateDistributions([]*model.Distribution{{Key: "hot", Holder: "10.0.0.1:5000", Group: "a"}}, "a")
+		require.NoError(t, err)
+	})
+	require.NotContains(t, c.entries, hot)
+	require.Empty(t, c.reads)
+}
+
+type blockingHostStore struct {
+	HostStore
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingHostStore) GetHosts(group string, hostAddrs []string) (map[string]model.Host, error) {
+	s.reading <- struct{}{}
+	<-s.release
+	return s.HostStore.GetHosts(group, hostAddrs)
+}
+
+func TestCachedHostStoreConcurrentWrites(t *testing.T) {
+	t.Parallel()
+
+	store := &blockingHostStore{
+		HostStore: newTestBoltManager(t).Host,
+		reading:   make(chan struct{}),
+		release:   make(chan struct{}),
+	}
+	c := NewCachedHostStore(store, 10, time.Minute)
+
+	errs := make(chan error)
+	go func() {
+		_, err := c.GetHosts("a", []string{"10.0.0.1:5000", "10.0.0.2:5000"})
+		errs <- err
+	}()
+	<-store.reading
+	// A write to 10.0.0.2 during the read only keeps 10.0.0.2 from being
+	// cached, other hosts refreshing does not affect any of them.
+	require.NoError(t, c.RefreshHostAddr("10.0.0.2:5000", "a"))
+	require.NoError(t, c.RefreshHostAddr("10.0.0.3:5000", "a"))
+	close(store.release)
+	require.NoError(t, <-errs)
+
+	require.Contains(t, c.entries, cacheHolder{group: "a", holder: "10.0.0.1:5000"})
+	require.NotContains(t, c.entries, cacheHolder{group: "a", holder: "10.0.0.2:5000"})
+	require.Empty(t, c.reads)
+}
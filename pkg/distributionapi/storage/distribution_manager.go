@@ -159,3 +159,66 @@ func (m *DistributionManager) DeleteByHolderByMasterResolver(host model.Host, ma
 	}
 	return nil
 }
+
+func (m *DistributionManager) ListKeysByHolder(group, holder string, offset, limit int) (_ []string, _ int64, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("distribution_tab", "list_keys_by_holder", group, start, retErr) }()
+
+	query := m.db.
+		Clauses(dbresolver.Use(group)).
+		Model(&model.Distribution{}).
+		Where("`holder` = ? AND `group` = ?", holder, group)
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to count keys of holder %s (group=%s): %w", holder, group, err)
+	}
+	keys := []string{}
+	if err := query.Order("`key`").Offset(offset).Limit(limit).Pluck("`key`", &keys).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to list keys of holder %s (group=%s): %w", holder, group, err)
+	}
+	return keys, total, nil
+}
+
+func (m *DistributionManager) ListHoldersByKey(group, key string, offset, limit int) (_ []model.Distribution, _ int64, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("distribution_tab", "list_holders_by_key", group, start, retErr) }()
+
+	query := m.db.
+		Clauses(dbresolver.Use(group)).
+		Model(&model.Distribution{}).
+		Where("`group` = ? AND `key` = ?", group, key)
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to count holders of key %s (group=%s): %w", key, group, err)
+	}
+	distributions := []model.Distribution{}
+	if err := query.Order("holder").Offset(offset).Limit(limit).Find(&distributions).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to list holders of key %s (group=%s): %w", key, group, err)
+	}
+	return distributions, total, nil
+}
+
+func (m *DistributionManager) TopKeys(group string, offset, limit int) (_ []model.KeyReplicas, _ int64, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("distribution_tab", "top_keys", group, start, retErr) }()
+
+	query := m.db.
+		Clauses(dbresolver.Use(group)).
+		Model(&model.Distribution{}).
+		Where("`group` = ?", group)
+	var total int64
+	if err := query.Session(&gorm.Session{}).Distinct("`key`").Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to count keys (group=%s): %w", group, err)
+	}
+	keys := []model.KeyReplicas{}
+	if err := query.
+		Select("`key`, COUNT(*) AS holders").
+		Group("`key`").
+		Order("holders DESC, `key`").
+		Offset(offset).
+		Limit(limit).
+		Scan(&keys).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to find top keys (group=%s): %w", group, err)
+	}
+	return keys, total, nil
+}
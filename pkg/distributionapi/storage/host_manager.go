@@ -146,3 +146,163 @@ func (m *HostManager) DeleteHostByMasterResolver(host model.Host, masterResolver
 	}
 	return nil
 }
+
+func (m *HostManager) HostExists(hostAddr, group string) (bool, error) {
+	start := time.Now()
+	var retErr error
+	defer func() {
+		status := "success"
+		if retErr != nil {
+			status = "fail"
+		}
+		metrics.DBQueryTotal.WithLabelValues("host_tab", "host_exists", group, status).Inc()
+		metrics.DBQueryDuration.WithLabelValues("host_tab", "host_exists", group, status).Observe(time.Since(start).Seconds())
+	}()
+
+	var count int64
+	if err := m.db.
+		Clauses(dbresolver.Use(group), dbresolver.Write).
+		Model(&model.Host{}).
+		Where("`host_addr` = ? AND `group` = ?", hostAddr, group).
+		Count(&count).Error; err != nil {
+		retErr = fmt.Errorf("failed to find host %s (group=%s): %w", hostAddr, group, err)
+		return false, retErr
+	}
+	return count > 0, nil
+}
+
+func (m *HostManager) GetSyncGeneration(hostAddr, group string) (_ uint64, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "get_sync_generation", group, start, retErr) }()
+
+	var hosts []model.Host
+	if err := m.db.
+		Clauses(dbresolver.Use(group), dbresolver.Write).
+		Where("`host_addr` = ? AND `group` = ?", hostAddr, group).
+		Limit(1).
+		Find(&hosts).Error; err != nil {
+		return 0, fmt.Errorf("failed to get sync generation of host %s (group=%s): %w", hostAddr, group, err)
+	}
+	if len(hosts) == 0 {
+		return 0, nil
+	}
+	return hosts[0].SyncGeneration, nil
+}
+
+func (m *HostManager) SetSyncGeneration(hostAddr, group string, generation uint64) (retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "set_sync_generation", group, start, retErr) }()
+
+	host := &model.Host{
+		HostAddr:       hostAddr,
+		Group:          group,
+		LastSeen:       time.Now(),
+		SyncGeneration: generation,
+	}
+	return m.db.Clauses(
+		dbresolver.Use(group),
+		dbresolver.Write,
+		clause.OnConflict{
+			Columns:   []clause.Column{{Name: "host_addr"}, {Name: "group"}},
+			DoUpdates: clause.AssignmentColumns([]string{"sync_generation"}),
+		},
+	).Create(host).Error
+}
+
+func (m *HostManager) SetHostLabels(hostAddr, group string, labels model.Labels) (retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "set_host_labels", group, start, retErr) }()
+
+	host := &model.Host{
+		HostAddr: hostAddr,
+		Group:    group,
+		LastSeen: time.Now(),
+		Labels:   labels,
+	}
+	return m.db.Clauses(
+		dbresolver.Use(group),
+		dbresolver.Write,
+		clause.OnConflict{
+			Columns:   []clause.Column{{Name: "host_addr"}, {Name: "group"}},
+			DoUpdates: clause.AssignmentColumns([]string{"labels"}),
+		},
+	).Create(host).Error
+}
+
+func (m *HostManager) SetHostUtilization(hostAddr, group string, utilization float64) (retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "set_host_utilization", group, start, retErr) }()
+
+	host := &model.Host{
+		HostAddr:    hostAddr,
+		Group:       group,
+		LastSeen:    time.Now(),
+		Utilization: utilization,
+	}
+	return m.db.Clauses(
+		dbresolver.Use(group),
+		dbresolver.Write,
+		clause.OnConflict{
+			Columns:   []clause.Column{{Name: "host_addr"}, {Name: "group"}},
+			DoUpdates: clause.AssignmentColumns([]string{"utilization"}),
+		},
+	).Create(host).Error
+}
+
+func (m *HostManager) GetHosts(group string, hostAddrs []string) (_ map[string]model.Host, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "get_hosts", group, start, retErr) }()
+
+	hosts := map[string]model.Host{}
+	if len(hostAddrs) == 0 {
+		return hosts, nil
+	}
+	var found []model.Host
+	if err := m.db.
+		Clauses(dbresolver.Use(group)).
+		Select("host_addr", "group", "last_seen", "labels", "utilization").
+		Where("`group` = ? AND `host_addr` IN ?", group, hostAddrs).
+		Find(&found).Error; err != nil {
+		return nil, fmt.Errorf("failed to get hosts (group=%s): %w", group, err)
+	}
+	for _, host := range found {
+		hosts[host.HostAddr] = host
+	}
+	return hosts, nil
+}
+
+func (m *HostManager) ListHosts(group string, offset, limit int) (_ []model.Host, _ int64, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "list_hosts", group, start, retErr) }()
+
+	query := m.db.
+		Clauses(dbresolver.Use(group)).
+		Model(&model.Host{}).
+		Where("`group` = ?", group)
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to count hosts (group=%s): %w", group, err)
+	}
+	hosts := []model.Host{}
+	if err := query.Order("host_addr").Offset(offset).Limit(limit).Find(&hosts).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to list hosts (group=%s): %w", group, err)
+	}
+	return hosts, total, nil
+}
+
+func (m *HostManager) ListGroupsByMasterResolver(masterResolver string) (_ []model.GroupSummary, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "list_groups_by_master", masterResolver, start, retErr) }()
+
+	groups := []model.GroupSummary{}
+	if err := m.db.
+		Clauses(dbresolver.Use(masterResolver), dbresolver.Write).
+		Model(&model.Host{}).
+		Select("`group`, COUNT(*) AS hosts").
+		Group("`group`").
+		Order("`group`").
+		Scan(&groups).Error; err != nil {
+		return nil, fmt.Errorf("failed to list groups from master resolver %s: %w", masterResolver, err)
+	}
+	return groups, nil
+}
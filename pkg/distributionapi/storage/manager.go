@@ -2,35 +2,108 @@ package storage
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/redis/go-redis/v9"
+	bolt "go.etcd.io/bbolt"
 	"gorm.io/gorm"
 )
 
 const (
 	MaxBatch          = 100
 	FindKeyMaxResults = 2000
-	DEADTIMEOUT = 31 * time.Minute
+	DEADTIMEOUT       = 31 * time.Minute
 )
 
 type Manager struct {
-	db              *gorm.DB
-	Distribution    *DistributionManager
-	Host            *HostManager
+	Distribution    DistributionStore
+	Host            HostStore
+	Prepull         PrepullStore
 	groups          []string
 	masterResolvers []string
+	close           func() error
 }
 
 func NewManager(db *gorm.DB, groups []string, masterResolvers []string) *Manager {
 	return &Manager{
 		Distribution:    NewDistributionManager(db),
 		Host:            NewHostManager(db),
-		db:              db,
+		Prepull:         NewPrepullManager(db),
 		groups:          groups,
 		masterResolvers: masterResolvers,
+		close: func() error {
+			sqlDB, err := db.DB()
+			if err != nil {
+				return fmt.Errorf("failed to get database instance: %w", err)
+			}
+			return sqlDB.Close()
+		},
 	}
 }
 
+// NewBoltManager returns a manager storing everything in a single bbolt
+// database, all groups share the database.
+func NewBoltManager(db *bolt.DB) *Manager {
+	return &Manager{
+		Distribution:    NewBoltDistributionManager(db),
+		Host:            NewBoltHostManager(db),
+		Prepull:         NewBoltPrepullManager(db),
+		groups:          []string{"default"},
+		masterResolvers: []string{"master_default"},
+		close:           db.Close,
+	}
+}
+
+// NewRedisManager returns a manager storing everything in a single redis
+// database, all groups share the database.
+func NewRedisManager(client *redis.Client) *Manager {
+	return &Manager{
+		Distribution:    NewRedisDistributionManager(client),
+		Host:            NewRedisHostManager(client),
+		Prepull:         NewRedisPrepullManager(client),
+		groups:          []string{"default"},
+		masterResolvers: []string{"master_default"},
+		close:           client.Close,
+	}
+}
+
+// Open returns the manager for the DSN list, the backend is selected by the
+// dbtype of the entries: 'bolt' for an embedded database, 'redis' for a
+// redis server and 'master' and 'slave' for MySQL.
+func Open(dsnList []string) (*Manager, error) {
+	for _, d := range dsnList {
+		parts := strings.SplitN(d, ":", 3)
+		if len(parts) != 3 || (parts[1] != "bolt" && parts[1] != "redis") {
+			continue
+		}
+		if len(dsnList) != 1 {
+			return nil, fmt.Errorf("%s database %s can not be combined with other DSNs", parts[1], parts[2])
+		}
+		if parts[0] != "default" {
+			return nil, fmt.Errorf("%s database must be configured for the default group, got %s", parts[1], parts[0])
+		}
+		if parts[1] == "redis" {
+			client, err := InitRedis(parts[2])
+			if err != nil {
+				return nil, err
+			}
+			return NewRedisManager(client), nil
+		}
+		db, err := InitBolt(parts[2])
+		if err != nil {
+			return nil, err
+		}
+		return NewBoltManager(db), nil
+	}
+
+	db, groups, masterResolvers, err := InitMySQL(dsnList)
+	if err != nil {
+		return nil, err
+	}
+	return NewManager(db, groups, masterResolvers), nil
+}
+
 func (m *Manager) GetGroups() []string {
 	return m.groups
 }
@@ -40,14 +113,8 @@ func (m *Manager) GetMasterResolvers() []string {
 }
 
 func (m *Manager) Close() error {
-	sqlDB, err := m.db.DB()
-	if err != nil {
-		return fmt.Errorf("failed to get database instance: %w", err)
-	}
-
-	if err := sqlDB.Close(); err != nil {
+	if err := m.close(); err != nil {
 		return fmt.Errorf("failed to close database: %w", err)
 	}
-
 	return nil
 }
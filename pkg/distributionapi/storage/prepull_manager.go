@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/plugin/dbresolver"
+)
+
+type PrepullManager struct {
+	db *gorm.DB
+}
+
+func NewPrepullManager(db *gorm.DB) *PrepullManager {
+	return &PrepullManager{db: db}
+}
+
+func (m *PrepullManager) CreatePrepull(prepull *model.Prepull) (retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("prepull_tab", "create_prepull", prepull.Group, start, retErr) }()
+
+	return m.db.Clauses(dbresolver.Use(prepull.Group), dbresolver.Write).Create(prepull).Error
+}
+
+func (m *PrepullManager) GetPrepull(group string, id uint) (_ *model.Prepull, _ []model.PrepullHostStatus, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("prepull_tab", "get_prepull", group, start, retErr) }()
+
+	prepull := &model.Prepull{}
+	err := m.db.
+		Clauses(dbresolver.Use(group)).
+		Where("`id` = ? AND `group` = ?", id, group).
+		First(prepull).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get prepull %d: %w", id, err)
+	}
+	var hosts []model.PrepullHostStatus
+	if err := m.db.
+		Clauses(dbresolver.Use(group)).
+		Where("`prepull_id` = ?", id).
+		Order("`host`").
+		Find(&hosts).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to get hosts of prepull %d: %w", id, err)
+	}
+	return prepull, hosts, nil
+}
+
+func (m *PrepullManager) PendingPrepulls(group, host string, since time.Time) (_ []model.Prepull, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("prepull_tab", "pending_prepulls", group, start, retErr) }()
+
+	var prepulls []model.Prepull
+	if err := m.db.
+		Clauses(dbresolver.Use(group)).
+		Where("`group` = ? AND `created_at` > ?", group, since).
+		Where("NOT EXISTS (SELECT 1 FROM `prepull_host_tab` s WHERE s.`prepull_id` = `prepull_tab`.`id` AND s.`host` = ? AND s.`status` IN ?)",
+			host, []string{model.PrepullStatusDone, model.PrepullStatusFailed}).
+		Order("`id`").
+		Find(&prepulls).Error; err != nil {
+		return nil, fmt.Errorf("failed to find pending prepulls: %w", err)
+	}
+	return prepulls, nil
+}
+
+func (m *PrepullManager) UpdatePrepullStatus(status *model.PrepullHostStatus) (retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("prepull_host_tab", "update_prepull_status", status.Group, start, retErr) }()
+
+	return m.db.Clauses(
+		dbresolver.Use(status.Group),
+		dbresolver.Write,
+		clause.OnConflict{
+			Columns:   []clause.Column{{Name: "prepull_id"}, {Name: "host"}},
+			DoUpdates: clause.AssignmentColumns([]string{"status", "message", "updated_at"}),
+		},
+	).Create(status).Error
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The redis database stores the distributions of all groups:
+//
+//	piccolo:<group>:key:<key>       SET of holders
+//	piccolo:<group>:holder:<holder> SET of keys, expires DEADTIMEOUT after the last keepalive
+//	piccolo:<group>:hosts           ZSET of host addrs scored by the last keepalive
+//	piccolo:<group>:generation:<holder> sync generation of the holder, expires with the holder SET
+//	piccolo:groups                  SET of groups
+//	piccolo:prepull:seq             counter of the prepull ids
+//	piccolo:<group>:prepulls        ZSET of prepull ids scored by the creation time
+//	piccolo:<group>:prepull:<id>    JSON encoded model.Prepull, expires after redisPrepullTTL
+//	piccolo:<group>:prepull:<id>:hosts HASH of host to JSON encoded model.PrepullHostStatus
+//
+// A holder whose key set expired is dead, it is filtered from the holders of a
+// key and removed from the key lazily, so the evictor is not needed to stop
+// handing out dead holders.
+const redisPrefix = "piccolo:"
+
+func redisKeyKey(group, key string) string {
+	return redisPrefix + group + ":key:" + key
+}
+
+func redisHolderKey(group, holder string) string {
+	return redisPrefix + group + ":holder:" + holder
+}
+
+// redisHolderIndexKey is a set of the keys of the holder like redisHolderKey,
+// it does not expire so that the evictor finds the keys of dead holders.
+func redisHolderIndexKey(group, holder string) string {
+	return redisPrefix + group + ":holderindex:" + holder
+}
+
+func redisGenerationKey(group, holder string) string {
+	return redisPrefix + group + ":generation:" + holder
+}
+
+// redisLabelsKey is a hash of the labels of every host of the group.
+func redisLabelsKey(group string) string {
+	return redisPrefix + group + ":labels"
+}
+
+// redisUtilizationKey is a hash of the utilization of every host of the group.
+func redisUtilizationKey(group string) string {
+	return redisPrefix + group + ":utilization"
+}
+
+func redisHostsKey(group string) string {
+	return redisPrefix + group + ":hosts"
+}
+
+func redisPrepullsKey(group string) string {
+	return redisPrefix + group + ":prepulls"
+}
+
+func redisPrepullKey(group string, id uint) string {
+	return redisPrefix + group + ":prepull:" + strconv.FormatUint(uint64(id), 10)
+}
+
+func redisPrepullHostsKey(group string, id uint) string {
+	return redisPrepullKey(group, id) + ":hosts"
+}
+
+// redisGlobEscape escapes the glob characters of s for SCAN MATCH.
+func redisGlobEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+var (
+	redisGroupsKey     = redisPrefix + "groups"
+	redisPrepullSeqKey = redisPrefix + "prepull:seq"
+)
+
+// InitRedis connects to the redis server at url, e.g. redis://:password@host:6379/0.
+func InitRedis(url string) (*redis.Client, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to ping redis: %w", err)
+	}
+	return client, nil
+}
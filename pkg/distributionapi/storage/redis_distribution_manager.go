@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
+	"github.com/redis/go-redis/v9"
+)
+
+type RedisDistributionManager struct {
+	client *redis.Client
+}
+
+func NewRedisDistributionManager(client *redis.Client) *RedisDistributionManager {
+	return &RedisDistributionManager{client: client}
+}
+
+func (m *RedisDistributionManager) CreateDistributions(distributions []*model.Distribution, group string) (retErr error) {
+	if len(distributions) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	defer func() { observeQuery("distribution_tab", "insert", group, start, retErr) }()
+
+	ctx := context.Background()
+	for i := 0; i < len(distributions); i += MaxBatch {
+		pipe := m.client.Pipeline()
+		holders := map[string]struct{}{}
+		for _, d := range distributions[i:min(i+MaxBatch, len(distributions))] {
+			pipe.SAdd(ctx, redisKeyKey(d.Group, d.Key), d.Holder)
+			pipe.SAdd(ctx, redisHolderKey(d.Group, d.Holder), d.Key)
+			pipe.SAdd(ctx, redisHolderIndexKey(d.Group, d.Holder), d.Key)
+			holders[redisHolderKey(d.Group, d.Holder)] = struct{}{}
+		}
+		// Holders which advertise before their first keepalive are alive too.
+		for holderKey := range holders {
+			pipe.Expire(ctx, holderKey, DEADTIMEOUT)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *RedisDistributionManager) GetHolderByKey(ctx context.Context, group string, key string) (holders []string, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("distribution_tab", "get_holder_by_key", group, start, retErr) }()
+
+	candidates, err := m.client.SRandMemberN(ctx, redisKeyKey(group, key), FindKeyMaxResults).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get holders by key %s: %w", key, err)
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	pipe := m.client.Pipeline()
+	alive := make([]*redis.IntCmd, 0, len(candidates))
+	for _, holder := range candidates {
+		alive = append(alive, pipe.Exists(ctx, redisHolderKey(group, holder)))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get holders by key %s: %w", key, err)
+	}
+	dead := []any{}
+	for i, holder := range candidates {
+		if alive[i].Val() == 0 {
+			dead = append(dead, holder)
+			continue
+		}
+		holders = append(holders, holder)
+	}
+	if len(dead) > 0 {
+		// The holder expired, forget it without waiting for the evictor.
+		if err := m.client.SRem(ctx, redisKeyKey(group, key), dead...).Err(); err != nil {
+			return nil, fmt.Errorf("failed to remove expired holders of key %s: %w", key, err)
+		}
+	}
+	return holders, nil
+}
+
+// GetKeysByHolder returns the keys of the holder, including the keys of a
+// holder which expired but was not evicted yet.
+func (m *RedisDistributionManager) GetKeysByHolder(group, holder string) (keys []string, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("distribution_tab", "get_keys_by_holder", group, start, retErr) }()
+
+	return m.client.SMembers(context.Background(), redisHolderIndexKey(group, holder)).Result()
+}
+
+func (m *RedisDistributionManager) DeleteKeysByHolder(keys []string, holder, group string) (retErr error) {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	defer func() { observeQuery("distribution_tab", "delete_by_keys", group, start, retErr) }()
+
+	return m.deleteDistributions(context.Background(), group, holder, keys)
+}
+
+func (m *RedisDistributionManager) DeleteByHolder(host model.Host) (retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("distribution_tab", "delete_by_holder", host.Group, start, retErr) }()
+
+	if err := m.deleteByHolder(host); err != nil {
+		return fmt.Errorf("failed to delete distributions for holder %s (group=%s): %w",
+			host.HostAddr, host.Group, err)
+	}
+	return nil
+}
+
+// DeleteByHolderByMasterResolver deletes distributions of the holder, all
+// groups share the same redis database so the resolver is only used for metrics.
+func (m *RedisDistributionManager) DeleteByHolderByMasterResolver(host model.Host, masterResolver string) (retErr error) {
+	start := time.Now()
+	defer func() {
+		observeQuery("distribution_tab", "delete_by_holder_by_master", masterResolver, start, retErr)
+	}()
+
+	if err := m.deleteByHolder(host); err != nil {
+		return fmt.Errorf("failed to delete distributions for holder %s (group=%s) from master %s: %w",
+			host.HostAddr, host.Group, masterResolver, err)
+	}
+	return nil
+}
+
+func (m *RedisDistributionManager) deleteByHolder(host model.Host) error {
+	ctx := context.Background()
+	// The keys of the holder expired already if it stopped sending keepalives.
+	keys, err := m.client.SMembers(ctx, redisHolderIndexKey(host.Group, host.HostAddr)).Result()
+	if err != nil {
+		return err
+	}
+	if err := m.deleteDistributions(ctx, host.Group, host.HostAddr, keys); err != nil {
+		return err
+	}
+	return m.client.Del(ctx, redisHolderKey(host.Group, host.HostAddr), redisHolderIndexKey(host.Group, host.HostAddr)).Err()
+}
+
+func (m *RedisDistributionManager) deleteDistributions(ctx context.Context, group, holder string, keys []string) error {
+	for i := 0; i < len(keys); i += MaxBatch {
+		batch := keys[i:min(i+MaxBatch, len(keys))]
+		pipe := m.client.Pipeline()
+		members := make([]any, 0, len(batch))
+		for _, key := range batch {
+			pipe.SRem(ctx, redisKeyKey(group, key), holder)
+			members = append(members, key)
+		}
+		pipe.SRem(ctx, redisHolderKey(group, holder), members...)
+		pipe.SRem(ctx, redisHolderIndexKey(group, holder), members...)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *RedisDistributionManager) ListKeysByHolder(group, holder string, offset, limit int) (_ []string, _ int64, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("distribution_tab", "list_keys_by_holder", group, start, retErr) }()
+
+	keys, err := m.client.SMembers(context.Background(), redisHolderKey(group, holder)).Result()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list keys of holder %s (group=%s): %w", holder, group, err)
+	}
+	slices.Sort(keys)
+	return page(keys, offset, limit), int64(len(keys)), nil
+}
+
+// ListHoldersByKey lists the holders of the key, holders which expired but
+// were not removed from the key yet are listed too. Redis does not record
+// when a key was advertised.
+func (m *RedisDistributionManager) ListHoldersByKey(group, key string, offset, limit int) (_ []model.Distribution, _ int64, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("distribution_tab", "list_holders_by_key", group, start, retErr) }()
+
+	holders, err := m.client.SMembers(context.Background(), redisKeyKey(group, key)).Result()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list holders of key %s (group=%s): %w", key, group, err)
+	}
+	slices.Sort(holders)
+	distributions := []model.Distribution{}
+	for _, holder := range page(holders, offset, limit) {
+		distributions = append(distributions, model.Distribution{Key: key, Holder: holder, Group: group})
+	}
+	return distributions, int64(len(holders)), nil
+}
+
+// TopKeys scans all keys of the group, holders which expired but were not
+// removed from a key yet are counted too.
+func (m *RedisDistributionManager) TopKeys(group string, offset, limit int) (_ []model.KeyReplicas, _ int64, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("distribution_tab", "top_keys", group, start, retErr) }()
+
+	ctx := context.Background()
+	prefix := redisKeyKey(group, "")
+	keys := []model.KeyReplicas{}
+	iter := m.client.Scan(ctx, 0, redisGlobEscape(prefix)+"*", 1000).Iterator()
+	batch := []string{}
+	count := func() error {
+		pipe := m.client.Pipeline()
+		cmds := make([]*redis.IntCmd, 0, len(batch))
+		for _, k := range batch {
+			cmds = append(cmds, pipe.SCard(ctx, k))
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+		for i, k := range batch {
+			keys = append(keys, model.KeyReplicas{Key: strings.TrimPrefix(k, prefix), Holders: cmds[i].Val()})
+		}
+		batch = batch[:0]
+		return nil
+	}
+	for iter.Next(ctx) {
+		batch = append(batch, iter.Val())
+		if len(batch) == MaxBatch {
+			if err := count(); err != nil {
+				return nil, 0, fmt.Errorf("failed to find top keys (group=%s): %w", group, err)
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to find top keys (group=%s): %w", group, err)
+	}
+	if len(batch) > 0 {
+		if err := count(); err != nil {
+			return nil, 0, fmt.Errorf("failed to find top keys (group=%s): %w", group, err)
+		}
+	}
+	return pageTopKeys(keys, offset, limit), int64(len(keys)), nil
+}
@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
+	"github.com/redis/go-redis/v9"
+)
+
+type RedisHostManager struct {
+	client *redis.Client
+}
+
+func NewRedisHostManager(client *redis.Client) *RedisHostManager {
+	return &RedisHostManager{client: client}
+}
+
+// RefreshHostAddr records the keepalive and extends the expiry of the keys of the host.
+func (m *RedisHostManager) RefreshHostAddr(hostAddr, group string) (retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "refresh_host_addr", group, start, retErr) }()
+
+	ctx := context.Background()
+	pipe := m.client.Pipeline()
+	pipe.SAdd(ctx, redisGroupsKey, group)
+	pipe.ZAdd(ctx, redisHostsKey(group), redis.Z{Score: float64(time.Now().Unix()), Member: hostAddr})
+	pipe.Expire(ctx, redisHolderKey(group, hostAddr), DEADTIMEOUT)
+	pipe.Expire(ctx, redisGenerationKey(group, hostAddr), DEADTIMEOUT)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (m *RedisHostManager) HostExists(hostAddr, group string) (_ bool, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "host_exists", group, start, retErr) }()
+
+	_, err := m.client.ZScore(context.Background(), redisHostsKey(group), hostAddr).Result()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to find host %s (group=%s): %w", hostAddr, group, err)
+	}
+	return true, nil
+}
+
+func (m *RedisHostManager) GetSyncGeneration(hostAddr, group string) (_ uint64, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "get_sync_generation", group, start, retErr) }()
+
+	generation, err := m.client.Get(context.Background(), redisGenerationKey(group, hostAddr)).Uint64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get sync generation of host %s (group=%s): %w", hostAddr, group, err)
+	}
+	return generation, nil
+}
+
+// SetSyncGeneration stores the generation, it expires together with the keys
+// of the holder so a holder whose keys expired has to sync all of its keys.
+func (m *RedisHostManager) SetSyncGeneration(hostAddr, group string, generation uint64) (retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "set_sync_generation", group, start, retErr) }()
+
+	return m.client.Set(context.Background(), redisGenerationKey(group, hostAddr), generation, DEADTIMEOUT).Err()
+}
+
+func (m *RedisHostManager) SetHostLabels(hostAddr, group string, labels model.Labels) (retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "set_host_labels", group, start, retErr) }()
+
+	v, err := json.Marshal(labels)
+	if err != nil {
+		return err
+	}
+	return m.client.HSet(context.Background(), redisLabelsKey(group), hostAddr, v).Err()
+}
+
+func (m *RedisHostManager) SetHostUtilization(hostAddr, group string, utilization float64) (retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "set_host_utilization", group, start, retErr) }()
+
+	return m.client.HSet(context.Background(), redisUtilizationKey(group), hostAddr, utilization).Err()
+}
+
+func (m *RedisHostManager) GetHosts(group string, hostAddrs []string) (hosts map[string]model.Host, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "get_hosts", group, start, retErr) }()
+
+	hosts, err := m.getHosts(context.Background(), group, hostAddrs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hosts (group=%s): %w", group, err)
+	}
+	return hosts, nil
+}
+
+func (m *RedisHostManager) getHosts(ctx context.Context, group string, hostAddrs []string) (map[string]model.Host, error) {
+	hosts := map[string]model.Host{}
+	if len(hostAddrs) == 0 {
+		return hosts, nil
+	}
+	pipe := m.client.Pipeline()
+	lastSeenCmd := pipe.ZMScore(ctx, redisHostsKey(group), hostAddrs...)
+	labelsCmd := pipe.HMGet(ctx, redisLabelsKey(group), hostAddrs...)
+	utilizationCmd := pipe.HMGet(ctx, redisUtilizationKey(group), hostAddrs...)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	host := func(i int) model.Host {
+		if host, ok := hosts[hostAddrs[i]]; ok {
+			return host
+		}
+		return model.Host{HostAddr: hostAddrs[i], Group: group}
+	}
+	for i, score := range lastSeenCmd.Val() {
+		// Hosts which have not sent a keepalive have no score.
+		if score == 0 {
+			continue
+		}
+		h := host(i)
+		h.LastSeen = time.Unix(int64(score), 0)
+		hosts[hostAddrs[i]] = h
+	}
+	for i, v := range labelsCmd.Val() {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		h := host(i)
+		if err := json.Unmarshal([]byte(s), &h.Labels); err != nil {
+			return nil, fmt.Errorf("failed to get labels of host %s: %w", hostAddrs[i], err)
+		}
+		hosts[hostAddrs[i]] = h
+	}
+	for i, v := range utilizationCmd.Val() {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		utilization, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get utilization of host %s: %w", hostAddrs[i], err)
+		}
+		h := host(i)
+		h.Utilization = utilization
+		hosts[hostAddrs[i]] = h
+	}
+	return hosts, nil
+}
+
+// ListHosts lists the hosts which sent a keepalive, hosts only known from
+// their labels or utilization are left out.
+func (m *RedisHostManager) ListHosts(group string, offset, limit int) (_ []model.Host, _ int64, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "list_hosts", group, start, retErr) }()
+
+	ctx := context.Background()
+	hostAddrs, err := m.client.ZRange(ctx, redisHostsKey(group), 0, -1).Result()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list hosts (group=%s): %w", group, err)
+	}
+	slices.Sort(hostAddrs)
+	pageAddrs := page(hostAddrs, offset, limit)
+	found, err := m.getHosts(ctx, group, pageAddrs)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list hosts (group=%s): %w", group, err)
+	}
+	hosts := make([]model.Host, 0, len(pageAddrs))
+	for _, hostAddr := range pageAddrs {
+		// The host was deleted since it was listed.
+		if host, ok := found[hostAddr]; ok && !host.LastSeen.IsZero() {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts, int64(len(hostAddrs)), nil
+}
+
+// ListGroupsByMasterResolver lists all groups, all groups share the same
+// redis database so the resolver is only used for metrics.
+func (m *RedisHostManager) ListGroupsByMasterResolver(masterResolver string) (_ []model.GroupSummary, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "list_groups_by_master", masterResolver, start, retErr) }()
+
+	ctx := context.Background()
+	names, err := m.client.SMembers(ctx, redisGroupsKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list groups from master resolver %s: %w", masterResolver, err)
+	}
+	slices.Sort(names)
+	pipe := m.client.Pipeline()
+	counts := make([]*redis.IntCmd, 0, len(names))
+	for _, group := range names {
+		counts = append(counts, pipe.ZCard(ctx, redisHostsKey(group)))
+	}
+	if len(names) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, fmt.Errorf("failed to list groups from master resolver %s: %w", masterResolver, err)
+		}
+	}
+	groups := make([]model.GroupSummary, 0, len(names))
+	for i, group := range names {
+		groups = append(groups, model.GroupSummary{Group: group, Hosts: counts[i].Val()})
+	}
+	return groups, nil
+}
+
+func (m *RedisHostManager) FindDeadHosts(group string) (deadHosts []model.Host, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "find_dead_hosts", group, start, retErr) }()
+
+	deadHosts, err := m.findDeadHosts(context.Background(), group)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find dead hosts: %w", err)
+	}
+	return deadHosts, nil
+}
+
+// FindDeadHostsByMasterResolver finds the dead hosts of all groups, all
+// groups share the same redis database so the resolver is only used for metrics.
+func (m *RedisHostManager) FindDeadHostsByMasterResolver(masterResolver string) (deadHosts []model.Host, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "find_dead_hosts_by_master", masterResolver, start, retErr) }()
+
+	ctx := context.Background()
+	groups, err := m.client.SMembers(ctx, redisGroupsKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find dead hosts from master resolver %s: %w", masterResolver, err)
+	}
+	for _, group := range groups {
+		hosts, err := m.findDeadHosts(ctx, group)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find dead hosts from master resolver %s: %w", masterResolver, err)
+		}
+		deadHosts = append(deadHosts, hosts...)
+	}
+	return deadHosts, nil
+}
+
+func (m *RedisHostManager) findDeadHosts(ctx context.Context, group string) ([]model.Host, error) {
+	threshold := time.Now().Add(-DEADTIMEOUT).Unix()
+	members, err := m.client.ZRangeByScoreWithScores(ctx, redisHostsKey(group), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: "(" + strconv.FormatInt(threshold, 10),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	deadHosts := make([]model.Host, 0, len(members))
+	for _, z := range members {
+		deadHosts = append(deadHosts, model.Host{
+			HostAddr: z.Member.(string),
+			Group:    group,
+			LastSeen: time.Unix(int64(z.Score), 0),
+		})
+	}
+	return deadHosts, nil
+}
+
+func (m *RedisHostManager) DeleteHost(host model.Host) (retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "delete_host", host.Group, start, retErr) }()
+
+	if err := m.deleteHost(context.Background(), host); err != nil {
+		return fmt.Errorf("failed to delete host %s (group=%s): %w",
+			host.HostAddr, host.Group, err)
+	}
+	return nil
+}
+
+// DeleteHostByMasterResolver deletes the host, all groups share the same
+// redis database so the resolver is only used for metrics.
+func (m *RedisHostManager) DeleteHostByMasterResolver(host model.Host, masterResolver string) (retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("host_tab", "delete_host_by_master", masterResolver, start, retErr) }()
+
+	if err := m.deleteHost(context.Background(), host); err != nil {
+		return fmt.Errorf("failed to delete host %s (group=%s) from master %s: %w",
+			host.HostAddr, host.Group, masterResolver, err)
+	}
+	return nil
+}
+
+func (m *RedisHostManager) deleteHost(ctx context.Context, host model.Host) error {
+	pipe := m.client.Pipeline()
+	pipe.ZRem(ctx, redisHostsKey(host.Group), host.HostAddr)
+	pipe.Del(ctx, redisGenerationKey(host.Group, host.HostAddr))
+	pipe.HDel(ctx, redisLabelsKey(host.Group), host.HostAddr)
+	pipe.HDel(ctx, redisUtilizationKey(host.Group), host.HostAddr)
+	_, err := pipe.Exec(ctx)
+	return err
+}
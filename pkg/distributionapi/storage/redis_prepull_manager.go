@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisPrepullTTL is how long prepulls and their progress are kept.
+const redisPrepullTTL = 7 * 24 * time.Hour
+
+type RedisPrepullManager struct {
+	client *redis.Client
+}
+
+func NewRedisPrepullManager(client *redis.Client) *RedisPrepullManager {
+	return &RedisPrepullManager{client: client}
+}
+
+func (m *RedisPrepullManager) CreatePrepull(prepull *model.Prepull) (retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("prepull_tab", "create_prepull", prepull.Group, start, retErr) }()
+
+	ctx := context.Background()
+	id, err := m.client.Incr(ctx, redisPrepullSeqKey).Result()
+	if err != nil {
+		return err
+	}
+	prepull.ID = uint(id)
+	prepull.CreatedAt = time.Now()
+	v, err := json.Marshal(prepull)
+	if err != nil {
+		return err
+	}
+	pipe := m.client.TxPipeline()
+	pipe.Set(ctx, redisPrepullKey(prepull.Group, prepull.ID), v, redisPrepullTTL)
+	pipe.ZAdd(ctx, redisPrepullsKey(prepull.Group), redis.Z{Score: float64(prepull.CreatedAt.UnixNano()), Member: prepull.ID})
+	pipe.ZRemRangeByScore(ctx, redisPrepullsKey(prepull.Group), "-inf", "("+strconv.FormatInt(prepull.CreatedAt.Add(-redisPrepullTTL).UnixNano(), 10))
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (m *RedisPrepullManager) GetPrepull(group string, id uint) (_ *model.Prepull, _ []model.PrepullHostStatus, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("prepull_tab", "get_prepull", group, start, retErr) }()
+
+	ctx := context.Background()
+	prepull, err := m.getPrepull(ctx, group, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	values, err := m.client.HVals(ctx, redisPrepullHostsKey(group, id)).Result()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get hosts of prepull %d: %w", id, err)
+	}
+	hosts := make([]model.PrepullHostStatus, 0, len(values))
+	for _, v := range values {
+		status := model.PrepullHostStatus{}
+		if err := json.Unmarshal([]byte(v), &status); err != nil {
+			return nil, nil, fmt.Errorf("failed to get hosts of prepull %d: %w", id, err)
+		}
+		hosts = append(hosts, status)
+	}
+	return prepull, hosts, nil
+}
+
+func (m *RedisPrepullManager) getPrepull(ctx context.Context, group string, id uint) (*model.Prepull, error) {
+	v, err := m.client.Get(ctx, redisPrepullKey(group, id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get prepull %d: %w", id, err)
+	}
+	prepull := &model.Prepull{}
+	if err := json.Unmarshal(v, prepull); err != nil {
+		return nil, fmt.Errorf("failed to get prepull %d: %w", id, err)
+	}
+	return prepull, nil
+}
+
+func (m *RedisPrepullManager) PendingPrepulls(group, host string, since time.Time) (_ []model.Prepull, retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("prepull_tab", "pending_prepulls", group, start, retErr) }()
+
+	ctx := context.Background()
+	ids, err := m.client.ZRangeByScore(ctx, redisPrepullsKey(group), &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(since.UnixNano(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find pending prepulls: %w", err)
+	}
+	prepulls := []model.Prepull{}
+	for _, member := range ids {
+		id, err := strconv.ParseUint(member, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find pending prepulls: %w", err)
+		}
+		prepull, err := m.getPrepull(ctx, group, uint(id))
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		v, err := m.client.HGet(ctx, redisPrepullHostsKey(group, prepull.ID), host).Bytes()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return nil, fmt.Errorf("failed to find pending prepulls: %w", err)
+		}
+		if err == nil {
+			status := model.PrepullHostStatus{}
+			if err := json.Unmarshal(v, &status); err != nil {
+				return nil, fmt.Errorf("failed to find pending prepulls: %w", err)
+			}
+			if status.Status == model.PrepullStatusDone || status.Status == model.PrepullStatusFailed {
+				continue
+			}
+		}
+		prepulls = append(prepulls, *prepull)
+	}
+	return prepulls, nil
+}
+
+func (m *RedisPrepullManager) UpdatePrepullStatus(status *model.PrepullHostStatus) (retErr error) {
+	start := time.Now()
+	defer func() { observeQuery("prepull_host_tab", "update_prepull_status", status.Group, start, retErr) }()
+
+	status.UpdatedAt = time.Now()
+	v, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	pipe := m.client.TxPipeline()
+	pipe.HSet(ctx, redisPrepullHostsKey(status.Group, status.PrepullID), status.Host, v)
+	pipe.Expire(ctx, redisPrepullHostsKey(status.Group, status.PrepullID), redisPrepullTTL)
+	_, err = pipe.Exec(ctx)
+	return err
+}
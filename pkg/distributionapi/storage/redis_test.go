@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
+)
+
+func newTestRedisManager(t *testing.T) (*Manager, *miniredis.Miniredis) {
+	t.Helper()
+
+	srv := miniredis.RunT(t)
+	m, err := Open([]string{"default:redis:redis://" + srv.Addr() + "/0"})
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+	return m, srv
+}
+
+func TestRedisDistributions(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	m, _ := newTestRedisManager(t)
+
+	err := m.Distribution.CreateDistributions([]*model.Distribution{
+		{Key: "foo", Holder: "10.0.0.1:5000", Group: "a"},
+		{Key: "foo", Holder: "10.0.0.2:5000", Group: "a"},
+		{Key: "bar", Holder: "10.0.0.1:5000", Group: "a"},
+		{Key: "foo", Holder: "10.0.0.3:5000", Group: "b"},
+	}, "a")
+	require.NoError(t, err)
+
+	holders, err := m.Distribution.GetHolderByKey(ctx, "a", "foo")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"10.0.0.1:5000", "10.0.0.2:5000"}, holders)
+	keys, err := m.Distribution.GetKeysByHolder("a", "10.0.0.1:5000")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"foo", "bar"}, keys)
+
+	err = m.Distribution.DeleteKeysByHolder([]string{"foo"}, "10.0.0.1:5000", "a")
+	require.NoError(t, err)
+	holders, err = m.Distribution.GetHolderByKey(ctx, "a", "foo")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.2:5000"}, holders)
+
+	err = m.Distribution.DeleteByHolder(model.Host{HostAddr: "10.0.0.1:5000", Group: "a"})
+	require.NoError(t, err)
+	keys, err = m.Distribution.GetKeysByHolder("a", "10.0.0.1:5000")
+	require.NoError(t, err)
+	require.Empty(t, keys)
+	holders, err = m.Distribution.GetHolderByKey(ctx, "b", "foo")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.3:5000"}, holders)
+}
+
+func TestRedisHolderExpiry(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	m, srv := newTestRedisManager(t)
+
+	err := m.Distribution.CreateDistributions([]*model.Distribution{
+		{Key: "foo", Holder: "10.0.0.1:5000", Group: "a"},
+		{Key: "foo", Holder: "10.0.0.2:5000", Group: "a"},
+		{Key: "bar", Holder: "10.0.0.2:5000", Group: "a"},
+	}, "a")
+	require.NoError(t, err)
+	require.NoError(t, m.Host.RefreshHostAddr("10.0.0.1:5000", "a"))
+	require.NoError(t, m.Host.RefreshHostAddr("10.0.0.2:5000", "a"))
+
+	// Only the first holder keeps sending keepalives.
+	srv.FastForward(DEADTIMEOUT - time.Minute)
+	require.NoError(t, m.Host.RefreshHostAddr("10.0.0.1:5000", "a"))
+	srv.FastForward(2 * time.Minute)
+
+	holders, err := m.Distribution.GetHolderByKey(ctx, "a", "foo")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1:5000"}, holders)
+	members, err := srv.SMembers(redisKeyKey("a", "foo"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1:5000"}, members)
+
+	// The evictor removes the expired holder from the keys nobody asked for.
+	require.True(t, srv.Exists(redisKeyKey("a", "bar")))
+	require.NoError(t, m.Distribution.DeleteByHolder(model.Host{HostAddr: "10.0.0.2:5000", Group: "a"}))
+	require.False(t, srv.Exists(redisKeyKey("a", "bar")))
+	require.False(t, srv.Exists(redisHolderIndexKey("a", "10.0.0.2:5000")))
+}
+
+func TestRedisHosts(t *testing.T) {
+	t.Parallel()
+
+	m, srv := newTestRedisManager(t)
+	require.NoError(t, m.Host.RefreshHostAddr("10.0.0.1:5000", "a"))
+	require.NoError(t, m.Host.RefreshHostAddr("10.0.0.2:5000", "b"))
+	_, err := srv.ZAdd(redisHostsKey("a"), float64(time.Now().Add(-DEADTIMEOUT-time.Minute).Unix()), "10.0.0.1:5000")
+	require.NoError(t, err)
+
+	dead, err := m.Host.FindDeadHosts("a")
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	require.Equal(t, "10.0.0.1:5000", dead[0].HostAddr)
+	dead, err = m.Host.FindDeadHosts("b")
+	require.NoError(t, err)
+	require.Empty(t, dead)
+	dead, err = m.Host.FindDeadHostsByMasterResolver("master_default")
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+
+	require.NoError(t, m.Host.DeleteHostByMasterResolver(dead[0], "master_default"))
+	dead, err = m.Host.FindDeadHostsByMasterResolver("master_default")
+	require.NoError(t, err)
+	require.Empty(t, dead)
+	exists, err := m.Host.HostExists("10.0.0.1:5000", "a")
+	require.NoError(t, err)
+	require.False(t, exists)
+	exists, err = m.Host.HostExists("10.0.0.2:5000", "b")
+	require.NoError(t, err)
+	require.True(t, exists)
+}
+
+func TestRedisPrepulls(t *testing.T) {
+	t.Parallel()
+
+	m, _ := newTestRedisManager(t)
+	testPrepullStore(t, m.Prepull)
+}
+
+func TestRedisAdminQueries(t *testing.T) {
+	t.Parallel()
+
+	m, _ := newTestRedisManager(t)
+	testAdminQueries(t, m)
+
+	// Glob characters of the group are matched literally.
+	top, total, err := m.Distribution.TopKeys("*", 0, 10)
+	require.NoError(t, err)
+	require.Zero(t, total)
+	require.Empty(t, top)
+}
+
+func TestRedisSyncGeneration(t *testing.T) {
+	t.Parallel()
+
+	m, srv := newTestRedisManager(t)
+	generation, err := m.Host.GetSyncGeneration("10.0.0.1:5000", "a")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), generation)
+
+	require.NoError(t, m.Host.SetSyncGeneration("10.0.0.1:5000", "a", 42))
+	generation, err = m.Host.GetSyncGeneration("10.0.0.1:5000", "a")
+	require.NoError(t, err)
+	require.Equal(t, uint64(42), generation)
+
+	// The generation expires together with the keys of the holder.
+	srv.FastForward(DEADTIMEOUT + time.Second)
+	generation, err = m.Host.GetSyncGeneration("10.0.0.1:5000", "a")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), generation)
+}
+
+func TestRedisGetHosts(t *testing.T) {
+	t.Parallel()
+
+	m, _ := newTestRedisManager(t)
+	require.NoError(t, m.Host.SetHostLabels("10.0.0.1:5000", "a", model.Labels{"zone": "a"}))
+	require.NoError(t, m.Host.SetHostUtilization("10.0.0.1:5000", "a", 0.5))
+	require.NoError(t, m.Host.SetHostUtilization("10.0.0.2:5000", "a", 1))
+	hosts, err := m.Host.GetHosts("a", []string{"10.0.0.1:5000", "10.0.0.2:5000", "10.0.0.3:5000"})
+	require.NoError(t, err)
+	expected := map[string]model.Host{
+		"10.0.0.1:5000": {HostAddr: "10.0.0.1:5000", Group: "a", Labels: model.Labels{"zone": "a"}, Utilization: 0.5},
+		"10.0.0.2:5000": {HostAddr: "10.0.0.2:5000", Group: "a", Utilization: 1},
+	}
+	require.Equal(t, expected, hosts)
+
+	require.NoError(t, m.Host.DeleteHost(model.Host{HostAddr: "10.0.0.1:5000", Group: "a"}))
+	hosts, err = m.Host.GetHosts("a", []string{"10.0.0.1:5000"})
+	require.NoError(t, err)
+	require.Empty(t, hosts)
+}
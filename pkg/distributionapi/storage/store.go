@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/laixintao/piccolo/pkg/distributionapi/metrics"
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
+)
+
+// DistributionStore stores which holders have which keys.
+type DistributionStore interface {
+	CreateDistributions(distributions []*model.Distribution, group string) error
+	GetHolderByKey(ctx context.Context, group string, key string) ([]string, error)
+	GetKeysByHolder(group, holder string) ([]string, error)
+	DeleteKeysByHolder(keys []string, holder, group string) error
+	DeleteByHolder(host model.Host) error
+	DeleteByHolderByMasterResolver(host model.Host, masterResolver string) error
+	// ListKeysByHolder returns a page of the keys of the holder sorted by
+	// key and the number of keys of the holder.
+	ListKeysByHolder(group, holder string, offset, limit int) ([]string, int64, error)
+	// ListHoldersByKey returns a page of the distributions of the key sorted
+	// by holder and the number of holders of the key.
+	ListHoldersByKey(group, key string, offset, limit int) ([]model.Distribution, int64, error)
+	// TopKeys returns a page of the keys of the group sorted by their number
+	// of holders, most held first, and the number of keys of the group.
+	TopKeys(group string, offset, limit int) ([]model.KeyReplicas, int64, error)
+}
+
+// HostStore stores the last keepalive of the holders.
+type HostStore interface {
+	RefreshHostAddr(hostAddr, group string) error
+	HostExists(hostAddr, group string) (bool, error)
+	FindDeadHosts(group string) ([]model.Host, error)
+	FindDeadHostsByMasterResolver(masterResolver string) ([]model.Host, error)
+	DeleteHost(host model.Host) error
+	DeleteHostByMasterResolver(host model.Host, masterResolver string) error
+	// GetSyncGeneration returns 0 if the host is unknown.
+	GetSyncGeneration(hostAddr, group string) (uint64, error)
+	SetSyncGeneration(hostAddr, group string, generation uint64) error
+	SetHostLabels(hostAddr, group string, labels model.Labels) error
+	SetHostUtilization(hostAddr, group string, utilization float64) error
+	// GetHosts returns the labels, utilization and last keepalive of the
+	// hosts, unknown hosts are left out.
+	GetHosts(group string, hostAddrs []string) (map[string]model.Host, error)
+	// ListHosts returns a page of the hosts of the group sorted by address
+	// and the number of hosts of the group.
+	ListHosts(group string, offset, limit int) ([]model.Host, int64, error)
+	// ListGroupsByMasterResolver returns the groups in the database of the
+	// master resolver with their number of hosts, sorted by group.
+	ListGroupsByMasterResolver(masterResolver string) ([]model.GroupSummary, error)
+}
+
+// PrepullStore stores requests to pull an image on every pi of a group and
+// the progress of every host.
+type PrepullStore interface {
+	CreatePrepull(prepull *model.Prepull) error
+	// GetPrepull returns ErrNotFound if the prepull does not exist in the group.
+	GetPrepull(group string, id uint) (*model.Prepull, []model.PrepullHostStatus, error)
+	// PendingPrepulls returns the prepulls of the group created after since
+	// which are neither done nor failed on the host.
+	PendingPrepulls(group, host string, since time.Time) ([]model.Prepull, error)
+	UpdatePrepullStatus(status *model.PrepullHostStatus) error
+}
+
+var ErrNotFound = errors.New("not found")
+
+var (
+	_ DistributionStore = &DistributionManager{}
+	_ DistributionStore = &BoltDistributionManager{}
+	_ HostStore         = &HostManager{}
+	_ HostStore         = &BoltHostManager{}
+	_ DistributionStore = &RedisDistributionManager{}
+	_ HostStore         = &RedisHostManager{}
+	_ DistributionStore = &CachedDistributionStore{}
+	_ PrepullStore      = &PrepullManager{}
+	_ PrepullStore      = &BoltPrepullManager{}
+	_ PrepullStore      = &RedisPrepullManager{}
+)
+
+func observeQuery(table, op, group string, start time.Time, err error) {
+	status := "success"
+	if err != nil {
+		status = "fail"
+	}
+	metrics.DBQueryTotal.WithLabelValues(table, op, group, status).Inc()
+	metrics.DBQueryDuration.WithLabelValues(table, op, group, status).Observe(time.Since(start).Seconds())
+}
+
+// page returns the items from offset up to limit items.
+func page[T any](items []T, offset, limit int) []T {
+	if offset >= len(items) {
+		return []T{}
+	}
+	return items[offset:min(offset+limit, len(items))]
+}
+
+// pageTopKeys sorts the keys by their number of holders, most held first,
+// and returns the page.
+func pageTopKeys(keys []model.KeyReplicas, offset, limit int) []model.KeyReplicas {
+	slices.SortFunc(keys, func(a, b model.KeyReplicas) int {
+		return cmp.Or(cmp.Compare(b.Holders, a.Holders), cmp.Compare(a.Key, b.Key))
+	})
+	return page(keys, offset, limit)
+}
@@ -17,8 +17,60 @@ var (
 var (
 	MirrorRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "piccolo_mirror_requests_total",
-		Help: "Total number of mirror requests.",
+		Help: "Total number of mirror requests by cache result, hit, miss, upstream or digest_mismatch for blobs aborted because they did not match their digest.",
 	}, []string{"registry", "cache", "ref_kind"})
+	UpstreamRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "piccolo_upstream_requests_total",
+		Help: "Total number of requests served from the upstream registry because no peer could serve them.",
+	}, []string{"registry", "ref_kind", "status"})
+	MirrorSingleFlightTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "piccolo_mirror_singleflight_total",
+		Help: "Total number of spooled blob requests, by whether the request started the transfer or joined an existing one.",
+	}, []string{"role"})
+	MirrorResumedTransfersTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "piccolo_mirror_resumed_transfers_total",
+		Help: "Total number of blob transfers resumed from another peer after a peer failed mid-stream.",
+	}, []string{"status"})
+	MirrorDigestMismatchTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "piccolo_mirror_digest_mismatch_total",
+		Help: "Total number of blobs received from peers whose content did not match the requested digest.",
+	}, []string{"registry"})
+	MirrorPrefetchedHoldersTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "piccolo_mirror_prefetched_holders_total",
+		Help: "Total number of resolves by whether holders prefetched with the manifest were used, hit or miss.",
+	}, []string{"result"})
+	MirrorPrefetchedBlobsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "piccolo_mirror_prefetched_blobs_total",
+		Help: "Total number of blobs fetched into the spool after their manifest was served.",
+	}, []string{"status"})
+	PrepullsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "piccolo_prepulls_total",
+		Help: "Total number of images pulled ahead of time on request of piccolo.",
+	}, []string{"status"})
+	MirrorParallelDownloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "piccolo_mirror_parallel_downloads_total",
+		Help: "Total number of blobs fetched in chunks from several peers at once.",
+	}, []string{"status"})
+	MirrorParallelChunkFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "piccolo_mirror_parallel_chunk_failures_total",
+		Help: "Total number of chunks which had to be fetched again from another peer.",
+	})
+	PeerScore = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "piccolo_peer_score",
+		Help: "Expected cost in seconds of fetching a blob from the peer, lower is better.",
+	}, []string{"peer"})
+	PeerLatency = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "piccolo_peer_latency_seconds",
+		Help: "Moving average of the time until the peer responded with a header.",
+	}, []string{"peer"})
+	PeerThroughput = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "piccolo_peer_throughput_bytes_per_second",
+		Help: "Moving average of the throughput of blob transfers from the peer.",
+	}, []string{"peer"})
+	PeerErrorRate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "piccolo_peer_error_rate",
+		Help: "Moving average of the ratio of failed requests to the peer.",
+	}, []string{"peer"})
 	ResolveDurHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name: "piccolo_resolve_duration_seconds",
 		Help: "The duration for using piccolo to resolve a key.",
@@ -75,6 +127,19 @@ var (
 
 func Register() {
 	DefaultRegisterer.MustRegister(MirrorRequestsTotal)
+	DefaultRegisterer.MustRegister(UpstreamRequestsTotal)
+	DefaultRegisterer.MustRegister(MirrorSingleFlightTotal)
+	DefaultRegisterer.MustRegister(MirrorResumedTransfersTotal)
+	DefaultRegisterer.MustRegister(MirrorDigestMismatchTotal)
+	DefaultRegisterer.MustRegister(MirrorPrefetchedHoldersTotal)
+	DefaultRegisterer.MustRegister(MirrorPrefetchedBlobsTotal)
+	DefaultRegisterer.MustRegister(PrepullsTotal)
+	DefaultRegisterer.MustRegister(MirrorParallelDownloadsTotal)
+	DefaultRegisterer.MustRegister(MirrorParallelChunkFailuresTotal)
+	DefaultRegisterer.MustRegister(PeerScore)
+	DefaultRegisterer.MustRegister(PeerLatency)
+	DefaultRegisterer.MustRegister(PeerThroughput)
+	DefaultRegisterer.MustRegister(PeerErrorRate)
 	DefaultRegisterer.MustRegister(ResolveDurHistogram)
 	DefaultRegisterer.MustRegister(AdvertisedImages)
 	DefaultRegisterer.MustRegister(AdvertisedImageTags)
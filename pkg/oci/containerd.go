@@ -3,39 +3,55 @@ package oci
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 	"text/template"
+	"time"
 
 	semver "github.com/Masterminds/semver/v3"
 	"github.com/containerd/containerd"
 	eventtypes "github.com/containerd/containerd/api/events"
 	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/containerd/remotes/docker/config"
 	"github.com/containerd/errdefs"
 	"github.com/containerd/typeurl/v2"
 	"github.com/go-logr/logr"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pelletier/go-toml/v2/unstable"
+	"github.com/spf13/afero"
 	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
 )
 
 const (
 	backupDir = "_backup"
+	// Content written by pi is protected from containerd garbage collection
+	// for this long, giving containerd time to reference it from an image.
+	writeLeaseExpiration = 1 * time.Hour
+	// Content is not named after images, deletes of all content are received.
+	contentDeleteFilter = `topic=="/content/delete"`
 )
 
 var _ Client = &Containerd{}
 
 type Containerd struct {
-	contentPath  string
-	client       *containerd.Client
-	clientGetter func() (*containerd.Client, error)
-	listFilter   string
-	eventFilter  string
+	contentPath        string
+	registryConfigPath string
+	client             *containerd.Client
+	clientGetter       func() (*containerd.Client, error)
+	listFilter         string
+	eventFilter        string
 }
 
 type Option func(*Containerd)
@@ -46,17 +62,15 @@ func WithContentPath(path string) Option {
 	}
 }
 
-func NewContainerd(ctx context.Context, sock, namespace string, registries []url.URL, opts ...Option) (*Containerd, error) {
+func NewContainerd(sock, namespace, registryConfigPath string, registries []url.URL, opts ...Option) (*Containerd, error) {
 	listFilter, eventFilter := createFilters(registries)
-	log := logr.FromContextOrDiscard(ctx)
-	log.Info("ContainerdClient Created.", "listFilter", listFilter, "eventFilter", eventFilter)
-
 	c := &Containerd{
 		clientGetter: func() (*containerd.Client, error) {
 			return containerd.New(sock, containerd.WithDefaultNamespace(namespace))
 		},
-		eventFilter: eventFilter,
-		listFilter:  listFilter,
+		registryConfigPath: registryConfigPath,
+		eventFilter:        eventFilter,
+		listFilter:         listFilter,
 	}
 	for _, opt := range opts {
 		opt(c)
@@ -108,7 +122,48 @@ func (c *Containerd) Verify(ctx context.Context) error {
 		return nil
 	}
 
-	return nil
+	resp, err := srv.Status(ctx, &runtimeapi.StatusRequest{Verbose: true})
+	if err != nil {
+		return err
+	}
+	return verifyStatusResponse(resp, c.registryConfigPath)
+}
+
+func verifyStatusResponse(resp *runtimeapi.StatusResponse, configPath string) error {
+	str, ok := resp.Info["config"]
+	if !ok {
+		return errors.New("could not get config data from info response")
+	}
+	cfg := &struct {
+		Registry struct {
+			ConfigPath *string `json:"configPath"`
+		} `json:"registry"`
+		Containerd struct {
+			DiscardUnpackedLayers *bool `json:"discardUnpackedLayers"`
+		} `json:"containerd"`
+	}{}
+	err := json.Unmarshal([]byte(str), cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.Containerd.DiscardUnpackedLayers == nil {
+		return errors.New("field containerd.discardUnpackedLayers missing from config")
+	}
+	if *cfg.Containerd.DiscardUnpackedLayers {
+		return errors.New("Containerd discard unpacked layers cannot be enabled")
+	}
+	if cfg.Registry.ConfigPath == nil {
+		return errors.New("field registry.configPath missing from config")
+	}
+	if *cfg.Registry.ConfigPath == "" {
+		return errors.New("Containerd registry config path needs to be set for mirror configuration to take effect")
+	}
+	for _, p := range filepath.SplitList(*cfg.Registry.ConfigPath) {
+		if p == configPath {
+			return nil
+		}
+	}
+	return fmt.Errorf("Containerd registry config path is %s but needs to contain path %s for mirror configuration to take effect", *cfg.Registry.ConfigPath, configPath)
 }
 
 func (c *Containerd) Subscribe(ctx context.Context) (<-chan ImageEvent, <-chan error, <-chan error, error) {
@@ -119,7 +174,7 @@ func (c *Containerd) Subscribe(ctx context.Context) (<-chan ImageEvent, <-chan e
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	envelopeCh, cErrCh := client.EventService().Subscribe(ctx, c.eventFilter)
+	envelopeCh, cErrCh := client.EventService().Subscribe(ctx, c.eventFilter, contentDeleteFilter)
 	go func() {
 		defer func() {
 			close(imgCh)
@@ -141,6 +196,10 @@ func (c *Containerd) Subscribe(ctx context.Context) (<-chan ImageEvent, <-chan e
 					errCh <- err
 					continue
 				}
+				if eventType == ContentDeleteEvent {
+					imgCh <- ImageEvent{Type: eventType, Digest: digest.Digest(imageName)}
+					continue
+				}
 				switch eventType {
 				case CreateEvent, UpdateEvent:
 					cImg, err := client.GetImage(ctx, imageName)
@@ -270,6 +329,41 @@ func (c *Containerd) GetBlob(ctx context.Context, dgst digest.Digest) (io.ReadSe
 	}, nil
 }
 
+func (c *Containerd) WriteBlob(ctx context.Context, desc ocispec.Descriptor, r io.Reader) error {
+	client, err := c.Client()
+	if err != nil {
+		return err
+	}
+	lease, err := client.LeasesService().Create(ctx, leases.WithRandomID(), leases.WithExpiration(writeLeaseExpiration))
+	if err != nil {
+		return fmt.Errorf("could not create lease for blob %s: %w", desc.Digest, err)
+	}
+	ctx = leases.WithLease(ctx, lease.ID)
+	return content.WriteBlob(ctx, client.ContentStore(), "pi-"+desc.Digest.String(), r, desc)
+}
+
+func (c *Containerd) Pull(ctx context.Context, ref string) error {
+	client, err := c.Client()
+	if err != nil {
+		return err
+	}
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: config.ConfigureHosts(ctx, config.HostOptions{
+			HostDir: config.HostDirFromRoot(c.registryConfigPath),
+		}),
+	})
+	_, err = client.Pull(ctx, ref,
+		containerd.WithResolver(resolver),
+		containerd.WithPullUnpack,
+		// Makes the image visible to the CRI plugin, like images pulled by the kubelet.
+		containerd.WithPullLabel("io.cri-containerd.image", "managed"),
+	)
+	if err != nil {
+		return fmt.Errorf("could not pull image %s: %w", ref, err)
+	}
+	return nil
+}
+
 func getEventImage(e typeurl.Any) (string, EventType, error) {
 	if e == nil {
 		return "", "", errors.New("any cannot be nil")
@@ -285,6 +379,8 @@ func getEventImage(e typeurl.Any) (string, EventType, error) {
 		return e.Name, UpdateEvent, nil
 	case *eventtypes.ImageDelete:
 		return e.Name, DeleteEvent, nil
+	case *eventtypes.ContentDelete:
+		return e.Digest, ContentDeleteEvent, nil
 	default:
 		return "", "", errors.New("unsupported event type")
 	}
@@ -351,6 +447,209 @@ capabilities = {{ $.Capabilities }}
 	return strings.TrimSpace(buf.String()), nil
 }
 
+// AddMirrorConfiguration writes a hosts.toml for every registry, pointing it
+// at the mirrors. Existing configuration is moved to a backup directory the
+// first time, and can be appended to the new configuration with appendToBackup.
+func AddMirrorConfiguration(ctx context.Context, fs afero.Fs, configPath string, registryURLs, mirrorURLs []url.URL, resolveTags, appendToBackup bool) error {
+	log := logr.FromContextOrDiscard(ctx)
+	err := validateRegistries(registryURLs)
+	if err != nil {
+		return err
+	}
+	err = fs.MkdirAll(configPath, 0o755)
+	if err != nil {
+		return err
+	}
+	err = backupConfig(log, fs, configPath)
+	if err != nil {
+		return err
+	}
+	err = clearConfig(fs, configPath)
+	if err != nil {
+		return err
+	}
+
+	capabilities := []string{"pull"}
+	if resolveTags {
+		capabilities = append(capabilities, "resolve")
+	}
+	for _, registryURL := range registryURLs {
+		templatedHosts, err := templateHosts(registryURL, mirrorURLs, capabilities)
+		if err != nil {
+			return err
+		}
+		if appendToBackup {
+			eh, err := existingHosts(fs, configPath, registryURL)
+			if err != nil {
+				return err
+			}
+			if eh != "" {
+				templatedHosts = templatedHosts + "\n\n" + eh
+			}
+		}
+		fp := path.Join(configPath, registryURL.Host, "hosts.toml")
+		err = fs.MkdirAll(path.Dir(fp), 0o755)
+		if err != nil {
+			return err
+		}
+		err = afero.WriteFile(fs, fp, []byte(templatedHosts), 0o644)
+		if err != nil {
+			return err
+		}
+		log.Info("added containerd mirror configuration", "registry", registryURL.String(), "path", fp)
+	}
+	return nil
+}
+
+// RemoveMirrorConfiguration removes the mirror configuration and restores the
+// configuration which existed before AddMirrorConfiguration was first called.
+func RemoveMirrorConfiguration(ctx context.Context, fs afero.Fs, configPath string) error {
+	log := logr.FromContextOrDiscard(ctx)
+	err := clearConfig(fs, configPath)
+	if err != nil {
+		return err
+	}
+	ok, err := afero.DirExists(fs, path.Join(configPath, backupDir))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	files, err := afero.ReadDir(fs, path.Join(configPath, backupDir))
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		oldPath := path.Join(configPath, backupDir, fi.Name())
+		newPath := path.Join(configPath, fi.Name())
+		err := fs.Rename(oldPath, newPath)
+		if err != nil {
+			return err
+		}
+		log.Info("recovering backup file", "path", newPath)
+	}
+	return fs.Remove(path.Join(configPath, backupDir))
+}
+
+func backupConfig(log logr.Logger, fs afero.Fs, configPath string) error {
+	ok, err := afero.DirExists(fs, path.Join(configPath, backupDir))
+	if err != nil {
+		return err
+	}
+	// Never overwrite an existing backup, it holds the original configuration.
+	if ok {
+		return nil
+	}
+	files, err := afero.ReadDir(fs, configPath)
+	if err != nil {
+		return err
+	}
+	err = fs.MkdirAll(path.Join(configPath, backupDir), 0o755)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		oldPath := path.Join(configPath, fi.Name())
+		newPath := path.Join(configPath, backupDir, fi.Name())
+		err := fs.Rename(oldPath, newPath)
+		if err != nil {
+			return err
+		}
+		log.Info("backing up Containerd host configuration", "path", oldPath)
+	}
+	return nil
+}
+
+func clearConfig(fs afero.Fs, configPath string) error {
+	files, err := afero.ReadDir(fs, configPath)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if fi.Name() == backupDir {
+			continue
+		}
+		err := fs.RemoveAll(path.Join(configPath, fi.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type hostFile struct {
 	Hosts map[string]interface{} `toml:"host"`
 }
+
+// existingHosts returns the host entries of the backed up hosts.toml for the
+// registry, in the order they were defined.
+func existingHosts(fs afero.Fs, configPath string, registryURL url.URL) (string, error) {
+	fp := path.Join(configPath, backupDir, registryURL.Host, "hosts.toml")
+	b, err := afero.ReadFile(fs, fp)
+	if errors.Is(err, afero.ErrFileNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	hf := hostFile{}
+	err = toml.Unmarshal(b, &hf)
+	if err != nil {
+		return "", err
+	}
+	if len(hf.Hosts) == 0 {
+		return "", nil
+	}
+	order, err := hostOrder(b)
+	if err != nil {
+		return "", err
+	}
+	remaining := []string{}
+	for h := range hf.Hosts {
+		if !slices.Contains(order, h) {
+			remaining = append(remaining, h)
+		}
+	}
+	slices.Sort(remaining)
+	order = append(order, remaining...)
+
+	hosts := []string{}
+	for _, h := range order {
+		v, ok := hf.Hosts[h]
+		if !ok {
+			continue
+		}
+		hb, err := toml.Marshal(hostFile{Hosts: map[string]interface{}{h: v}})
+		if err != nil {
+			return "", err
+		}
+		hs := strings.TrimPrefix(string(hb), "[host]\n")
+		hosts = append(hosts, strings.TrimSpace(hs))
+	}
+	return strings.Join(hosts, "\n\n"), nil
+}
+
+// hostOrder returns the host names in the order their tables are defined.
+func hostOrder(b []byte) ([]string, error) {
+	p := unstable.Parser{}
+	p.Reset(b)
+	order := []string{}
+	for p.NextExpression() {
+		expr := p.Expression()
+		if expr.Kind != unstable.Table {
+			continue
+		}
+		keys := []string{}
+		it := expr.Key()
+		for it.Next() {
+			keys = append(keys, string(it.Node().Data))
+		}
+		if len(keys) != 2 || keys[0] != "host" || slices.Contains(order, keys[1]) {
+			continue
+		}
+		order = append(order, keys[1])
+	}
+	return order, p.Error()
+}
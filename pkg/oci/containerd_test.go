@@ -246,6 +246,14 @@ func TestGetEventImage(t *testing.T) {
 			expectedName:      "delete",
 			expectedEventType: DeleteEvent,
 		},
+		{
+			name: "content delete event",
+			data: &eventtypes.ContentDelete{
+				Digest: "sha256:c0ffee",
+			},
+			expectedName:      "sha256:c0ffee",
+			expectedEventType: ContentDeleteEvent,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
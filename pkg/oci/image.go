@@ -24,12 +24,17 @@ const (
 	CreateEvent EventType = "CREATE"
 	UpdateEvent EventType = "UPDATE"
 	DeleteEvent EventType = "DELETE"
+	// ContentDeleteEvent is sent when content is removed from the content
+	// store, e.g. by garbage collection.
+	ContentDeleteEvent EventType = "CONTENT_DELETE"
 )
 
 type ImageEvent struct {
 	ImageName string
 	Image     Image
 	Type      EventType
+	// Digest of the deleted content, only set for ContentDeleteEvent.
+	Digest digest.Digest
 }
 
 func NewImage(name, registry, repository, tag string, dgst digest.Digest) (Image, error) {
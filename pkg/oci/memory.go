@@ -0,0 +1,138 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ Client = &Memory{}
+
+// Memory is an in memory Client used for testing.
+type Memory struct {
+	blobs  map[digest.Digest][]byte
+	images []Image
+	mx     sync.RWMutex
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		images: []Image{},
+		blobs:  map[digest.Digest][]byte{},
+	}
+}
+
+func (m *Memory) Name() string {
+	return "memory"
+}
+
+func (m *Memory) Verify(ctx context.Context) error {
+	return nil
+}
+
+func (m *Memory) Subscribe(ctx context.Context) (<-chan ImageEvent, <-chan error, <-chan error, error) {
+	return nil, nil, nil, nil
+}
+
+func (m *Memory) ListImages(ctx context.Context) ([]Image, error) {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+
+	return append([]Image{}, m.images...), nil
+}
+
+func (m *Memory) Resolve(ctx context.Context, ref string) (digest.Digest, error) {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+
+	for _, img := range m.images {
+		if img.Name == ref {
+			return img.Digest, nil
+		}
+	}
+	return "", fmt.Errorf("could not find image %s", ref)
+}
+
+func (m *Memory) Size(ctx context.Context, dgst digest.Digest) (int64, error) {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+
+	b, ok := m.blobs[dgst]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return int64(len(b)), nil
+}
+
+func (m *Memory) GetManifest(ctx context.Context, dgst digest.Digest) ([]byte, string, error) {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+
+	b, ok := m.blobs[dgst]
+	if !ok {
+		return nil, "", ErrNotFound
+	}
+	mt, err := DetermineMediaType(b)
+	if err != nil {
+		return nil, "", err
+	}
+	return b, mt, nil
+}
+
+func (m *Memory) GetBlob(ctx context.Context, dgst digest.Digest) (io.ReadSeekCloser, error) {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+
+	b, ok := m.blobs[dgst]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return struct {
+		io.ReadSeeker
+		io.Closer
+	}{
+		ReadSeeker: bytes.NewReader(b),
+		Closer:     io.NopCloser(nil),
+	}, nil
+}
+
+func (m *Memory) WriteBlob(ctx context.Context, desc ocispec.Descriptor, r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(b)) != desc.Size {
+		return fmt.Errorf("unexpected size %d for blob %s, expected %d", len(b), desc.Digest, desc.Size)
+	}
+	if digest.FromBytes(b) != desc.Digest {
+		return errors.New("written content does not match descriptor digest")
+	}
+	m.AddBlob(b, desc.Digest)
+	return nil
+}
+
+// Pull succeeds if the image was added before, the memory client cannot fetch content.
+func (m *Memory) Pull(ctx context.Context, ref string) error {
+	_, err := m.Resolve(ctx, ref)
+	return err
+}
+
+func (m *Memory) AddImage(img Image) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	m.images = append(m.images, img)
+}
+
+func (m *Memory) AddBlob(b []byte, dgst digest.Digest) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	m.blobs[dgst] = b
+}
@@ -45,6 +45,15 @@ type Client interface {
 	// GetBlob returns a stream of the blob content for the given digest.
 	// Will return ErrNotFound if the digest cannot be found.
 	GetBlob(ctx context.Context, dgst digest.Digest) (io.ReadSeekCloser, error)
+
+	// WriteBlob stores the content read from r under the given descriptor.
+	// Content is verified against the descriptor digest and size before it is committed.
+	WriteBlob(ctx context.Context, desc ocispec.Descriptor, r io.Reader) error
+
+	// Pull pulls and unpacks the image so that it is ready to run. Registry
+	// hosts are configured like for the container runtime, so pulls go
+	// through the mirror.
+	Pull(ctx context.Context, ref string) error
 }
 
 type UnknownDocument struct {
@@ -81,6 +90,35 @@ func DetermineMediaType(b []byte) (string, error) {
 	return "", errors.New("not able to determine media type")
 }
 
+// ManifestReferences returns the manifests referenced by an index, or the
+// config and layers referenced by an image manifest.
+func ManifestReferences(b []byte, mediaType string) ([]digest.Digest, []digest.Digest, error) {
+	switch mediaType {
+	case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+		var idx ocispec.Index
+		if err := json.Unmarshal(b, &idx); err != nil {
+			return nil, nil, err
+		}
+		manifests := []digest.Digest{}
+		for _, m := range idx.Manifests {
+			manifests = append(manifests, m.Digest)
+		}
+		return manifests, nil, nil
+	case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(b, &manifest); err != nil {
+			return nil, nil, err
+		}
+		blobs := []digest.Digest{manifest.Config.Digest}
+		for _, layer := range manifest.Layers {
+			blobs = append(blobs, layer.Digest)
+		}
+		return nil, blobs, nil
+	default:
+		return nil, nil, fmt.Errorf("unexpected media type %s", mediaType)
+	}
+}
+
 func WalkImage(ctx context.Context, client Client, img Image) ([]string, error) {
 	keys := []string{}
 	err := walk(ctx, []digest.Digest{img.Digest}, func(dgst digest.Digest) ([]digest.Digest, error) {
@@ -89,41 +127,31 @@ func WalkImage(ctx context.Context, client Client, img Image) ([]string, error)
 			return nil, err
 		}
 		keys = append(keys, dgst.String())
-		switch mt {
-		case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
-			var idx ocispec.Index
-			if err := json.Unmarshal(b, &idx); err != nil {
-				return nil, err
-			}
-			manifestDgsts := []digest.Digest{}
-			for _, m := range idx.Manifests {
-				_, err := client.Size(ctx, m.Digest)
-				if errors.Is(err, ErrNotFound) {
-					continue
-				}
-				if err != nil {
-					return nil, err
-				}
-				manifestDgsts = append(manifestDgsts, m.Digest)
-			}
-			if len(manifestDgsts) == 0 {
-				return nil, fmt.Errorf("could not find any platforms with local content in manifest %s", dgst)
+		manifests, blobs, err := ManifestReferences(b, mt)
+		if err != nil {
+			return nil, fmt.Errorf("%w for digest %s", err, dgst)
+		}
+		for _, blob := range blobs {
+			keys = append(keys, blob.String())
+		}
+		if len(manifests) == 0 {
+			return nil, nil
+		}
+		manifestDgsts := []digest.Digest{}
+		for _, m := range manifests {
+			_, err := client.Size(ctx, m)
+			if errors.Is(err, ErrNotFound) {
+				continue
 			}
-			return manifestDgsts, nil
-		case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
-			var manifest ocispec.Manifest
-			err := json.Unmarshal(b, &manifest)
 			if err != nil {
 				return nil, err
 			}
-			keys = append(keys, manifest.Config.Digest.String())
-			for _, layer := range manifest.Layers {
-				keys = append(keys, layer.Digest.String())
-			}
-			return nil, nil
-		default:
-			return nil, fmt.Errorf("unexpected media type %s for digest %s", mt, dgst)
+			manifestDgsts = append(manifestDgsts, m)
+		}
+		if len(manifestDgsts) == 0 {
+			return nil, fmt.Errorf("could not find any platforms with local content in manifest %s", dgst)
 		}
+		return manifestDgsts, nil
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to walk image manifests: %w", err)
@@ -0,0 +1,281 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/laixintao/piccolo/internal/mux"
+	"github.com/laixintao/piccolo/pkg/metrics"
+)
+
+// useParallel returns true if the blob could be fetched from several peers at once.
+func (r *Registry) useParallel(peers []netip.AddrPort) bool {
+	return r.parallelThreshold > 0 && r.parallelPeers > 1 && len(peers) > 1
+}
+
+// peerHead returns the size and headers of the blob on the peer.
+func (r *Registry) peerHead(ctx context.Context, peer netip.AddrPort, req *http.Request) (int64, http.Header, error) {
+	outReq := r.peerRequest(ctx, peer, req)
+	outReq.Method = http.MethodHead
+	outReq.Header.Del("Range")
+	resp, err := r.transport.RoundTrip(outReq)
+	if err != nil {
+		r.scores.ObserveFailure(peer)
+		return 0, nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		r.scores.observeError(peer, resp.StatusCode)
+		return 0, nil, fmt.Errorf("expected mirror to respond with 200 OK but received: %s", resp.Status)
+	}
+	if resp.Header.Get("Accept-Ranges") != "bytes" || resp.ContentLength < 0 {
+		return 0, nil, errors.New("mirror does not support range requests")
+	}
+	header := http.Header{}
+	for _, k := range []string{"Content-Type", "Content-Length", "Docker-Content-Digest"} {
+		if v := resp.Header.Get(k); v != "" {
+			header.Set(k, v)
+		}
+	}
+	return resp.ContentLength, header, nil
+}
+
+// tryParallel serves the blob by fetching chunks from several peers at once.
+// It returns false without writing a response if the blob is too small.
+func (r *Registry) tryParallel(ctx context.Context, peers []netip.AddrPort, rw mux.ResponseWriter, req *http.Request, t *blobTransfer) (bool, error) {
+	size, header, err := r.peerHead(ctx, peers[0], req)
+	if err != nil {
+		return false, err
+	}
+	if size < r.parallelThreshold {
+		return false, nil
+	}
+	for k, vv := range header {
+		rw.Header()[k] = vv
+	}
+	rw.WriteHeader(http.StatusOK)
+	t.headerSent = true
+	t.expected = size
+
+	used, err := r.fetchParallel(ctx, peers, req, size, &transferWriter{t: t, rw: rw})
+	t.peers = append(t.peers, used...)
+	if t.writeErr != nil {
+		return true, t.writeErr
+	}
+	if err != nil {
+		return true, err
+	}
+	return true, t.complete(rw)
+}
+
+// chunkScheduler hands out chunks to the workers. At most window chunks
+// ahead of the next chunk to write are fetched, which bounds the memory used
+// for reordering. Chunks of failed workers are handed out again first.
+type chunkScheduler struct {
+	mx     sync.Mutex
+	cond   *sync.Cond
+	count  int
+	window int
+	next   int
+	retry  []int
+	chunks map[int]fetchedChunk
+	// Index of the next chunk to write.
+	written int
+	workers int
+	err     error
+}
+
+func newChunkScheduler(count, window, workers int) *chunkScheduler {
+	s := &chunkScheduler{
+		count:   count,
+		window:  window,
+		workers: workers,
+		chunks:  map[int]fetchedChunk{},
+	}
+	s.cond = sync.NewCond(&s.mx)
+	return s
+}
+
+// take returns the next chunk to fetch, false if there is nothing left to fetch.
+func (s *chunkScheduler) take() (int, bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for {
+		if s.err != nil || s.written == s.count {
+			return 0, false
+		}
+		if len(s.retry) > 0 {
+			idx := s.retry[0]
+			s.retry = s.retry[1:]
+			return idx, true
+		}
+		if s.next < s.count && s.next < s.written+s.window {
+			idx := s.next
+			s.next++
+			return idx, true
+		}
+		// Wait for the window to move or for chunks of failed workers.
+		s.cond.Wait()
+	}
+}
+
+type fetchedChunk struct {
+	data []byte
+	peer netip.AddrPort
+}
+
+func (s *chunkScheduler) done(idx int, data []byte, peer netip.AddrPort) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.chunks[idx] = fetchedChunk{data: data, peer: peer}
+	s.cond.Broadcast()
+}
+
+// fail gives the chunk back and removes the worker.
+func (s *chunkScheduler) fail(idx int, err error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.retry = append(s.retry, idx)
+	s.workers--
+	if s.workers == 0 && s.err == nil {
+		s.err = fmt.Errorf("all peers failed: %w", err)
+	}
+	s.cond.Broadcast()
+}
+
+func (s *chunkScheduler) abort(err error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+}
+
+// ready blocks until the next chunk to write is available.
+func (s *chunkScheduler) ready() (fetchedChunk, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for {
+		if chunk, ok := s.chunks[s.written]; ok {
+			delete(s.chunks, s.written)
+			return chunk, nil
+		}
+		if s.err != nil {
+			return fetchedChunk{}, s.err
+		}
+		s.cond.Wait()
+	}
+}
+
+func (s *chunkScheduler) advance() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.written++
+	s.cond.Broadcast()
+}
+
+// fetchParallel fetches the blob in chunks from up to parallelPeers peers at
+// once and writes the content in order to w. On error the content written to
+// w is a valid prefix of the blob, so the transfer can be resumed. It returns
+// the peers which served any of the chunks written to w.
+func (r *Registry) fetchParallel(ctx context.Context, peers []netip.AddrPort, req *http.Request, size int64, w io.Writer) ([]netip.AddrPort, error) {
+	log := logr.FromContextOrDiscard(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := min(r.parallelPeers, len(peers))
+	count := int((size + r.chunkSize - 1) / r.chunkSize)
+	s := newChunkScheduler(count, 2*workers, workers)
+	stop := context.AfterFunc(ctx, func() { s.abort(ctx.Err()) })
+	defer stop()
+
+	wg := sync.WaitGroup{}
+	for _, peer := range peers[:workers] {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				idx, ok := s.take()
+				if !ok {
+					return
+				}
+				start := int64(idx) * r.chunkSize
+				end := min(start+r.chunkSize, size) - 1
+				data, err := r.fetchChunk(ctx, peer, req, start, end)
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Error(err, "fetching chunk from peer failed", "peer", peer, "start", start, "end", end)
+						metrics.MirrorParallelChunkFailuresTotal.Inc()
+					}
+					s.fail(idx, err)
+					return
+				}
+				s.done(idx, data, peer)
+			}
+		}()
+	}
+
+	used := []netip.AddrPort{}
+	var err error
+	for range count {
+		var chunk fetchedChunk
+		chunk, err = s.ready()
+		if err != nil {
+			break
+		}
+		if !slices.Contains(used, chunk.peer) {
+			used = append(used, chunk.peer)
+		}
+		if _, err = w.Write(chunk.data); err != nil {
+			s.abort(err)
+			break
+		}
+		s.advance()
+	}
+	cancel()
+	wg.Wait()
+
+	status := "success"
+	if err != nil {
+		status = "fail"
+	}
+	metrics.MirrorParallelDownloadsTotal.WithLabelValues(status).Inc()
+	return used, err
+}
+
+// fetchChunk returns the bytes from start to end inclusive of the blob from the peer.
+func (r *Registry) fetchChunk(ctx context.Context, peer netip.AddrPort, req *http.Request, start, end int64) ([]byte, error) {
+	outReq := r.peerRequest(ctx, peer, req)
+	outReq.Header.Set("Range", "bytes="+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(end, 10))
+	reqStart := time.Now()
+	resp, err := r.transport.RoundTrip(outReq)
+	if err != nil {
+		r.scores.ObserveFailure(peer)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	ttfb := time.Since(reqStart)
+	if err := checkResumeResponse(resp, start); err != nil {
+		r.scores.observeError(peer, resp.StatusCode)
+		return nil, err
+	}
+	data := make([]byte, end-start+1)
+	_, err = io.ReadFull(resp.Body, data)
+	if err != nil {
+		r.scores.ObserveFailure(peer)
+		return nil, err
+	}
+	r.scores.ObserveSuccess(peer, ttfb, int64(len(data)), time.Since(reqStart)-ttfb)
+	return data, nil
+}
@@ -0,0 +1,110 @@
+package registry
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParallelDownload(t *testing.T) {
+	t.Parallel()
+
+	blob := make([]byte, 100000)
+	for i := range blob {
+		blob[i] = byte(i % 251)
+	}
+	dgst := digest.FromBytes(blob)
+
+	servers := []*httptest.Server{}
+	counts := []*atomic.Int32{}
+	for i := range 3 {
+		count := &atomic.Int32{}
+		counts = append(counts, count)
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("Accept-Ranges", "bytes")
+			if req.Method == http.MethodGet {
+				require.NotEmpty(t, req.Header.Get("Range"))
+				// The last peer fails after serving a few chunks.
+				if count.Add(1) > 3 && i == 2 {
+					rw.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+			}
+			http.ServeContent(rw, req, "", time.Time{}, bytes.NewReader(blob))
+		}))
+		defer srv.Close()
+		servers = append(servers, srv)
+	}
+	peers := []netip.AddrPort{}
+	for _, srv := range servers {
+		u, err := url.Parse(srv.URL)
+		require.NoError(t, err)
+		peers = append(peers, netip.MustParseAddrPort(u.Host))
+	}
+
+	for _, spoolDir := range []string{"", t.TempDir()} {
+		for _, count := range counts {
+			count.Store(0)
+		}
+		opts := []Option{WithParallelDownload(1, 1000, 3)}
+		if spoolDir != "" {
+			opts = append(opts, WithSpoolDir(spoolDir))
+		}
+		reg := NewRegistry(&staticDiscover{peers: peers}, logr.Discard(), opts...)
+		srv, err := reg.Server("")
+		require.NoError(t, err)
+
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/v2/library/foo/blobs/"+dgst.String()+"?ns=docker.io", nil)
+		srv.Handler.ServeHTTP(rw, req)
+		require.Equal(t, http.StatusOK, rw.Code)
+		b, err := io.ReadAll(rw.Body)
+		require.NoError(t, err)
+		require.Equal(t, dgst, digest.FromBytes(b))
+		for _, count := range counts {
+			require.Positive(t, count.Load())
+		}
+	}
+}
+
+func TestFetchParallelUsedPeers(t *testing.T) {
+	t.Parallel()
+
+	blob := make([]byte, 10000)
+	for i := range blob {
+		blob[i] = byte(i % 251)
+	}
+	good := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.ServeContent(rw, req, "", time.Time{}, bytes.NewReader(blob))
+	}))
+	defer good.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	peers := []netip.AddrPort{}
+	for _, srv := range []*httptest.Server{good, failing} {
+		u, err := url.Parse(srv.URL)
+		require.NoError(t, err)
+		peers = append(peers, netip.MustParseAddrPort(u.Host))
+	}
+
+	reg := NewRegistry(&staticDiscover{peers: peers}, logr.Discard(), WithParallelDownload(1, 1000, 2))
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/v2/library/foo/blobs/"+digest.FromBytes(blob).String()+"?ns=docker.io", nil)
+	buf := &bytes.Buffer{}
+	used, err := reg.fetchParallel(req.Context(), peers, req, int64(len(blob)), buf)
+	require.NoError(t, err)
+	require.Equal(t, blob, buf.Bytes())
+	// The failing peer served none of the chunks.
+	require.Equal(t, []netip.AddrPort{peers[0]}, used)
+}
@@ -0,0 +1,267 @@
+package registry
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/laixintao/piccolo/pkg/metrics"
+)
+
+const (
+	// Weight of a new observation in the moving averages.
+	peerScoreAlpha = 0.3
+	// Blob size used to turn the throughput into an expected transfer time.
+	peerScoreReferenceSize = 16 << 20
+	// Transfers smaller than this are dominated by latency and do not update the throughput.
+	peerScoreMinThroughputBytes = 64 << 10
+	peerCooldownBase            = 5 * time.Second
+	peerCooldownMax             = time.Minute
+	peerScoreExpiry             = time.Hour
+)
+
+// PeerScores keeps a rolling score for every peer the registry fetched
+// content from. Lower scores are better, peers which recently responded with
+// 503 Service Unavailable are cooled down and only tried as a last resort.
+type PeerScores struct {
+	mx        sync.Mutex
+	peers     map[netip.AddrPort]*peerScore
+	now       func() time.Time
+	lastPrune time.Time
+}
+
+type peerScore struct {
+	latency      float64
+	throughput   float64
+	errorRate    float64
+	requests     int64
+	failures     int64
+	unavailable  int64
+	consecutive  int
+	cooldownTill time.Time
+	lastSeen     time.Time
+}
+
+// PeerStats is a snapshot of the score of a peer.
+type PeerStats struct {
+	Peer           string     `json:"peer"`
+	Score          float64    `json:"score"`
+	LatencySeconds float64    `json:"latency_seconds"`
+	Throughput     float64    `json:"throughput_bytes_per_second"`
+	ErrorRate      float64    `json:"error_rate"`
+	Requests       int64      `json:"requests"`
+	Failures       int64      `json:"failures"`
+	Unavailable    int64      `json:"unavailable"`
+	CooldownUntil  *time.Time `json:"cooldown_until,omitempty"`
+	LastSeen       time.Time  `json:"last_seen"`
+}
+
+func NewPeerScores() *PeerScores {
+	return &PeerScores{
+		peers: map[netip.AddrPort]*peerScore{},
+		now:   time.Now,
+	}
+}
+
+func ewma(old, v float64, first bool) float64 {
+	if first {
+		return v
+	}
+	return peerScoreAlpha*v + (1-peerScoreAlpha)*old
+}
+
+// score returns the expected cost in seconds of fetching a blob from the peer.
+func (p *peerScore) score() float64 {
+	cost := p.latency
+	if p.throughput > 0 {
+		cost += peerScoreReferenceSize / p.throughput
+	}
+	return cost * (1 + 9*p.errorRate)
+}
+
+// get must be called with the lock held.
+func (s *PeerScores) get(peer netip.AddrPort) *peerScore {
+	p, ok := s.peers[peer]
+	if !ok {
+		p = &peerScore{}
+		s.peers[peer] = p
+	}
+	p.requests++
+	p.lastSeen = s.now()
+	return p
+}
+
+// ObserveSuccess records a successful request. ttfb is the time until the
+// response header was received, n the bytes transferred in d.
+func (s *PeerScores) ObserveSuccess(peer netip.AddrPort, ttfb time.Duration, n int64, d time.Duration) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	p := s.get(peer)
+	p.latency = ewma(p.latency, ttfb.Seconds(), p.latency == 0)
+	p.errorRate = ewma(p.errorRate, 0, p.requests == 1)
+	if n >= peerScoreMinThroughputBytes && d > 0 {
+		p.throughput = ewma(p.throughput, float64(n)/d.Seconds(), p.throughput == 0)
+	}
+	p.consecutive = 0
+	s.update(peer, p)
+}
+
+// ObserveFailure records a request which failed or returned an unexpected response.
+func (s *PeerScores) ObserveFailure(peer netip.AddrPort) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	p := s.get(peer)
+	p.failures++
+	p.errorRate = ewma(p.errorRate, 1, p.requests == 1)
+	s.update(peer, p)
+}
+
+// ObserveUnavailable records a 503 response, the peer is skipped for a
+// cooldown period which doubles with every consecutive 503.
+func (s *PeerScores) ObserveUnavailable(peer netip.AddrPort) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	p := s.get(peer)
+	p.unavailable++
+	p.consecutive++
+	cooldown := peerCooldownBase << min(p.consecutive-1, 4)
+	p.cooldownTill = s.now().Add(min(cooldown, peerCooldownMax))
+	s.update(peer, p)
+}
+
+// update must be called with the lock held.
+func (s *PeerScores) update(peer netip.AddrPort, p *peerScore) {
+	label := peer.String()
+	metrics.PeerScore.WithLabelValues(label).Set(p.score())
+	metrics.PeerLatency.WithLabelValues(label).Set(p.latency)
+	metrics.PeerThroughput.WithLabelValues(label).Set(p.throughput)
+	metrics.PeerErrorRate.WithLabelValues(label).Set(p.errorRate)
+	s.prune()
+}
+
+// prune forgets peers which have not been used for a while, so that the
+// metrics do not grow with every peer ever seen. Must be called with the lock held.
+func (s *PeerScores) prune() {
+	now := s.now()
+	if now.Sub(s.lastPrune) < time.Minute {
+		return
+	}
+	s.lastPrune = now
+	for peer, p := range s.peers {
+		if now.Sub(p.lastSeen) < peerScoreExpiry {
+			continue
+		}
+		delete(s.peers, peer)
+		label := peer.String()
+		metrics.PeerScore.DeleteLabelValues(label)
+		metrics.PeerLatency.DeleteLabelValues(label)
+		metrics.PeerThroughput.DeleteLabelValues(label)
+		metrics.PeerErrorRate.DeleteLabelValues(label)
+	}
+}
+
+// Order returns the peers sorted by their score. Peers without observations
+// keep their position in the order returned by piccolo, only the peers with
+// observations are sorted among the positions they take. Peers in cooldown
+// are moved to the end.
+func (s *PeerScores) Order(peers []netip.AddrPort) []netip.AddrPort {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	now := s.now()
+	type candidate struct {
+		peer  netip.AddrPort
+		score float64
+	}
+	ordered := make([]netip.AddrPort, 0, len(peers))
+	// Positions in ordered of the peers with observations.
+	slots := []int{}
+	known := []candidate{}
+	cooling := []candidate{}
+	for _, peer := range peers {
+		p, ok := s.peers[peer]
+		switch {
+		case !ok:
+			ordered = append(ordered, peer)
+		case now.Before(p.cooldownTill):
+			cooling = append(cooling, candidate{peer: peer, score: p.score()})
+		default:
+			slots = append(slots, len(ordered))
+			ordered = append(ordered, peer)
+			known = append(known, candidate{peer: peer, score: p.score()})
+		}
+	}
+	byScore := func(a, b candidate) int {
+		return cmp.Compare(a.score, b.score)
+	}
+	slices.SortStableFunc(known, byScore)
+	for i, slot := range slots {
+		ordered[slot] = known[i].peer
+	}
+	slices.SortStableFunc(cooling, byScore)
+	for _, c := range cooling {
+		ordered = append(ordered, c.peer)
+	}
+	return ordered
+}
+
+// Snapshot returns the stats of all known peers, best peers first.
+func (s *PeerScores) Snapshot() []PeerStats {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	now := s.now()
+	stats := make([]PeerStats, 0, len(s.peers))
+	for peer, p := range s.peers {
+		st := PeerStats{
+			Peer:           peer.String(),
+			Score:          p.score(),
+			LatencySeconds: p.latency,
+			Throughput:     p.throughput,
+			ErrorRate:      p.errorRate,
+			Requests:       p.requests,
+			Failures:       p.failures,
+			Unavailable:    p.unavailable,
+			LastSeen:       p.lastSeen,
+		}
+		if now.Before(p.cooldownTill) {
+			cooldownTill := p.cooldownTill
+			st.CooldownUntil = &cooldownTill
+		}
+		stats = append(stats, st)
+	}
+	slices.SortFunc(stats, func(a, b PeerStats) int {
+		switch {
+		case a.Score < b.Score:
+			return -1
+		case a.Score > b.Score:
+			return 1
+		}
+		return 0
+	})
+	return stats
+}
+
+// ServeHTTP writes the snapshot of the peer scores as JSON.
+func (s *PeerScores) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	enc.Encode(s.Snapshot())
+}
+
+// observeError records a request which failed, status is 0 when no response was received.
+func (s *PeerScores) observeError(peer netip.AddrPort, status int) {
+	if status == http.StatusServiceUnavailable {
+		s.ObserveUnavailable(peer)
+		return
+	}
+	s.ObserveFailure(peer)
+}
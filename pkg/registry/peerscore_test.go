@@ -0,0 +1,57 @@
+package registry
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerScoresOrder(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	scores := NewPeerScores()
+	scores.now = func() time.Time { return now }
+
+	unknown := netip.MustParseAddrPort("10.0.0.1:5001")
+	fast := netip.MustParseAddrPort("10.0.0.2:5001")
+	slow := netip.MustParseAddrPort("10.0.0.3:5001")
+	failing := netip.MustParseAddrPort("10.0.0.4:5001")
+	busy := netip.MustParseAddrPort("10.0.0.5:5001")
+
+	scores.ObserveSuccess(fast, 10*time.Millisecond, 100<<20, time.Second)
+	scores.ObserveSuccess(slow, 10*time.Millisecond, 100<<20, 3*time.Second)
+	scores.ObserveSuccess(failing, 10*time.Millisecond, 100<<20, time.Second)
+	scores.ObserveFailure(failing)
+	scores.ObserveFailure(failing)
+	scores.ObserveUnavailable(busy)
+
+	peers := []netip.AddrPort{busy, failing, slow, fast, unknown}
+	require.Equal(t, []netip.AddrPort{fast, slow, failing, unknown, busy}, scores.Order(peers))
+
+	// Peers without observations keep the position piccolo ranked them at.
+	other := netip.MustParseAddrPort("10.0.0.6:5001")
+	require.Equal(t, []netip.AddrPort{unknown, fast, other, slow}, scores.Order([]netip.AddrPort{unknown, slow, other, fast}))
+
+	// The cooldown expires and the busy peer is tried again.
+	now = now.Add(peerCooldownBase)
+	require.Equal(t, []netip.AddrPort{busy, fast, slow, failing, unknown}, scores.Order(peers))
+
+	// Consecutive 503 double the cooldown.
+	scores.ObserveUnavailable(busy)
+	now = now.Add(peerCooldownBase)
+	require.Equal(t, busy, scores.Order(peers)[4])
+
+	stats := map[string]PeerStats{}
+	for _, st := range scores.Snapshot() {
+		stats[st.Peer] = st
+	}
+	require.Len(t, stats, 4)
+	require.Equal(t, int64(3), stats[failing.String()].Requests)
+	require.Equal(t, int64(2), stats[failing.String()].Failures)
+	require.Equal(t, int64(2), stats[busy.String()].Unavailable)
+	require.NotNil(t, stats[busy.String()].CooldownUntil)
+	require.Nil(t, stats[fast.String()].CooldownUntil)
+}
@@ -1,12 +1,16 @@
 package registry
 
 import (
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-logr/logr"
@@ -14,6 +18,7 @@ import (
 
 	"github.com/laixintao/piccolo/internal/mux"
 	"github.com/laixintao/piccolo/internal/ratelimit"
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
 	"github.com/laixintao/piccolo/pkg/metrics"
 	"github.com/laixintao/piccolo/pkg/oci"
 	"github.com/laixintao/piccolo/pkg/sd"
@@ -33,6 +38,19 @@ type PiServer struct {
 	group                   string
 	maxUploadBlobSpeedBytes float64
 	limiter                 *rate.Limiter
+	tlsConfig               *tls.Config
+	draining                atomic.Bool
+	// Bytes of blobs uploaded to peers.
+	uploaded atomic.Int64
+	loadMx   sync.Mutex
+	// Time and uploaded bytes of the last load report.
+	loadAt    time.Time
+	loadBytes int64
+	// Uploads in flight and the upload seconds since the last load report,
+	// accumulated up to uploadsAt.
+	uploads    int
+	uploadTime float64
+	uploadsAt  time.Time
 }
 
 type PiServerOption func(*PiServer)
@@ -51,6 +69,14 @@ func WithMaxUploadBlobSpeedBytes(speed float64) PiServerOption {
 	}
 }
 
+// WithPiServerTLS serves peers over TLS, peers are required to present a
+// client certificate if the configuration verifies client certificates.
+func WithPiServerTLS(cfg *tls.Config) PiServerOption {
+	return func(r *PiServer) {
+		r.tlsConfig = cfg
+	}
+}
+
 func NewPiServer(ociClient oci.Client, group string, log logr.Logger, sd sd.ServiceDiscover, opts ...PiServerOption) *PiServer {
 	r := &PiServer{
 		ociClient:            ociClient,
@@ -63,6 +89,8 @@ func NewPiServer(ociClient oci.Client, group string, log logr.Logger, sd sd.Serv
 		semaphore:            make(chan struct{}, 5),
 		group:                group,
 		limiter:              rate.NewLimiter(rate.Limit(ONE_G_BPS), int(ONE_G_BPS)),
+		loadAt:               time.Now(),
+		uploadsAt:            time.Now(),
 	}
 	for _, opt := range opts {
 		opt(r)
@@ -70,14 +98,58 @@ func NewPiServer(ociClient oci.Client, group string, log logr.Logger, sd sd.Serv
 	return r
 }
 
+// Drain refuses new blob transfers and reports the server as not ready,
+// transfers in flight continue.
+func (r *PiServer) Drain() {
+	r.draining.Store(true)
+}
+
+// Load returns the average uploads and the upload bandwidth used since the
+// last call.
+func (r *PiServer) Load() model.HostLoad {
+	r.loadMx.Lock()
+	defer r.loadMx.Unlock()
+
+	now := time.Now()
+	r.addUploadsLocked(now, 0)
+	uploaded := r.uploaded.Load()
+	uploads := float64(r.uploads)
+	bytesPerSecond := 0.0
+	if elapsed := now.Sub(r.loadAt).Seconds(); elapsed > 0 {
+		uploads = r.uploadTime / elapsed
+		bytesPerSecond = float64(uploaded-r.loadBytes) / elapsed
+	}
+	r.loadAt, r.loadBytes, r.uploadTime = now, uploaded, 0
+	return model.HostLoad{
+		Uploads:                 uploads,
+		MaxUploads:              r.maxUploadConnections,
+		UploadBytesPerSecond:    bytesPerSecond,
+		MaxUploadBytesPerSecond: float64(r.limiter.Limit()),
+	}
+}
+
+func (r *PiServer) addUploads(n int) {
+	r.loadMx.Lock()
+	defer r.loadMx.Unlock()
+	r.addUploadsLocked(time.Now(), n)
+}
+
+// addUploadsLocked must be called with loadMx held.
+func (r *PiServer) addUploadsLocked(now time.Time, n int) {
+	r.uploadTime += float64(r.uploads) * now.Sub(r.uploadsAt).Seconds()
+	r.uploadsAt = now
+	r.uploads += n
+}
+
 func (r *PiServer) Server(addr string) (*http.Server, error) {
 	m, err := mux.NewServeMux(r.handle)
 	if err != nil {
 		return nil, err
 	}
 	srv := &http.Server{
-		Addr:    addr,
-		Handler: m,
+		Addr:      addr,
+		Handler:   m,
+		TLSConfig: r.tlsConfig,
 	}
 	return srv, nil
 }
@@ -151,10 +223,17 @@ func (r *PiServer) registryHandler(rw mux.ResponseWriter, req *http.Request) str
 		r.handleManifest(rw, req, ref)
 		return "manifest"
 	case referenceKindBlob:
+		if r.draining.Load() {
+			// Peers try the next holder on 503.
+			http.Error(rw, "503 Service Unavailable: Draining", http.StatusServiceUnavailable)
+			return "blob"
+		}
 		// rate limit on maxUploadConnections
 		select {
 		case r.semaphore <- struct{}{}:
+			r.addUploads(1)
 			defer func() {
+				r.addUploads(-1)
 				<-r.semaphore
 				metrics.HttpRequestsBlobHandlerInflight.WithLabelValues().Add(-1)
 			}()
@@ -220,13 +299,25 @@ func (r *PiServer) handleBlob(rw mux.ResponseWriter, req *http.Request, ref refe
 	defer rc.Close()
 
 	limitedRC := &ratelimit.RateLimitedReadSeeker{
-		Rs:      rc,
+		Rs:      &countingReadSeeker{ReadSeeker: rc, n: &r.uploaded},
 		Limiter: r.limiter,
 	}
 
 	http.ServeContent(rw, req, "", time.Time{}, limitedRC)
 }
 
+// countingReadSeeker adds the bytes read to n.
+type countingReadSeeker struct {
+	io.ReadSeeker
+	n *atomic.Int64
+}
+
+func (c *countingReadSeeker) Read(p []byte) (int, error) {
+	n, err := c.ReadSeeker.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
 func getClientIP(req *http.Request) string {
 	forwardedFor := req.Header.Get("X-Forwarded-For")
 	if forwardedFor != "" {
@@ -244,6 +335,10 @@ func getClientIP(req *http.Request) string {
 }
 
 func (r *PiServer) readyHandler(rw mux.ResponseWriter, req *http.Request) {
+	if r.draining.Load() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
 	ok, err := r.sd.Ready(req.Context())
 	if err != nil {
 		rw.WriteError(http.StatusInternalServerError, fmt.Errorf("could not determine router readiness: %w", err))
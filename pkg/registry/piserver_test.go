@@ -0,0 +1,66 @@
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+
+	"github.com/laixintao/piccolo/pkg/oci"
+)
+
+func TestPiServerDrain(t *testing.T) {
+	t.Parallel()
+
+	blob := []byte("hello world")
+	dgst := digest.FromBytes(blob)
+	ociClient := oci.NewMemory()
+	ociClient.AddBlob(blob, dgst)
+	piServer := NewPiServer(ociClient, "default", logr.Discard(), &staticDiscover{})
+	srv, err := piServer.Server("")
+	require.NoError(t, err)
+
+	get := func(target string) int {
+		rw := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, target, nil))
+		return rw.Code
+	}
+	blobURL := "http://localhost/v2/library/foo/blobs/" + dgst.String() + "?ns=docker.io"
+	require.Equal(t, http.StatusOK, get("http://localhost/healthz"))
+	require.Equal(t, http.StatusOK, get(blobURL))
+
+	piServer.Drain()
+	require.Equal(t, http.StatusServiceUnavailable, get("http://localhost/healthz"))
+	require.Equal(t, http.StatusServiceUnavailable, get(blobURL))
+}
+
+func TestPiServerLoad(t *testing.T) {
+	t.Parallel()
+
+	blob := []byte("hello world")
+	dgst := digest.FromBytes(blob)
+	ociClient := oci.NewMemory()
+	ociClient.AddBlob(blob, dgst)
+	piServer := NewPiServer(ociClient, "default", logr.Discard(), &staticDiscover{}, WithMaxUploadConnection(3), WithMaxUploadBlobSpeedBytes(1024))
+	srv, err := piServer.Server("")
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/v2/library/foo/blobs/"+dgst.String()+"?ns=docker.io", nil))
+	require.Equal(t, http.StatusOK, rw.Code)
+
+	load := piServer.Load()
+	// The upload counts for the time it was running.
+	require.Greater(t, load.Uploads, 0.0)
+	require.Less(t, load.Uploads, 1.0)
+	require.Equal(t, 3, load.MaxUploads)
+	require.Greater(t, load.UploadBytesPerSecond, 0.0)
+	require.Equal(t, 1024.0, load.MaxUploadBytesPerSecond)
+	// The bandwidth is measured since the last report.
+	load = piServer.Load()
+	require.Zero(t, load.UploadBytesPerSecond)
+	require.Zero(t, load.Uploads)
+}
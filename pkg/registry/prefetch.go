@@ -0,0 +1,246 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/laixintao/piccolo/internal/mux"
+	"github.com/laixintao/piccolo/pkg/metrics"
+	"github.com/laixintao/piccolo/pkg/oci"
+)
+
+const (
+	// How long prefetched holders are used before keys are resolved again.
+	prefetchedHoldersTTL = time.Minute
+	prefetchedHoldersMax = 10000
+	// Manifests larger than this are not parsed for prefetching.
+	manifestRecordLimit = 4 << 20
+	// How long prefetched blobs are kept in the spool for the request.
+	prefetchRetention = 5 * time.Minute
+)
+
+// holderCache keeps the holders of keys resolved ahead of the request, such
+// as the layers of a manifest which was just served.
+type holderCache struct {
+	mx      sync.Mutex
+	entries map[string]holderCacheEntry
+	now     func() time.Time
+}
+
+type holderCacheEntry struct {
+	peers   []netip.AddrPort
+	expires time.Time
+}
+
+func newHolderCache() *holderCache {
+	return &holderCache{
+		entries: map[string]holderCacheEntry{},
+		now:     time.Now,
+	}
+}
+
+func (c *holderCache) get(key string) ([]netip.AddrPort, bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if c.now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.peers, true
+}
+
+func (c *holderCache) set(peers map[string][]netip.AddrPort) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	now := c.now()
+	if len(c.entries)+len(peers) > prefetchedHoldersMax {
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+	}
+	for key, p := range peers {
+		if len(c.entries) >= prefetchedHoldersMax {
+			return
+		}
+		c.entries[key] = holderCacheEntry{peers: p, expires: now.Add(prefetchedHoldersTTL)}
+	}
+}
+
+func (c *holderCache) forget(key string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	delete(c.entries, key)
+}
+
+// resolve returns the peers holding the key, holders prefetched with the
+// manifest are used when available.
+func (r *Registry) resolve(ctx context.Context, key string) ([]netip.AddrPort, error) {
+	if peers, ok := r.holders.get(key); ok {
+		metrics.MirrorPrefetchedHoldersTotal.WithLabelValues("hit").Inc()
+		return peers, nil
+	}
+	metrics.MirrorPrefetchedHoldersTotal.WithLabelValues("miss").Inc()
+	return r.sd.Resolve(ctx, key, r.resolveRetries)
+}
+
+// manifestRecorder keeps a copy of the manifest written to the client, so
+// that the holders of the content it references can be prefetched.
+type manifestRecorder struct {
+	mux.ResponseWriter
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func (m *manifestRecorder) Write(b []byte) (int, error) {
+	if !m.overflow {
+		if m.buf.Len()+len(b) > manifestRecordLimit {
+			m.overflow = true
+			m.buf = bytes.Buffer{}
+		} else {
+			m.buf.Write(b)
+		}
+	}
+	return m.ResponseWriter.Write(b)
+}
+
+func (m *manifestRecorder) Unwrap() http.ResponseWriter {
+	return m.ResponseWriter
+}
+
+// manifest returns the recorded manifest, nil if it was not served or too large.
+func (m *manifestRecorder) manifest() []byte {
+	if m.overflow || m.Status() != http.StatusOK {
+		return nil
+	}
+	return m.buf.Bytes()
+}
+
+// manifestReferences returns the manifests and blobs referenced by the
+// manifest, the media type is determined from the content when the response
+// did not have a known one.
+func manifestReferences(b []byte, mediaType string) ([]digest.Digest, []digest.Digest, error) {
+	if manifests, blobs, err := oci.ManifestReferences(b, mediaType); err == nil {
+		return manifests, blobs, nil
+	}
+	mt, err := oci.DetermineMediaType(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	return oci.ManifestReferences(b, mt)
+}
+
+// prefetchManifest resolves the holders of all content referenced by the
+// manifest in one request, so the blob requests which follow do not have to
+// resolve every blob on its own. When layer prefetching is enabled the blobs
+// are fetched into the spool, so the requests are served from local disk.
+func (r *Registry) prefetchManifest(log logr.Logger, manifestURL url.URL, ref reference, manifest []byte, mediaType string) {
+	manifests, blobs, err := manifestReferences(manifest, mediaType)
+	if err != nil {
+		log.V(4).Info("could not parse manifest for prefetching", "err", err)
+		return
+	}
+	keys := []string{}
+	for _, dgst := range append(manifests, blobs...) {
+		if _, ok := r.holders.get(dgst.String()); ok {
+			continue
+		}
+		keys = append(keys, dgst.String())
+	}
+	if len(keys) > 0 {
+		ctx, cancel := context.WithTimeout(logr.NewContext(context.Background(), log), r.resolveTimeout)
+		peers, err := r.sd.ResolveMany(ctx, keys, r.resolveRetries)
+		cancel()
+		if err != nil {
+			log.Error(err, "could not prefetch holders for manifest", "keys", len(keys))
+		} else {
+			r.holders.set(peers)
+			log.Info("prefetched holders for manifest", "keys", len(keys), "found", len(peers))
+		}
+	}
+
+	if r.prefetchLayers == nil || r.spool == nil {
+		return
+	}
+	for _, dgst := range blobs {
+		if r.prefetchContent != nil {
+			// Content in the local store is not requested by containerd.
+			if _, err := r.prefetchContent.Size(context.Background(), dgst); err == nil {
+				continue
+			}
+		}
+		blobURL := manifestURL
+		blobURL.Path = blobPath(manifestURL.Path, dgst)
+		blobRef := reference{
+			kind:             referenceKindBlob,
+			dgst:             dgst,
+			originalRegistry: ref.originalRegistry,
+		}
+		go r.prefetchBlob(log.WithValues("key", dgst.String()), blobURL, blobRef)
+	}
+}
+
+// blobPath returns the path of the blob in the repository of the manifest path.
+func blobPath(manifestPath string, dgst digest.Digest) string {
+	repository, _, _ := strings.Cut(manifestPath, "/manifests/")
+	return repository + "/blobs/" + dgst.String()
+}
+
+// prefetchBlob fetches the blob into the spool without a client. The content
+// is kept for prefetchRetention after the transfer, requests arriving while
+// the transfer is running or within the retention join it.
+func (r *Registry) prefetchBlob(log logr.Logger, u url.URL, ref reference) {
+	r.prefetchLayers <- struct{}{}
+	defer func() { <-r.prefetchLayers }()
+
+	key := ref.dgst.String()
+	f, leader, err := r.spool.join(ref.dgst)
+	if err != nil {
+		log.Error(err, "could not create spool for prefetched blob")
+		return
+	}
+	if !leader {
+		// The blob is already being fetched.
+		f.leave()
+		return
+	}
+
+	req, err := http.NewRequestWithContext(logr.NewContext(f.ctx, log), http.MethodGet, u.String(), nil)
+	if err != nil {
+		r.spool.complete(f)
+		f.finish(err)
+		f.leave()
+		return
+	}
+	req.Header.Set(MirroredHeaderKey, "true")
+	err = r.fetchFlight(req.Context(), f, req, ref, key)
+	if err != nil {
+		log.Error(err, "could not prefetch blob")
+		metrics.MirrorPrefetchedBlobsTotal.WithLabelValues("fail").Inc()
+		r.spool.complete(f)
+		f.finish(err)
+		f.leave()
+		return
+	}
+	metrics.MirrorPrefetchedBlobsTotal.WithLabelValues("success").Inc()
+	log.Info("prefetched blob into spool", "size", f.size())
+	f.finish(nil)
+	time.AfterFunc(prefetchRetention, func() {
+		r.spool.complete(f)
+		f.leave()
+	})
+}
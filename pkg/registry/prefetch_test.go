@@ -0,0 +1,201 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifestReferences(t *testing.T) {
+	t.Parallel()
+
+	config := digest.FromString("config")
+	layer := digest.FromString("layer")
+	manifest := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: config},
+		Layers:    []ocispec.Descriptor{{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: layer}},
+	}
+	manifest.SchemaVersion = 2
+	b, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	manifests, blobs, err := manifestReferences(b, ocispec.MediaTypeImageManifest)
+	require.NoError(t, err)
+	require.Empty(t, manifests)
+	require.Equal(t, []digest.Digest{config, layer}, blobs)
+	// The media type is determined from the content when unknown.
+	manifests, blobs, err = manifestReferences(b, "application/octet-stream")
+	require.NoError(t, err)
+	require.Empty(t, manifests)
+	require.Equal(t, []digest.Digest{config, layer}, blobs)
+
+	index := ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(b)}},
+	}
+	index.SchemaVersion = 2
+	b, err = json.Marshal(index)
+	require.NoError(t, err)
+	manifests, blobs, err = manifestReferences(b, "")
+	require.NoError(t, err)
+	require.Equal(t, []digest.Digest{index.Manifests[0].Digest}, manifests)
+	require.Empty(t, blobs)
+
+	_, _, err = manifestReferences([]byte("foo"), "")
+	require.Error(t, err)
+}
+
+type testImage struct {
+	manifest     []byte
+	manifestDgst digest.Digest
+	config       []byte
+	configDgst   digest.Digest
+	layer        []byte
+	layerDgst    digest.Digest
+}
+
+func newTestImage(t *testing.T) testImage {
+	t.Helper()
+
+	layer := []byte(strings.Repeat("layer", 100))
+	layerDgst := digest.FromBytes(layer)
+	config := []byte(`{"architecture":"amd64","os":"linux","rootfs":{}}`)
+	configDgst := digest.FromBytes(config)
+	manifest := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: configDgst},
+		Layers:    []ocispec.Descriptor{{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: layerDgst}},
+	}
+	manifest.SchemaVersion = 2
+	b, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	return testImage{
+		manifest:     b,
+		manifestDgst: digest.FromBytes(b),
+		config:       config,
+		configDgst:   configDgst,
+		layer:        layer,
+		layerDgst:    layerDgst,
+	}
+}
+
+// newTestImagePeer serves the image and counts the blob requests by digest.
+func newTestImagePeer(t *testing.T, img testImage) (netip.AddrPort, func(digest.Digest) int) {
+	t.Helper()
+
+	mx := sync.Mutex{}
+	requests := map[digest.Digest]int{}
+	peer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch {
+		case strings.HasSuffix(req.URL.Path, img.manifestDgst.String()):
+			rw.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+			rw.Write(img.manifest)
+			return
+		case strings.HasSuffix(req.URL.Path, img.configDgst.String()):
+			mx.Lock()
+			requests[img.configDgst]++
+			mx.Unlock()
+			http.ServeContent(rw, req, "", time.Time{}, bytes.NewReader(img.config))
+		case strings.HasSuffix(req.URL.Path, img.layerDgst.String()):
+			mx.Lock()
+			requests[img.layerDgst]++
+			mx.Unlock()
+			http.ServeContent(rw, req, "", time.Time{}, bytes.NewReader(img.layer))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(peer.Close)
+	u, err := url.Parse(peer.URL)
+	require.NoError(t, err)
+	return netip.MustParseAddrPort(u.Host), func(dgst digest.Digest) int {
+		mx.Lock()
+		defer mx.Unlock()
+		return requests[dgst]
+	}
+}
+
+func TestPrefetchHoldersForManifest(t *testing.T) {
+	t.Parallel()
+
+	img := newTestImage(t)
+	peer, _ := newTestImagePeer(t, img)
+	sd := &staticDiscover{peers: []netip.AddrPort{peer}}
+	reg := NewRegistry(sd, logr.Discard())
+	srv, err := reg.Server("")
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/v2/library/foo/manifests/"+img.manifestDgst.String()+"?ns=docker.io", nil)
+	srv.Handler.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, img.manifest, rw.Body.Bytes())
+	require.Eventually(t, func() bool {
+		_, ok := reg.holders.get(img.layerDgst.String())
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	sd.mx.Lock()
+	require.Equal(t, [][]string{{img.configDgst.String(), img.layerDgst.String()}}, sd.resolvedMany)
+	require.Equal(t, 1, sd.resolved)
+	sd.mx.Unlock()
+
+	// The blob is served without resolving its holders again.
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "http://localhost/v2/library/foo/blobs/"+img.layerDgst.String()+"?ns=docker.io", nil)
+	srv.Handler.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, img.layer, rw.Body.Bytes())
+	sd.mx.Lock()
+	require.Equal(t, 1, sd.resolved)
+	sd.mx.Unlock()
+}
+
+func TestPrefetchLayersIntoSpool(t *testing.T) {
+	t.Parallel()
+
+	img := newTestImage(t)
+	peer, requests := newTestImagePeer(t, img)
+	sd := &staticDiscover{peers: []netip.AddrPort{peer}}
+	reg := NewRegistry(sd, logr.Discard(), WithSpoolDir(t.TempDir()), WithLayerPrefetch(2, nil))
+	srv, err := reg.Server("")
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/v2/library/foo/manifests/"+img.manifestDgst.String()+"?ns=docker.io", nil)
+	srv.Handler.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Eventually(t, func() bool {
+		return requests(img.configDgst) == 1 && requests(img.layerDgst) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The blobs are served from the spool without another peer request.
+	for _, blob := range [][]byte{img.config, img.layer} {
+		rw = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodGet, "http://localhost/v2/library/foo/blobs/"+digest.FromBytes(blob).String()+"?ns=docker.io", nil)
+		srv.Handler.ServeHTTP(rw, req)
+		require.Equal(t, http.StatusOK, rw.Code)
+		require.Equal(t, blob, rw.Body.Bytes())
+	}
+	require.Equal(t, 1, requests(img.configDgst))
+	require.Equal(t, 1, requests(img.layerDgst))
+}
+
+func TestBlobPath(t *testing.T) {
+	t.Parallel()
+
+	dgst := digest.FromString("foo")
+	require.Equal(t, "/v2/library/foo/blobs/"+dgst.String(), blobPath("/v2/library/foo/manifests/latest", dgst))
+}
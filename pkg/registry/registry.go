@@ -2,6 +2,7 @@ package registry
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -20,6 +21,7 @@ import (
 	"github.com/laixintao/piccolo/internal/httputils"
 	"github.com/laixintao/piccolo/internal/mux"
 	"github.com/laixintao/piccolo/pkg/metrics"
+	"github.com/laixintao/piccolo/pkg/oci"
 	"github.com/laixintao/piccolo/pkg/sd"
 )
 
@@ -36,6 +38,20 @@ type Registry struct {
 	resolveTimeout   time.Duration
 	resolveLatestTag bool
 	semaphore        chan struct{}
+	upstreams        []url.URL
+	upstreamClient   *http.Client
+	ociClient        oci.Client
+	spoolDir         string
+	spool            *spool
+	scores           *PeerScores
+	holders          *holderCache
+	prefetchLayers   chan struct{}
+	prefetchContent  oci.Client
+	peerTLS          *tls.Config
+
+	parallelThreshold int64
+	parallelPeers     int
+	chunkSize         int64
 }
 
 type Option func(*Registry)
@@ -58,12 +74,73 @@ func WithResolveTimeout(resolveTimeout time.Duration) Option {
 	}
 }
 
+// WithPeerTLS makes the registry connect to peers with TLS, presenting the
+// client certificate of the configuration if the peer requires one.
+func WithPeerTLS(cfg *tls.Config) Option {
+	return func(r *Registry) {
+		r.peerTLS = cfg
+	}
+}
+
 func WithTransport(transport http.RoundTripper) Option {
 	return func(r *Registry) {
 		r.transport = transport
 	}
 }
 
+// WithUpstreamFallback makes the registry fetch content from the original
+// registry when no peer in the group is able to serve it.
+func WithUpstreamFallback(registries []url.URL) Option {
+	return func(r *Registry) {
+		r.upstreams = registries
+	}
+}
+
+// WithContentStore writes content fetched from upstream registries into the
+// local content store, so this node can serve it to peers.
+func WithContentStore(ociClient oci.Client) Option {
+	return func(r *Registry) {
+		r.ociClient = ociClient
+	}
+}
+
+// WithSpoolDir enables coalescing of concurrent requests for the same blob,
+// the shared transfer is buffered in files in the given directory.
+func WithSpoolDir(dir string) Option {
+	return func(r *Registry) {
+		r.spoolDir = dir
+	}
+}
+
+// WithPeerScores sets the peer scores used to order peers, so that they can
+// be shared with other components such as the debug endpoint.
+func WithPeerScores(scores *PeerScores) Option {
+	return func(r *Registry) {
+		r.scores = scores
+	}
+}
+
+// WithParallelDownload fetches blobs of at least threshold bytes in chunks of
+// chunkSize from up to peers peers at once.
+func WithParallelDownload(threshold, chunkSize int64, peers int) Option {
+	return func(r *Registry) {
+		r.parallelThreshold = threshold
+		r.chunkSize = chunkSize
+		r.parallelPeers = peers
+	}
+}
+
+// WithLayerPrefetch fetches the blobs referenced by a manifest into the spool
+// as soon as the manifest was served, fetching up to concurrency blobs at
+// once. Blobs present in the content store of client are skipped, client may
+// be nil. Requires a spool directory.
+func WithLayerPrefetch(concurrency int, client oci.Client) Option {
+	return func(r *Registry) {
+		r.prefetchLayers = make(chan struct{}, concurrency)
+		r.prefetchContent = client
+	}
+}
+
 func NewRegistry(sd sd.ServiceDiscover, log logr.Logger, opts ...Option) *Registry {
 	r := &Registry{
 		sd:               sd,
@@ -72,6 +149,8 @@ func NewRegistry(sd sd.ServiceDiscover, log logr.Logger, opts ...Option) *Regist
 		resolveTimeout:   2 * time.Second,
 		resolveLatestTag: true,
 		bufferPool:       buffer.NewBufferPool(),
+		holders:          newHolderCache(),
+		chunkSize:        8 << 20,
 	}
 	for _, opt := range opts {
 		opt(r)
@@ -83,12 +162,28 @@ func NewRegistry(sd sd.ServiceDiscover, log logr.Logger, opts ...Option) *Regist
 			Timeout:   5 * time.Second,
 			KeepAlive: 30 * time.Second,
 		}).DialContext
+		transport.TLSClientConfig = r.peerTLS
 		r.transport = transport
 	}
+	if r.scores == nil {
+		r.scores = NewPeerScores()
+	}
+	if r.upstreamClient == nil {
+		r.upstreamClient = &http.Client{
+			Transport: http.DefaultTransport.(*http.Transport).Clone(),
+		}
+	}
 	return r
 }
 
 func (r *Registry) Server(addr string) (*http.Server, error) {
+	if r.spoolDir != "" {
+		s, err := newSpool(r.spoolDir)
+		if err != nil {
+			return nil, fmt.Errorf("could not create spool directory: %w", err)
+		}
+		r.spool = s
+	}
 	m, err := mux.NewServeMux(r.handle)
 	if err != nil {
 		return nil, err
@@ -179,9 +274,15 @@ func (r *Registry) handleMirror(rw mux.ResponseWriter, req *http.Request, ref re
 
 	log := r.log.WithValues("key", key, "path", req.URL.Path, "ip", getClientIP(req))
 
+	servedByUpstream := false
+	digestMismatch := false
 	defer func() {
 		cacheType := "hit"
-		if rw.Status() != http.StatusOK {
+		if servedByUpstream {
+			cacheType = "upstream"
+		} else if digestMismatch {
+			cacheType = "digest_mismatch"
+		} else if rw.Status() != http.StatusOK {
 			cacheType = "miss"
 		}
 		metrics.MirrorRequestsTotal.WithLabelValues(ref.originalRegistry, cacheType, string(ref.kind)).Inc()
@@ -193,13 +294,38 @@ func (r *Registry) handleMirror(rw mux.ResponseWriter, req *http.Request, ref re
 		return
 	}
 
+	if ref.kind == referenceKindManifest && req.Method == http.MethodGet {
+		recorder := &manifestRecorder{ResponseWriter: rw}
+		rw = recorder
+		manifestURL := *req.URL
+		defer func() {
+			if manifest := recorder.manifest(); manifest != nil {
+				go r.prefetchManifest(log, manifestURL, ref, manifest, recorder.Header().Get("Content-Type"))
+			}
+		}()
+	}
+
+	if r.spool != nil && ref.kind == referenceKindBlob && req.Method == http.MethodGet && req.Header.Get("Range") == "" {
+		upstream, err := r.handleSpooled(rw, req.WithContext(logr.NewContext(req.Context(), log)), ref, key)
+		if err != nil {
+			rw.WriteError(http.StatusNotFound, err)
+			return
+		}
+		servedByUpstream = upstream
+		return
+	}
+
 	// Resolve mirror with the requested key
 	resolveCtx, cancel := context.WithTimeout(req.Context(), r.resolveTimeout)
 	defer cancel()
 	resolveCtx = logr.NewContext(resolveCtx, log)
-	peers, err := r.sd.Resolve(resolveCtx, key, r.resolveRetries)
+	peers, err := r.resolve(resolveCtx, key)
 
 	if err != nil {
+		if r.tryUpstream(rw, req, ref) {
+			servedByUpstream = true
+			return
+		}
 		if errors.Is(err, httputils.ErrNotFound) {
 			rw.WriteError(http.StatusNotFound, err)
 			return
@@ -208,13 +334,66 @@ func (r *Registry) handleMirror(rw mux.ResponseWriter, req *http.Request, ref re
 		return
 	}
 
-	for _, peer := range peers {
-		select {
-		case <-req.Context().Done():
-			// Request has been closed by server or client. No use continuing.
-			rw.WriteError(http.StatusNotFound, fmt.Errorf("mirroring for image component %s has been cancelled: %w", key, resolveCtx.Err()))
+	peers = r.scores.Order(peers)
+	if ref.kind == referenceKindBlob && req.Method == http.MethodGet {
+		t := newBlobTransfer(req, ref.dgst)
+		if t.verifier != nil && r.useParallel(peers) {
+			attempted, err := r.tryParallel(req.Context(), peers, rw, req, t)
+			switch {
+			case attempted && err == nil:
+				r.log.Info("Mirror successfully handled in parallel", "peers", t.peers)
+				return
+			case t.writeErr != nil:
+				log.Error(err, "could not write blob to client")
+				return
+			case errors.Is(err, errDigestMismatch):
+				// Failing over is not possible, see below.
+				log.Error(err, "blob received from peers does not match digest", "peers", t.peers)
+				r.reportDigestMismatch(logr.NewContext(req.Context(), log), ref, key, t.peers)
+				digestMismatch = true
+				return
+			case err != nil:
+				// The remaining content is fetched from a single peer at a time.
+				log.Error(err, "parallel download failed", "received", t.received)
+			}
+		}
+		for _, peer := range peers {
+			if req.Context().Err() != nil {
+				break
+			}
+			err := r.tryBlob(req.Context(), peer, rw, req, t)
+			if err == nil {
+				r.log.Info("Mirror successfully handled", "peers", t.peers)
+				return
+			}
+			if t.writeErr != nil {
+				log.Error(err, "could not write blob to client")
+				return
+			}
+			if errors.Is(err, errDigestMismatch) {
+				// The content already written can not be taken back and the
+				// headers are sent, so failing over to the next peer is not
+				// possible. The held back bytes are dropped so that the client
+				// sees a short read and retries, the request is counted as a
+				// digest mismatch. Only spooled blobs fail over to the next
+				// peer, see --spool-dir.
+				log.Error(err, "blob received from peer does not match digest", "peers", t.peers)
+				r.reportDigestMismatch(logr.NewContext(req.Context(), log), ref, key, t.peers)
+				digestMismatch = true
+				return
+			}
+			log.Error(err, "request failed when try peer", "peer", peer, "written", t.written)
+		}
+		if t.headerSent {
+			// Headers are already written, the client will notice the short read.
+			log.Info("WARN: all peers failed before the blob was completely transferred", "written", t.written)
 			return
-		default:
+		}
+	} else {
+		for _, peer := range peers {
+			if req.Context().Err() != nil {
+				break
+			}
 			err := r.try(peer, rw, req)
 			if err != nil {
 				r.log.Error(err, "request failed when try peer", "peer", peer)
@@ -224,7 +403,16 @@ func (r *Registry) handleMirror(rw mux.ResponseWriter, req *http.Request, ref re
 			}
 		}
 	}
+	if req.Context().Err() != nil {
+		// Request has been closed by server or client. No use continuing.
+		rw.WriteError(http.StatusNotFound, fmt.Errorf("mirroring for image component %s has been cancelled: %w", key, req.Context().Err()))
+		return
+	}
 	r.log.Info("WARN: all peers failed or timeout reached")
+	if r.tryUpstream(rw, req, ref) {
+		servedByUpstream = true
+		return
+	}
 	rw.WriteHeader(http.StatusNotFound)
 }
 
@@ -234,25 +422,26 @@ func (r *Registry) try(peer netip.AddrPort, rw mux.ResponseWriter, req *http.Req
 	// If proxy fails no response is written and it is tried again against a different mirror.
 	// If the response writer has been written to it means that the request was properly proxied.
 	succeeded := false
-	scheme := "http"
-	if req.TLS != nil {
-		scheme = "https"
-	}
+	start := time.Now()
+	var ttfb time.Duration
 	u := &url.URL{
-		Scheme: scheme,
+		Scheme: r.peerScheme(),
 		Host:   peer.String(),
 	}
 	proxy := httputil.NewSingleHostReverseProxy(u)
 	proxy.BufferPool = r.bufferPool
 	proxy.Transport = r.transport
-	proxy.ErrorHandler = func(rw http.ResponseWriter, _ *http.Request, err error) {
+	status := 0
+	proxy.ErrorHandler = func(_ http.ResponseWriter, _ *http.Request, err error) {
 		r.log.Error(err, "request to mirror failed")
-		http.Error(rw, "Bad Gateway: "+err.Error(), http.StatusBadGateway)
+		r.scores.observeError(peer, status)
 	}
 	proxy.ModifyResponse = func(resp *http.Response) error {
+		status = resp.StatusCode
 		if resp.StatusCode != http.StatusOK {
 			return fmt.Errorf("expected mirror to respond with 200 OK but received: %s", resp.Status)
 		}
+		ttfb = time.Since(start)
 		succeeded = true
 		return nil
 	}
@@ -260,5 +449,13 @@ func (r *Registry) try(peer netip.AddrPort, rw mux.ResponseWriter, req *http.Req
 	if !succeeded {
 		return errors.New("Fail to mirror request")
 	}
+	r.scores.ObserveSuccess(peer, ttfb, 0, 0)
 	return nil
 }
+
+func (r *Registry) peerScheme() string {
+	if r.peerTLS != nil {
+		return "https"
+	}
+	return "http"
+}
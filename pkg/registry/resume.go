@@ -0,0 +1,300 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/laixintao/piccolo/internal/mux"
+	"github.com/laixintao/piccolo/pkg/metrics"
+)
+
+var errDigestMismatch = errors.New("content does not match digest")
+
+// blobTransfer tracks how much of a blob response has been delivered to the
+// client, so that a transfer interrupted by a failing peer can be continued
+// from another peer with a range request.
+type blobTransfer struct {
+	// Range requested by the client, end is -1 when open ended.
+	rangeStart int64
+	rangeEnd   int64
+	resumable  bool
+
+	// When the complete blob is requested the content is verified against the
+	// digest. The last byte, or the last chunk when the peer did not send the
+	// size, is held back until the digest is verified, so that the client
+	// never receives a complete blob with wrong content.
+	verifier digest.Verifier
+	expected int64
+	held     []byte
+
+	received   int64
+	written    int64
+	peers      []netip.AddrPort
+	headerSent bool
+	writeErr   error
+}
+
+func newBlobTransfer(req *http.Request, dgst digest.Digest) *blobTransfer {
+	t := &blobTransfer{rangeEnd: -1, resumable: true, expected: -1}
+	h := req.Header.Get("Range")
+	if h == "" {
+		if dgst.Validate() == nil {
+			t.verifier = dgst.Verifier()
+		}
+		return t
+	}
+	start, end, ok := parseSingleRange(h)
+	if !ok {
+		// Suffix and multipart ranges are passed through but can not be resumed.
+		t.resumable = false
+		return t
+	}
+	t.rangeStart = start
+	t.rangeEnd = end
+	return t
+}
+
+// resumeRange returns the Range header value requesting the remaining content.
+func (t *blobTransfer) resumeRange() string {
+	start := strconv.FormatInt(t.rangeStart+t.received, 10)
+	if t.rangeEnd < 0 {
+		return "bytes=" + start + "-"
+	}
+	return "bytes=" + start + "-" + strconv.FormatInt(t.rangeEnd, 10)
+}
+
+// complete verifies the received content and writes the held back bytes.
+func (t *blobTransfer) complete(rw mux.ResponseWriter) error {
+	if t.verifier == nil {
+		return nil
+	}
+	if t.expected >= 0 && t.received != t.expected {
+		return fmt.Errorf("expected %d bytes but received %d", t.expected, t.received)
+	}
+	if !t.verifier.Verified() {
+		return errDigestMismatch
+	}
+	n, err := rw.Write(t.held)
+	t.written += int64(n)
+	if err != nil {
+		t.writeErr = err
+	}
+	return err
+}
+
+// transferWriter counts the bytes written to the client and remembers write
+// errors, which can not be fixed by trying another peer.
+type transferWriter struct {
+	t  *blobTransfer
+	rw mux.ResponseWriter
+}
+
+func (w *transferWriter) Write(p []byte) (int, error) {
+	t := w.t
+	if t.verifier == nil {
+		return w.write(p, p)
+	}
+	t.verifier.Write(p)
+	if t.expected < 0 {
+		// The size is unknown, the last chunk is held back until the body ends.
+		n, err := w.write(p, t.held)
+		t.held = append(t.held[:0], p...)
+		return n, err
+	}
+	out := p
+	if t.expected > 0 && t.received+int64(len(p)) >= t.expected {
+		keep := max(t.expected-1-t.received, 0)
+		t.held = append(t.held, p[keep:]...)
+		out = p[:keep]
+	}
+	return w.write(p, out)
+}
+
+// write writes out to the client and counts p as received.
+func (w *transferWriter) write(p, out []byte) (int, error) {
+	t := w.t
+	t.received += int64(len(p))
+	n, err := w.rw.Write(out)
+	t.written += int64(n)
+	if err != nil {
+		t.writeErr = err
+		return n, err
+	}
+	return len(p), nil
+}
+
+// tryBlob streams the blob from the peer to the client. If part of the blob
+// has already been written by a previous peer only the remaining bytes are
+// requested.
+func (r *Registry) tryBlob(ctx context.Context, peer netip.AddrPort, rw mux.ResponseWriter, req *http.Request, t *blobTransfer) error {
+	resumed := t.headerSent
+	if resumed && !t.resumable {
+		return errors.New("transfer can not be resumed")
+	}
+	outReq := r.peerRequest(ctx, peer, req)
+	if resumed {
+		outReq.Header.Set("Range", t.resumeRange())
+	}
+	start := time.Now()
+	resp, err := r.transport.RoundTrip(outReq)
+	if err != nil {
+		r.scores.ObserveFailure(peer)
+		return err
+	}
+	defer resp.Body.Close()
+	ttfb := time.Since(start)
+
+	if resumed {
+		err := checkResumeResponse(resp, t.rangeStart+t.received)
+		if err != nil {
+			r.scores.observeError(peer, resp.StatusCode)
+			metrics.MirrorResumedTransfersTotal.WithLabelValues("fail").Inc()
+			return err
+		}
+	} else {
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+			r.scores.observeError(peer, resp.StatusCode)
+			return fmt.Errorf("expected mirror to respond with 200 OK but received: %s", resp.Status)
+		}
+		for k, vv := range resp.Header {
+			if _, ok := hopHeaders[k]; ok {
+				continue
+			}
+			rw.Header()[k] = vv
+		}
+		rw.WriteHeader(resp.StatusCode)
+		t.headerSent = true
+		t.expected = resp.ContentLength
+		if resp.StatusCode == http.StatusOK {
+			// The peer ignored the Range of the client and sends the whole
+			// blob, a resume has to continue the whole blob.
+			t.rangeStart, t.rangeEnd, t.resumable = 0, -1, true
+		}
+	}
+	t.peers = append(t.peers, peer)
+
+	buf := r.bufferPool.Get()
+	defer r.bufferPool.Put(buf)
+	copyStart := time.Now()
+	n, err := io.CopyBuffer(&transferWriter{t: t, rw: rw}, resp.Body, buf)
+	if t.writeErr != nil {
+		return t.writeErr
+	}
+	if resumed {
+		status := "success"
+		if err != nil {
+			status = "fail"
+		}
+		metrics.MirrorResumedTransfersTotal.WithLabelValues(status).Inc()
+	}
+	if err == nil {
+		err = t.complete(rw)
+	}
+	if err != nil {
+		r.scores.ObserveFailure(peer)
+		return err
+	}
+	r.scores.ObserveSuccess(peer, ttfb, n, time.Since(copyStart))
+	return nil
+}
+
+// reportDigestMismatch reports the peer which served content not matching
+// the digest to piccolo. When the transfer was resumed the corrupt bytes
+// can not be attributed to a single peer, so nothing is reported.
+func (r *Registry) reportDigestMismatch(ctx context.Context, ref reference, key string, peers []netip.AddrPort) {
+	log := logr.FromContextOrDiscard(ctx)
+	metrics.MirrorDigestMismatchTotal.WithLabelValues(ref.originalRegistry).Inc()
+	r.holders.forget(key)
+	if len(peers) != 1 {
+		log.Info("WARN: digest mismatch after transfer from multiple peers, not reporting", "peers", peers)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), r.resolveTimeout)
+	defer cancel()
+	err := r.sd.ReportBadHolder(ctx, key, peers[0])
+	if err != nil {
+		log.Error(err, "could not report bad holder", "peer", peers[0])
+		return
+	}
+	log.Info("reported bad holder", "peer", peers[0])
+}
+
+// peerRequest returns a copy of the mirror request addressed to the peer.
+func (r *Registry) peerRequest(ctx context.Context, peer netip.AddrPort, req *http.Request) *http.Request {
+	u := *req.URL
+	u.Scheme = r.peerScheme()
+	u.Host = peer.String()
+	outReq := req.Clone(ctx)
+	outReq.URL = &u
+	outReq.Host = ""
+	outReq.RequestURI = ""
+	return outReq
+}
+
+// checkResumeResponse verifies that the peer returned the content starting at offset.
+func checkResumeResponse(resp *http.Response, offset int64) error {
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("expected mirror to respond with 206 Partial Content but received: %s", resp.Status)
+	}
+	start, err := parseContentRangeStart(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return err
+	}
+	if start != offset {
+		return fmt.Errorf("expected mirror to respond with content starting at %d but received %d", offset, start)
+	}
+	return nil
+}
+
+// parseSingleRange parses a Range header of the form bytes=start- or
+// bytes=start-end, end is -1 when open ended.
+func parseSingleRange(h string) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(h, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	startStr, endStr, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok || startStr == "" {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	if endStr == "" {
+		return start, -1, true
+	}
+	end, err := strconv.ParseInt(endStr, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// parseContentRangeStart returns the first byte position of a Content-Range
+// header like bytes 100-199/200.
+func parseContentRangeStart(h string) (int64, error) {
+	spec, ok := strings.CutPrefix(h, "bytes ")
+	if !ok {
+		return 0, fmt.Errorf("invalid content range %q", h)
+	}
+	startStr, _, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, fmt.Errorf("invalid content range %q", h)
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid content range %q: %w", h, err)
+	}
+	return start, nil
+}
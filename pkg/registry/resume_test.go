@@ -0,0 +1,202 @@
+package registry
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSingleRange(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		header string
+		start  int64
+		end    int64
+		ok     bool
+	}{
+		{header: "bytes=0-", start: 0, end: -1, ok: true},
+		{header: "bytes=10-99", start: 10, end: 99, ok: true},
+		{header: "bytes=-100"},
+		{header: "bytes=0-10,20-30"},
+		{header: "bytes=20-10"},
+		{header: "items=0-10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			t.Parallel()
+
+			start, end, ok := parseSingleRange(tt.header)
+			require.Equal(t, tt.ok, ok)
+			require.Equal(t, tt.start, start)
+			require.Equal(t, tt.end, end)
+		})
+	}
+}
+
+func TestResumeBlobFromNextPeer(t *testing.T) {
+	t.Parallel()
+
+	blob := bytes.Repeat([]byte("0123456789"), 10000)
+	dgst := digest.FromBytes(blob)
+
+	// The failing peer sends the headers and half of the blob before dying.
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(blob[:len(blob)/2])
+		rw.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer failing.Close()
+	var ranges []string
+	healthy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ranges = append(ranges, req.Header.Get("Range"))
+		http.ServeContent(rw, req, "", time.Time{}, bytes.NewReader(blob))
+	}))
+	defer healthy.Close()
+
+	peers := []netip.AddrPort{}
+	for _, s := range []*httptest.Server{failing, healthy} {
+		u, err := url.Parse(s.URL)
+		require.NoError(t, err)
+		peers = append(peers, netip.MustParseAddrPort(u.Host))
+	}
+
+	for _, spoolDir := range []string{"", t.TempDir()} {
+		ranges = nil
+		opts := []Option{}
+		if spoolDir != "" {
+			opts = append(opts, WithSpoolDir(spoolDir))
+		}
+		reg := NewRegistry(&staticDiscover{peers: peers}, logr.Discard(), opts...)
+		srv, err := reg.Server("")
+		require.NoError(t, err)
+
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/v2/library/foo/blobs/"+dgst.String()+"?ns=docker.io", nil)
+		srv.Handler.ServeHTTP(rw, req)
+		require.Equal(t, http.StatusOK, rw.Code)
+		b, err := io.ReadAll(rw.Body)
+		require.NoError(t, err)
+		require.Equal(t, dgst, digest.FromBytes(b))
+		require.Equal(t, []string{"bytes=" + strconv.Itoa(len(blob)/2) + "-"}, ranges)
+	}
+}
+
+func TestResumeIgnoredRange(t *testing.T) {
+	t.Parallel()
+
+	blob := bytes.Repeat([]byte("0123456789"), 10000)
+
+	// The failing peer ignores the Range of the client, sends the whole blob
+	// with 200 OK and dies halfway.
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(blob[:len(blob)/2])
+		rw.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer failing.Close()
+	var ranges []string
+	healthy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ranges = append(ranges, req.Header.Get("Range"))
+		http.ServeContent(rw, req, "", time.Time{}, bytes.NewReader(blob))
+	}))
+	defer healthy.Close()
+
+	peers := []netip.AddrPort{}
+	for _, s := range []*httptest.Server{failing, healthy} {
+		u, err := url.Parse(s.URL)
+		require.NoError(t, err)
+		peers = append(peers, netip.MustParseAddrPort(u.Host))
+	}
+	reg := NewRegistry(&staticDiscover{peers: peers}, logr.Discard())
+	srv, err := reg.Server("")
+	require.NoError(t, err)
+
+	dgst := digest.FromBytes(blob)
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/v2/library/foo/blobs/"+dgst.String()+"?ns=docker.io", nil)
+	req.Header.Set("Range", "bytes=100-")
+	srv.Handler.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, dgst, digest.FromBytes(rw.Body.Bytes()))
+	require.Equal(t, []string{"bytes=" + strconv.Itoa(len(blob)/2) + "-"}, ranges)
+}
+
+func TestDigestMismatchReportsHolder(t *testing.T) {
+	t.Parallel()
+
+	blob := bytes.Repeat([]byte("0123456789"), 10000)
+	dgst := digest.FromBytes(blob)
+	corrupt := bytes.Clone(blob)
+	corrupt[len(corrupt)/2] = 'x'
+
+	peer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.ServeContent(rw, req, "", time.Time{}, bytes.NewReader(corrupt))
+	}))
+	defer peer.Close()
+	u, err := url.Parse(peer.URL)
+	require.NoError(t, err)
+	peerAddr := netip.MustParseAddrPort(u.Host)
+
+	for _, spoolDir := range []string{"", t.TempDir()} {
+		opts := []Option{}
+		if spoolDir != "" {
+			opts = append(opts, WithSpoolDir(spoolDir))
+		}
+		sd := &staticDiscover{peers: []netip.AddrPort{peerAddr}}
+		reg := NewRegistry(sd, logr.Discard(), opts...)
+		srv, err := reg.Server("")
+		require.NoError(t, err)
+
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/v2/library/foo/blobs/"+dgst.String()+"?ns=docker.io", nil)
+		srv.Handler.ServeHTTP(rw, req)
+		b, err := io.ReadAll(rw.Body)
+		require.NoError(t, err)
+		require.Less(t, len(b), len(blob))
+		require.Equal(t, []netip.AddrPort{peerAddr}, sd.reported)
+	}
+}
+
+func TestDigestMismatchWithoutContentLength(t *testing.T) {
+	t.Parallel()
+
+	blob := bytes.Repeat([]byte("0123456789"), 10000)
+	dgst := digest.FromBytes(blob)
+	corrupt := bytes.Clone(blob)
+	corrupt[len(corrupt)-1] = 'x'
+
+	// The peer streams the blob chunked, without Content-Length.
+	peer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+		for i := 0; i < len(corrupt); i += 4096 {
+			rw.Write(corrupt[i:min(i+4096, len(corrupt))])
+			rw.(http.Flusher).Flush()
+		}
+	}))
+	defer peer.Close()
+	u, err := url.Parse(peer.URL)
+	require.NoError(t, err)
+
+	reg := NewRegistry(&staticDiscover{peers: []netip.AddrPort{netip.MustParseAddrPort(u.Host)}}, logr.Discard())
+	srv, err := reg.Server("")
+	require.NoError(t, err)
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/v2/library/foo/blobs/"+dgst.String()+"?ns=docker.io", nil)
+	srv.Handler.ServeHTTP(rw, req)
+	require.Less(t, rw.Body.Len(), len(blob))
+}
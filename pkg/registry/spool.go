@@ -0,0 +1,582 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/laixintao/piccolo/internal/mux"
+	"github.com/laixintao/piccolo/pkg/metrics"
+)
+
+const spoolFileSuffix = ".spool"
+
+// spool coalesces concurrent requests for the same blob into a single
+// transfer. The first request for a digest becomes the leader and fetches the
+// content into a file on disk, every request (including the leader) streams
+// the content from that file. The tail of content verified against the digest
+// is held back until it is verified, a corrupt transfer is retried from
+// another peer and the readers which received the corrupt content fail.
+type spool struct {
+	dir     string
+	mx      sync.Mutex
+	flights map[digest.Digest]*flight
+}
+
+func newSpool(dir string) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	// Remove files left behind by a previous run.
+	leftovers, err := filepath.Glob(filepath.Join(dir, "*"+spoolFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range leftovers {
+		if err := os.Remove(p); err != nil {
+			return nil, err
+		}
+	}
+	return &spool{
+		dir:     dir,
+		flights: map[digest.Digest]*flight{},
+	}, nil
+}
+
+// join returns the in progress flight for the digest, or creates a new one.
+// The returned bool is true when the caller is the leader and has to fill the flight.
+func (s *spool) join(dgst digest.Digest) (*flight, bool, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if f, ok := s.flights[dgst]; ok {
+		f.mx.Lock()
+		f.readers++
+		f.mx.Unlock()
+		return f, false, nil
+	}
+	file, err := os.CreateTemp(s.dir, dgst.Encoded()+"-*"+spoolFileSuffix)
+	if err != nil {
+		return nil, false, err
+	}
+	f := newFlight(dgst, file)
+	f.readers = 1
+	s.flights[dgst] = f
+	return f, true, nil
+}
+
+// complete removes the flight so that new requests start a new transfer.
+func (s *spool) complete(f *flight) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.flights[f.dgst] == f {
+		delete(s.flights, f.dgst)
+	}
+}
+
+type flight struct {
+	dgst   digest.Digest
+	file   *os.File
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mx       sync.Mutex
+	cond     *sync.Cond
+	header   http.Header
+	expected int64
+	written  int64
+	// last is the size of the last write, it is held back from the readers
+	// when the size is unknown.
+	last int64
+	// verify is true when the content is verified against the digest.
+	verify bool
+	// resets counts the corrupt transfers dropped with reset.
+	resets   int
+	done     bool
+	err      error
+	readers  int
+	removed  bool
+	upstream bool
+}
+
+func newFlight(dgst digest.Digest, file *os.File) *flight {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &flight{
+		dgst:     dgst,
+		file:     file,
+		ctx:      ctx,
+		cancel:   cancel,
+		expected: -1,
+		verify:   dgst.Validate() == nil,
+	}
+	f.cond = sync.NewCond(&f.mx)
+	return f
+}
+
+// setHeader publishes the response header to the readers. Only the first
+// call has an effect.
+func (f *flight) setHeader(h http.Header) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	if f.header != nil {
+		return
+	}
+	f.header = h
+	if n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil {
+		f.expected = n
+	}
+	f.cond.Broadcast()
+}
+
+func (f *flight) setUpstream() {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	f.upstream = true
+}
+
+func (f *flight) fromUpstream() bool {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	return f.upstream
+}
+
+func (f *flight) Write(p []byte) (int, error) {
+	n, err := f.file.Write(p)
+	f.mx.Lock()
+	f.written += int64(n)
+	f.last = int64(n)
+	f.cond.Broadcast()
+	f.mx.Unlock()
+	return n, err
+}
+
+// reset drops the content written so far, readers which received some of it
+// fail.
+func (f *flight) reset() error {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	if err := f.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	f.written, f.last = 0, 0
+	f.resets++
+	f.cond.Broadcast()
+	return nil
+}
+
+func (f *flight) size() int64 {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	return f.written
+}
+
+// finish marks the transfer as done, a non nil error fails all readers.
+func (f *flight) finish(err error) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	f.done = true
+	f.err = err
+	f.file.Close()
+	f.cond.Broadcast()
+	f.removeIfUnused()
+}
+
+// leave is called when a reader stops reading. The transfer is cancelled
+// when nobody is waiting for it anymore.
+func (f *flight) leave() {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	f.readers--
+	if f.readers > 0 {
+		return
+	}
+	if !f.done {
+		f.cancel()
+	}
+	f.removeIfUnused()
+}
+
+// removeIfUnused must be called with the lock held.
+func (f *flight) removeIfUnused() {
+	if f.removed || !f.done || f.readers > 0 {
+		return
+	}
+	f.removed = true
+	f.cancel()
+	os.Remove(f.file.Name())
+}
+
+// wait blocks until the header is available or the flight failed.
+func (f *flight) wait(ctx context.Context) (http.Header, error) {
+	stop := context.AfterFunc(ctx, f.wake)
+	defer stop()
+
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	for f.header == nil && !f.done && ctx.Err() == nil {
+		f.cond.Wait()
+	}
+	if f.header != nil {
+		return f.header, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return nil, errors.New("flight finished without response")
+}
+
+// available blocks until more than offset bytes are readable or the flight
+// is done. The last byte, or the last write if the size is unknown and the
+// content is verified, is held back until the flight finished successfully.
+// Readers which already read resets content dropped by reset fail.
+func (f *flight) available(ctx context.Context, offset int64, resets int) (int64, bool, error) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	for f.readable() <= offset && !f.done && ctx.Err() == nil && (offset == 0 || f.resets == resets) {
+		f.cond.Wait()
+	}
+	if offset > 0 && f.resets != resets {
+		return 0, true, errDigestMismatch
+	}
+	if ctx.Err() != nil {
+		return f.readable(), true, ctx.Err()
+	}
+	return f.readable(), f.done, f.err
+}
+
+// readable must be called with the lock held.
+func (f *flight) readable() int64 {
+	if f.done && f.err == nil {
+		return f.written
+	}
+	if f.expected > 0 && f.written >= f.expected {
+		return f.expected - 1
+	}
+	if f.verify && f.expected < 0 {
+		return f.written - f.last
+	}
+	return f.written
+}
+
+func (f *flight) resetCount() int {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	return f.resets
+}
+
+func (f *flight) wake() {
+	f.mx.Lock()
+	f.cond.Broadcast()
+	f.mx.Unlock()
+}
+
+// copyTo streams the spooled content to w, following the file while it is
+// being written until the flight is done.
+func (f *flight) copyTo(ctx context.Context, w io.Writer, buf []byte) (int64, error) {
+	stop := context.AfterFunc(ctx, f.wake)
+	defer stop()
+
+	file, err := os.Open(f.file.Name())
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var offset int64
+	resets := f.resetCount()
+	for {
+		written, done, err := f.available(ctx, offset, resets)
+		if offset == 0 {
+			// Nothing was read yet, continue with the content of the next peer.
+			resets = f.resetCount()
+		}
+		for offset < written {
+			n := int64(len(buf))
+			if written-offset < n {
+				n = written - offset
+			}
+			read, rerr := file.ReadAt(buf[:n], offset)
+			if read > 0 {
+				if _, werr := w.Write(buf[:read]); werr != nil {
+					return offset, werr
+				}
+				offset += int64(read)
+			}
+			if errors.Is(rerr, io.EOF) && read == 0 {
+				// The file was truncated by reset.
+				break
+			}
+			if rerr != nil && !errors.Is(rerr, io.EOF) {
+				return offset, rerr
+			}
+		}
+		if err != nil {
+			return offset, err
+		}
+		if done {
+			return offset, nil
+		}
+	}
+}
+
+// handleSpooled serves a blob through the spool, so that concurrent requests
+// for the same digest share one transfer.
+func (r *Registry) handleSpooled(rw mux.ResponseWriter, req *http.Request, ref reference, key string) (bool, error) {
+	log := logr.FromContextOrDiscard(req.Context())
+	f, leader, err := r.spool.join(ref.dgst)
+	if err != nil {
+		return false, fmt.Errorf("could not create spool for %s: %w", key, err)
+	}
+	defer f.leave()
+
+	role := "follower"
+	if leader {
+		role = "leader"
+		fetchReq := req.Clone(logr.NewContext(f.ctx, log))
+		go func() {
+			err := r.fetchFlight(fetchReq.Context(), f, fetchReq, ref, key)
+			r.spool.complete(f)
+			f.finish(err)
+		}()
+	}
+	metrics.MirrorSingleFlightTotal.WithLabelValues(role).Inc()
+	log.Info("joined spooled transfer", "role", role)
+
+	header, err := f.wait(req.Context())
+	if err != nil {
+		return false, fmt.Errorf("could not fetch blob %s: %w", key, err)
+	}
+	for k, vv := range header {
+		rw.Header()[k] = vv
+	}
+	rw.WriteHeader(http.StatusOK)
+
+	buf := r.bufferPool.Get()
+	defer r.bufferPool.Put(buf)
+	_, err = f.copyTo(req.Context(), rw, buf)
+	if err != nil {
+		// Headers are already written, the client will notice the short read.
+		log.Error(err, "error occurred when streaming spooled blob")
+	}
+	return f.fromUpstream(), nil
+}
+
+// fetchFlight fills the flight from the first peer able to serve the blob,
+// falling back to the upstream registry when configured.
+func (r *Registry) fetchFlight(ctx context.Context, f *flight, req *http.Request, ref reference, key string) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	resolveCtx, cancel := context.WithTimeout(ctx, r.resolveTimeout)
+	peers, resolveErr := r.resolve(resolveCtx, key)
+	cancel()
+	peers = r.scores.Order(peers)
+
+	var verifier digest.Verifier
+	if f.verify {
+		verifier = f.dgst.Verifier()
+	}
+	contributors := []netip.AddrPort{}
+	if verifier != nil && r.useParallel(peers) {
+		attempted, err := r.fetchFlightParallel(ctx, f, peers, req, ref, key, verifier)
+		switch {
+		case attempted && err == nil:
+			return nil
+		case errors.Is(err, errDigestMismatch):
+			// Start over with one peer at a time, the tail was not released
+			// to the readers.
+			if err := f.reset(); err != nil {
+				return err
+			}
+			verifier = f.dgst.Verifier()
+		case err != nil:
+			// The remaining content is fetched from a single peer at a time.
+			log.Error(err, "parallel download failed", "written", f.size())
+		}
+	}
+	for _, peer := range peers {
+		// Continue where the previous peer stopped.
+		offset := f.size()
+		start := time.Now()
+		resp, err := r.peerGet(ctx, peer, req, offset)
+		if err != nil {
+			log.Error(err, "request failed when try peer", "peer", peer, "offset", offset)
+			if offset > 0 {
+				metrics.MirrorResumedTransfersTotal.WithLabelValues("fail").Inc()
+			}
+			continue
+		}
+		contributors = append(contributors, peer)
+		var w io.Writer = f
+		if verifier != nil {
+			w = io.MultiWriter(f, verifier)
+		}
+		ttfb := time.Since(start)
+		err = r.spoolResponse(f, resp, w)
+		if offset > 0 {
+			status := "success"
+			if err != nil {
+				status = "fail"
+			}
+			metrics.MirrorResumedTransfersTotal.WithLabelValues(status).Inc()
+		}
+		if err == nil && verifier != nil && !verifier.Verified() {
+			r.scores.ObserveFailure(peer)
+			log.Error(errDigestMismatch, "blob received from peer does not match digest", "peers", contributors)
+			r.reportDigestMismatch(ctx, ref, key, contributors)
+			// The tail was not released to the readers, the next peer starts
+			// over.
+			if err := f.reset(); err != nil {
+				return err
+			}
+			verifier = f.dgst.Verifier()
+			contributors = []netip.AddrPort{}
+			continue
+		}
+		if err == nil {
+			r.scores.ObserveSuccess(peer, ttfb, f.size()-offset, time.Since(start)-ttfb)
+			return nil
+		}
+		r.scores.ObserveFailure(peer)
+		log.Error(err, "spooling from peer failed", "peer", peer, "written", f.size())
+	}
+	if f.size() > 0 {
+		return errors.New("all peers failed before the blob was completely transferred")
+	}
+
+	if len(r.upstreams) > 0 {
+		err := r.fetchFlightUpstream(f, req, ref)
+		status := "success"
+		if err != nil {
+			status = "fail"
+		}
+		metrics.UpstreamRequestsTotal.WithLabelValues(ref.originalRegistry, string(ref.kind), status).Inc()
+		return err
+	}
+	if resolveErr != nil {
+		return resolveErr
+	}
+	return errors.New("all peers failed")
+}
+
+// fetchFlightParallel fills the flight with chunks fetched from several peers
+// at once. It returns false without fetching anything if the blob is too small.
+func (r *Registry) fetchFlightParallel(ctx context.Context, f *flight, peers []netip.AddrPort, req *http.Request, ref reference, key string, verifier digest.Verifier) (bool, error) {
+	log := logr.FromContextOrDiscard(ctx)
+	size, header, err := r.peerHead(ctx, peers[0], req)
+	if err != nil {
+		return false, err
+	}
+	if size < r.parallelThreshold {
+		return false, nil
+	}
+	f.setHeader(header)
+	used, err := r.fetchParallel(ctx, peers, req, size, io.MultiWriter(f, verifier))
+	if err != nil {
+		return true, err
+	}
+	if !verifier.Verified() {
+		log.Error(errDigestMismatch, "blob received from peers does not match digest", "peers", used)
+		r.reportDigestMismatch(ctx, ref, key, used)
+		return true, errDigestMismatch
+	}
+	return true, nil
+}
+
+func (r *Registry) fetchFlightUpstream(f *flight, req *http.Request, ref reference) error {
+	u, ok := r.upstreamURL(ref.originalRegistry)
+	if !ok {
+		return fmt.Errorf("registry %q is not configured to be mirrored", ref.originalRegistry)
+	}
+	u.Path = req.URL.Path
+	resp, err := r.doUpstream(req, u)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return fmt.Errorf("expected upstream to respond with 200 OK but received: %s", resp.Status)
+	}
+	f.setUpstream()
+
+	if r.ociClient == nil || resp.ContentLength <= 0 {
+		return r.spoolResponse(f, resp, f)
+	}
+	desc := ocispec.Descriptor{
+		MediaType: resp.Header.Get("Content-Type"),
+		Digest:    ref.dgst,
+		Size:      resp.ContentLength,
+	}
+	w, finishWrite := r.contentStoreWriter(req.Context(), desc)
+	err = r.spoolResponse(f, resp, io.MultiWriter(f, w))
+	finishWrite(err)
+	return err
+}
+
+func (r *Registry) spoolResponse(f *flight, resp *http.Response, w io.Writer) error {
+	defer resp.Body.Close()
+
+	header := http.Header{}
+	for _, k := range []string{"Content-Type", "Content-Length", "Docker-Content-Digest"} {
+		if v := resp.Header.Get(k); v != "" {
+			header.Set(k, v)
+		}
+	}
+	f.setHeader(header)
+
+	buf := r.bufferPool.Get()
+	defer r.bufferPool.Put(buf)
+	_, err := io.CopyBuffer(w, resp.Body, buf)
+	return err
+}
+
+// peerGet sends the request to the peer and returns the response if the
+// peer responded with the content starting at offset.
+func (r *Registry) peerGet(ctx context.Context, peer netip.AddrPort, req *http.Request, offset int64) (*http.Response, error) {
+	outReq := r.peerRequest(ctx, peer, req)
+	if offset > 0 {
+		outReq.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := r.transport.RoundTrip(outReq)
+	if err != nil {
+		r.scores.ObserveFailure(peer)
+		return nil, err
+	}
+	if offset > 0 {
+		err = checkResumeResponse(resp, offset)
+	} else if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("expected mirror to respond with 200 OK but received: %s", resp.Status)
+	}
+	if err != nil {
+		r.scores.observeError(peer, resp.StatusCode)
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,152 @@
+package registry
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpooledRequestsShareTransfer(t *testing.T) {
+	t.Parallel()
+
+	blob := []byte("hello spool")
+	dgst := digest.FromBytes(blob)
+	release := make(chan struct{})
+	var peerRequests atomic.Int32
+	peer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		peerRequests.Add(1)
+		require.Equal(t, "true", req.Header.Get(MirroredHeaderKey))
+		<-release
+		rw.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+		rw.Write(blob)
+	}))
+	defer peer.Close()
+	peerURL, err := url.Parse(peer.URL)
+	require.NoError(t, err)
+	peerAddr, err := netip.ParseAddrPort(peerURL.Host)
+	require.NoError(t, err)
+
+	spoolDir := t.TempDir()
+	reg := NewRegistry(&staticDiscover{peers: []netip.AddrPort{peerAddr}}, logr.Discard(), WithSpoolDir(spoolDir))
+	srv, err := reg.Server("")
+	require.NoError(t, err)
+
+	clients := 5
+	wg := sync.WaitGroup{}
+	for range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/v2/library/foo/blobs/"+dgst.String()+"?ns=docker.io", nil)
+			srv.Handler.ServeHTTP(rw, req)
+			require.Equal(t, http.StatusOK, rw.Code)
+			b, err := io.ReadAll(rw.Body)
+			require.NoError(t, err)
+			require.Equal(t, blob, b)
+		}()
+	}
+	require.Eventually(t, func() bool {
+		reg.spool.mx.Lock()
+		defer reg.spool.mx.Unlock()
+		f, ok := reg.spool.flights[dgst]
+		if !ok {
+			return false
+		}
+		f.mx.Lock()
+		defer f.mx.Unlock()
+		return f.readers == clients
+	}, 5*time.Second, 10*time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	require.Equal(t, int32(1), peerRequests.Load())
+	require.Eventually(t, func() bool {
+		files, err := os.ReadDir(spoolDir)
+		require.NoError(t, err)
+		return len(files) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSpoolDigestMismatchFailsOver(t *testing.T) {
+	t.Parallel()
+
+	// A one byte blob is held back completely until it is verified, so the
+	// client receives nothing of the corrupt transfer.
+	blob := []byte("s")
+	dgst := digest.FromBytes(blob)
+	corrupt := []byte("x")
+
+	servers := []*httptest.Server{}
+	for _, content := range [][]byte{corrupt, blob} {
+		servers = append(servers, httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			rw.Write(content)
+		})))
+	}
+	peers := []netip.AddrPort{}
+	for _, s := range servers {
+		defer s.Close()
+		u, err := url.Parse(s.URL)
+		require.NoError(t, err)
+		peers = append(peers, netip.MustParseAddrPort(u.Host))
+	}
+
+	sd := &staticDiscover{peers: peers}
+	reg := NewRegistry(sd, logr.Discard(), WithSpoolDir(t.TempDir()))
+	srv, err := reg.Server("")
+	require.NoError(t, err)
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/v2/library/foo/blobs/"+dgst.String()+"?ns=docker.io", nil)
+	srv.Handler.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusOK, rw.Code)
+	require.Equal(t, string(blob), rw.Body.String())
+	require.Equal(t, []netip.AddrPort{peers[0]}, sd.reported)
+}
+
+func TestFlightStreamsUntilReset(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s, err := newSpool(t.TempDir())
+	require.NoError(t, err)
+	f, _, err := s.join(digest.FromBytes([]byte("hello spool")))
+	require.NoError(t, err)
+	f.setHeader(http.Header{})
+
+	// Without Content-Length only the last write is held back.
+	_, err = f.Write([]byte("hello "))
+	require.NoError(t, err)
+	_, err = f.Write([]byte("sp00l"))
+	require.NoError(t, err)
+	readable, done, err := f.available(ctx, 0, 0)
+	require.NoError(t, err)
+	require.False(t, done)
+	require.Equal(t, int64(6), readable)
+
+	// Readers which received some of the dropped content fail, the others
+	// continue with the content of the next peer.
+	require.NoError(t, f.reset())
+	_, _, err = f.available(ctx, 6, 0)
+	require.ErrorIs(t, err, errDigestMismatch)
+	_, err = f.Write([]byte("hello spool"))
+	require.NoError(t, err)
+	f.finish(nil)
+	readable, done, err = f.available(ctx, 0, 0)
+	require.NoError(t, err)
+	require.True(t, done)
+	require.Equal(t, int64(11), readable)
+}
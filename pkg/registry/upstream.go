@@ -0,0 +1,280 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/laixintao/piccolo/internal/mux"
+	"github.com/laixintao/piccolo/pkg/metrics"
+)
+
+// Headers forwarded from the containerd request to the upstream registry.
+var upstreamForwardHeaders = []string{"Accept", "Range", "User-Agent"}
+
+// Hop-by-hop headers which are not copied from the upstream response.
+var hopHeaders = map[string]struct{}{
+	"Connection":        {},
+	"Keep-Alive":        {},
+	"Transfer-Encoding": {},
+	"Upgrade":           {},
+}
+
+// upstreamURL returns the configured upstream registry url for the original
+// registry of a mirrored request.
+func (r *Registry) upstreamURL(originalRegistry string) (url.URL, bool) {
+	for _, u := range r.upstreams {
+		if u.Host != originalRegistry {
+			continue
+		}
+		// docker.io is just an alias, the registry is served from registry-1.docker.io
+		if u.Host == "docker.io" {
+			u.Host = "registry-1.docker.io"
+		}
+		return u, true
+	}
+	return url.URL{}, false
+}
+
+// tryUpstream serves the request from the original registry. It returns false
+// if the request could not be served and no response has been written.
+func (r *Registry) tryUpstream(rw mux.ResponseWriter, req *http.Request, ref reference) bool {
+	if len(r.upstreams) == 0 {
+		return false
+	}
+	log := r.log.WithValues("registry", ref.originalRegistry, "path", req.URL.Path)
+	err := r.handleUpstream(rw, req, ref)
+	status := "success"
+	if err != nil {
+		status = "fail"
+		log.Error(err, "request to upstream registry failed")
+	}
+	metrics.UpstreamRequestsTotal.WithLabelValues(ref.originalRegistry, string(ref.kind), status).Inc()
+	return err == nil
+}
+
+func (r *Registry) handleUpstream(rw mux.ResponseWriter, req *http.Request, ref reference) error {
+	u, ok := r.upstreamURL(ref.originalRegistry)
+	if !ok {
+		return fmt.Errorf("registry %q is not configured to be mirrored", ref.originalRegistry)
+	}
+	u.Path = req.URL.Path
+
+	resp, err := r.doUpstream(req, u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("expected upstream to respond with 200 OK but received: %s", resp.Status)
+	}
+
+	for k, vv := range resp.Header {
+		if _, ok := hopHeaders[k]; ok {
+			continue
+		}
+		for _, v := range vv {
+			rw.Header().Add(k, v)
+		}
+	}
+	rw.WriteHeader(resp.StatusCode)
+	if req.Method == http.MethodHead {
+		return nil
+	}
+
+	var dst io.Writer = rw
+	var finishWrite func(copyErr error)
+	if r.ociClient != nil && ref.dgst != "" && resp.StatusCode == http.StatusOK && resp.ContentLength > 0 {
+		desc := ocispec.Descriptor{
+			MediaType: resp.Header.Get("Content-Type"),
+			Digest:    ref.dgst,
+			Size:      resp.ContentLength,
+		}
+		var w io.Writer
+		w, finishWrite = r.contentStoreWriter(req.Context(), desc)
+		dst = io.MultiWriter(rw, w)
+	}
+
+	buf := r.bufferPool.Get()
+	defer r.bufferPool.Put(buf)
+	_, err = io.CopyBuffer(dst, resp.Body, buf)
+	if finishWrite != nil {
+		finishWrite(err)
+	}
+	if err != nil {
+		// Headers are already written, the client will notice the short read.
+		r.log.Error(err, "error occurred when copying upstream response", "path", req.URL.Path)
+	}
+	return nil
+}
+
+// contentStoreWriter returns a writer which stores the content in the local
+// content store in the background. Failing to store the content never fails
+// the response to the client.
+func (r *Registry) contentStoreWriter(ctx context.Context, desc ocispec.Descriptor) (io.Writer, func(error)) {
+	log := r.log.WithValues("digest", desc.Digest.String())
+	pr, pw := io.Pipe()
+	errCh := make(chan error, 1)
+	go func() {
+		err := r.ociClient.WriteBlob(ctx, desc, pr)
+		pr.CloseWithError(err)
+		errCh <- err
+	}()
+	finish := func(copyErr error) {
+		pw.CloseWithError(copyErr)
+		if err := <-errCh; err != nil {
+			log.Error(err, "could not write upstream content to content store")
+			return
+		}
+		if copyErr == nil {
+			log.Info("upstream content written to content store", "size", desc.Size)
+		}
+	}
+	return &bestEffortWriter{w: pw}, finish
+}
+
+// bestEffortWriter stops writing after the first error without reporting it,
+// so that it can be used with io.MultiWriter without failing other writers.
+type bestEffortWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (b *bestEffortWriter) Write(p []byte) (int, error) {
+	if b.err == nil {
+		_, b.err = b.w.Write(p)
+	}
+	return len(p), nil
+}
+
+func (r *Registry) doUpstream(req *http.Request, u url.URL) (*http.Response, error) {
+	newRequest := func(token string) (*http.Request, error) {
+		upReq, err := http.NewRequestWithContext(req.Context(), req.Method, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range upstreamForwardHeaders {
+			if v := req.Header.Values(h); len(v) > 0 {
+				upReq.Header[h] = v
+			}
+		}
+		if token != "" {
+			upReq.Header.Set("Authorization", "Bearer "+token)
+		}
+		return upReq, nil
+	}
+
+	upReq, err := newRequest("")
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.upstreamClient.Do(upReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	token, err := r.fetchUpstreamToken(req.Context(), challenge)
+	if err != nil {
+		return nil, err
+	}
+	upReq, err = newRequest(token)
+	if err != nil {
+		return nil, err
+	}
+	return r.upstreamClient.Do(upReq)
+}
+
+// fetchUpstreamToken requests an anonymous pull token as described by the
+// bearer challenge returned from the registry.
+func (r *Registry) fetchUpstreamToken(ctx context.Context, challenge string) (string, error) {
+	params, err := parseBearerChallenge(challenge)
+	if err != nil {
+		return "", err
+	}
+	realm, ok := params["realm"]
+	if !ok {
+		return "", fmt.Errorf("authentication challenge %q is missing realm", challenge)
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	for _, k := range []string{"service", "scope"} {
+		if v, ok := params[k]; ok {
+			q.Set(k, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := r.upstreamClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("expected token endpoint to respond with 200 OK but received: %s", resp.Status)
+	}
+	tokenResp := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", err
+	}
+	if tokenResp.Token != "" {
+		return tokenResp.Token, nil
+	}
+	if tokenResp.AccessToken != "" {
+		return tokenResp.AccessToken, nil
+	}
+	return "", errors.New("token endpoint returned an empty token")
+}
+
+// parseBearerChallenge parses a header like
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull"
+func parseBearerChallenge(header string) (map[string]string, error) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return nil, fmt.Errorf("unsupported authentication challenge %q", header)
+	}
+	params := map[string]string{}
+	for {
+		rest = strings.TrimLeft(rest, " ,")
+		if rest == "" {
+			return params, nil
+		}
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed authentication challenge %q", header)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				return nil, fmt.Errorf("malformed authentication challenge %q", header)
+			}
+			params[key] = value[1 : end+1]
+			rest = value[end+2:]
+			continue
+		}
+		value, rest, _ = strings.Cut(value, ",")
+		params[key] = strings.TrimSpace(value)
+	}
+}
@@ -0,0 +1,166 @@
+package registry
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+
+	"github.com/laixintao/piccolo/internal/httputils"
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
+	"github.com/laixintao/piccolo/pkg/oci"
+)
+
+type staticDiscover struct {
+	peers []netip.AddrPort
+
+	mx           sync.Mutex
+	reported     []netip.AddrPort
+	resolved     int
+	resolvedMany [][]string
+}
+
+func (s *staticDiscover) Ready(ctx context.Context) (bool, error) {
+	return true, nil
+}
+
+func (s *staticDiscover) Resolve(ctx context.Context, key string, count int) ([]netip.AddrPort, error) {
+	s.mx.Lock()
+	s.resolved++
+	s.mx.Unlock()
+	if len(s.peers) == 0 {
+		return nil, httputils.ErrNotFound
+	}
+	return s.peers, nil
+}
+
+func (s *staticDiscover) ResolveMany(ctx context.Context, keys []string, count int) (map[string][]netip.AddrPort, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.resolvedMany = append(s.resolvedMany, keys)
+	peers := map[string][]netip.AddrPort{}
+	if len(s.peers) == 0 {
+		return peers, nil
+	}
+	for _, key := range keys {
+		peers[key] = s.peers
+	}
+	return peers, nil
+}
+
+func (s *staticDiscover) Advertise(ctx context.Context, keys []string) error {
+	return nil
+}
+
+func (s *staticDiscover) Sync(ctx context.Context, keys []string, generation uint64) error {
+	return nil
+}
+
+func (s *staticDiscover) SyncDelta(ctx context.Context, baseGeneration, generation uint64, added, removed []string) error {
+	return nil
+}
+
+func (s *staticDiscover) Withdraw(ctx context.Context, keys []string) error {
+	return nil
+}
+
+func (s *staticDiscover) DoKeepAlive(ctx context.Context) error {
+	return nil
+}
+
+func (s *staticDiscover) ReportLoad(ctx context.Context) error {
+	return nil
+}
+
+func (s *staticDiscover) Deregister(ctx context.Context) error {
+	return nil
+}
+
+func (s *staticDiscover) ReportBadHolder(ctx context.Context, key string, holder netip.AddrPort) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.reported = append(s.reported, holder)
+	return nil
+}
+
+func (s *staticDiscover) PendingPrepulls(ctx context.Context) ([]model.Prepull, error) {
+	return nil, nil
+}
+
+func (s *staticDiscover) ReportPrepull(ctx context.Context, id uint, status, message string) error {
+	return nil
+}
+
+func TestParseBearerChallenge(t *testing.T) {
+	t.Parallel()
+
+	params, err := parseBearerChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull,push"`)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:library/nginx:pull,push",
+	}, params)
+
+	_, err = parseBearerChallenge(`Basic realm="foo"`)
+	require.EqualError(t, err, `unsupported authentication challenge "Basic realm=\"foo\""`)
+}
+
+func TestUpstreamFallback(t *testing.T) {
+	t.Parallel()
+
+	blob := []byte("hello upstream")
+	dgst := digest.FromBytes(blob)
+
+	var upstream *httptest.Server
+	upstream = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/token":
+			require.Equal(t, "repository:library/foo:pull", req.URL.Query().Get("scope"))
+			rw.Write([]byte(`{"token": "secret"}`))
+		case "/v2/library/foo/blobs/" + dgst.String():
+			if req.Header.Get("Authorization") != "Bearer secret" {
+				rw.Header().Set("WWW-Authenticate", `Bearer realm="`+upstream.URL+`/token",scope="repository:library/foo:pull"`)
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			rw.Header().Set("Content-Type", "application/octet-stream")
+			rw.Write(blob)
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	ociClient := oci.NewMemory()
+	reg := NewRegistry(&staticDiscover{}, logr.Discard(), WithUpstreamFallback([]url.URL{*upstreamURL}), WithContentStore(ociClient))
+	srv, err := reg.Server("")
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/v2/library/foo/blobs/"+dgst.String()+"?ns="+upstreamURL.Host, nil)
+	srv.Handler.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusOK, rw.Code)
+	b, err := io.ReadAll(rw.Body)
+	require.NoError(t, err)
+	require.Equal(t, blob, b)
+
+	size, err := ociClient.Size(context.TODO(), dgst)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(blob)), size)
+
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "http://localhost/v2/library/foo/blobs/"+dgst.String()+"?ns=example.com", nil)
+	srv.Handler.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusNotFound, rw.Code)
+}
@@ -2,7 +2,9 @@ package sd
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -25,20 +27,86 @@ import (
 type ServiceDiscover interface {
 	Ready(ctx context.Context) (bool, error)
 	Resolve(ctx context.Context, key string, count int) ([]netip.AddrPort, error)
+	// ResolveMany returns the peers of every key which has peers.
+	ResolveMany(ctx context.Context, keys []string, count int) (map[string][]netip.AddrPort, error)
 	Advertise(ctx context.Context, keys []string) error
-	Sync(ctx context.Context, keys []string) error
+	// Sync replaces all keys of this host, deltas are based on generation afterwards.
+	Sync(ctx context.Context, keys []string, generation uint64) error
+	// SyncDelta applies the keys added and removed since baseGeneration,
+	// ErrFullSyncRequired is returned if piccolo has another generation.
+	SyncDelta(ctx context.Context, baseGeneration, generation uint64, added, removed []string) error
 	DoKeepAlive(ctx context.Context) error
+	// ReportLoad sends the upload load without a keepalive, it does nothing
+	// without WithLoad.
+	ReportLoad(ctx context.Context) error
+	// Deregister removes this host and all of its keys from piccolo.
+	Deregister(ctx context.Context) error
+	// Withdraw removes keys this host no longer has.
+	Withdraw(ctx context.Context, keys []string) error
+	ReportBadHolder(ctx context.Context, key string, holder netip.AddrPort) error
+	// PendingPrepulls returns the images this host should pull ahead of time.
+	PendingPrepulls(ctx context.Context) ([]model.Prepull, error)
+	ReportPrepull(ctx context.Context, id uint, status, message string) error
 }
 
+var ErrFullSyncRequired = errors.New("full sync required")
+
 type PiccoloServiceDiscover struct {
 	piccoloAddress url.URL
 	log            logr.Logger
 	httpClient     *http.Client
 	piAddr         string
 	group          string
+	token          string
+	labels         model.Labels
+	load           func() model.HostLoad
 }
 
-func NewPiccoloServiceDiscover(piccoloAddress url.URL, log logr.Logger, piAddr string, group string) (*PiccoloServiceDiscover, error) {
+type Option func(*options)
+
+type options struct {
+	tlsConfig *tls.Config
+	token     string
+	labels    model.Labels
+	load      func() model.HostLoad
+}
+
+// WithTLSConfig sets the TLS configuration used to connect to piccolo.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(o *options) {
+		o.tlsConfig = cfg
+	}
+}
+
+// WithLabels sets the topology labels of this host, they are reported with
+// keepalive and sync and sent with lookups so that piccolo ranks holders
+// close to this host first.
+func WithLabels(labels model.Labels) Option {
+	return func(o *options) {
+		o.labels = labels
+	}
+}
+
+// WithLoad reports the upload load returned by load with keepalive and
+// ReportLoad, piccolo sends fewer peers to loaded hosts.
+func WithLoad(load func() model.HostLoad) Option {
+	return func(o *options) {
+		o.load = load
+	}
+}
+
+// WithToken sets the bearer token sent to piccolo to authorize writes for the group.
+func WithToken(token string) Option {
+	return func(o *options) {
+		o.token = token
+	}
+}
+
+func NewPiccoloServiceDiscover(piccoloAddress url.URL, log logr.Logger, piAddr string, group string, opts ...Option) (*PiccoloServiceDiscover, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
 	httpClient := &http.Client{
 		Transport: &http.Transport{
 			Proxy: http.ProxyFromEnvironment,
@@ -52,6 +120,7 @@ func NewPiccoloServiceDiscover(piccoloAddress url.URL, log logr.Logger, piAddr s
 			IdleConnTimeout:       90 * time.Second,
 			TLSHandshakeTimeout:   5 * time.Second,
 			ExpectContinueTimeout: 1 * time.Second,
+			TLSClientConfig:       o.tlsConfig,
 		},
 	}
 	return &PiccoloServiceDiscover{
@@ -60,9 +129,20 @@ func NewPiccoloServiceDiscover(piccoloAddress url.URL, log logr.Logger, piAddr s
 		httpClient:     httpClient,
 		piAddr:         piAddr,
 		group:          group,
+		token:          o.token,
+		labels:         o.labels,
+		load:           o.load,
 	}, nil
 }
 
+// headers returns the request headers with the authorization header if a token is set.
+func (p PiccoloServiceDiscover) headers(headers map[string]string) map[string]string {
+	if p.token != "" {
+		headers["Authorization"] = "Bearer " + p.token
+	}
+	return headers
+}
+
 func (p PiccoloServiceDiscover) Ready(ctx context.Context) (bool, error) {
 	return true, nil
 }
@@ -76,6 +156,7 @@ func (p PiccoloServiceDiscover) Advertise(ctx context.Context, keys []string) er
 		Holder: p.piAddr,
 		Keys:   keys,
 		Group:  p.group,
+		Labels: p.labels,
 	}
 	body, err := json.Marshal(request)
 	if err != nil {
@@ -85,10 +166,10 @@ func (p PiccoloServiceDiscover) Advertise(ctx context.Context, keys []string) er
 		"POST",
 		url.String(),
 		body,
-		map[string]string{
+		p.headers(map[string]string{
 			"Content-Type": "application/json",
 			"Accept":       "application/json",
-		},
+		}),
 		10*time.Second,
 		60*time.Second,
 		p.httpClient,
@@ -109,6 +190,17 @@ func (p PiccoloServiceDiscover) Advertise(ctx context.Context, keys []string) er
 	return nil
 }
 
+// requestHost returns the host of piAddr, holders are sorted by their
+// distance to it.
+func (p PiccoloServiceDiscover) requestHost() string {
+	host, _, err := net.SplitHostPort(p.piAddr)
+	if err != nil {
+		// piAddr without port.
+		return strings.TrimSuffix(strings.TrimPrefix(p.piAddr, "["), "]")
+	}
+	return host
+}
+
 func (p PiccoloServiceDiscover) Resolve(ctx context.Context, key string, count int) ([]netip.AddrPort, error) {
 	p.log.Info("Resolve key", "key", key, "count", count)
 	deadline, _ := ctx.Deadline()
@@ -120,7 +212,10 @@ func (p PiccoloServiceDiscover) Resolve(ctx context.Context, key string, count i
 	params.Add("group", p.group)
 	params.Add("key", key)
 	params.Add("count", strconv.Itoa(count))
-	params.Add("request_host", strings.Split(p.piAddr, ":")[0])
+	params.Add("request_host", p.requestHost())
+	if len(p.labels) > 0 {
+		params.Add("labels", p.labels.String())
+	}
 	u.RawQuery = params.Encode()
 
 	resolveTimer := prometheus.NewTimer(metrics.ResolveDurHistogram.WithLabelValues())
@@ -128,9 +223,9 @@ func (p PiccoloServiceDiscover) Resolve(ctx context.Context, key string, count i
 		"GET",
 		u.String(),
 		nil,
-		map[string]string{
+		p.headers(map[string]string{
 			"Accept": "application/json",
-		},
+		}),
 		1*time.Second,
 		5*time.Second,
 		p.httpClient,
@@ -160,15 +255,73 @@ func (p PiccoloServiceDiscover) Resolve(ctx context.Context, key string, count i
 	return addrPorts, nil
 }
 
-func (p PiccoloServiceDiscover) Sync(ctx context.Context, keys []string) error {
+func (p PiccoloServiceDiscover) ResolveMany(ctx context.Context, keys []string, count int) (map[string][]netip.AddrPort, error) {
+	log := logr.FromContextOrDiscard(ctx)
+	u := p.piccoloAddress
+	u.Path = path.Join(u.Path, "api", "v1", "distribution", "findkeys")
+	request := model.FindKeysRequest{
+		Keys:        keys,
+		Group:       p.group,
+		Count:       count,
+		RequestHost: p.requestHost(),
+		Labels:      p.labels,
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	resolveTimer := prometheus.NewTimer(metrics.ResolveDurHistogram.WithLabelValues())
+	resp, err := httputils.DoRequestWithRetry(ctx,
+		"POST",
+		u.String(),
+		body,
+		p.headers(map[string]string{
+			"Content-Type": "application/json",
+			"Accept":       "application/json",
+		}),
+		1*time.Second,
+		5*time.Second,
+		p.httpClient,
+	)
+	resolveTimer.ObserveDuration()
+	if err != nil {
+		log.Error(err, "ResolveMany error", "requestAddress", u.String())
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var findkeysResp model.FindKeysResponse
+	if err := json.NewDecoder(resp.Body).Decode(&findkeysResp); err != nil {
+		return nil, err
+	}
+	peers := map[string][]netip.AddrPort{}
+	for key, holders := range findkeysResp.Holders {
+		for _, h := range holders {
+			ap, err := netip.ParseAddrPort(h)
+			if err != nil {
+				log.Error(err, "Can not convert to net.AddrPort", "host", h)
+				continue
+			}
+			peers[key] = append(peers[key], ap)
+		}
+	}
+	log.Info("ResolveMany done", "keys", len(keys), "found", len(peers))
+
+	return peers, nil
+}
+
+func (p PiccoloServiceDiscover) Sync(ctx context.Context, keys []string, generation uint64) error {
 	log := logr.FromContextOrDiscard(ctx)
 	log.Info("Sync keys...", "keys", keys)
 	url := p.piccoloAddress
 	url.Path = path.Join(url.Path, "api", "v1", "distribution", "sync")
 	request := model.ImageAdvertiseRequest{
-		Holder: p.piAddr,
-		Keys:   keys,
-		Group:  p.group,
+		Holder:     p.piAddr,
+		Keys:       keys,
+		Group:      p.group,
+		Generation: generation,
+		Labels:     p.labels,
 	}
 	body, err := json.Marshal(request)
 	if err != nil {
@@ -178,10 +331,10 @@ func (p PiccoloServiceDiscover) Sync(ctx context.Context, keys []string) error {
 		"POST",
 		url.String(),
 		body,
-		map[string]string{
+		p.headers(map[string]string{
 			"Content-Type": "application/json",
 			"Accept":       "application/json",
-		},
+		}),
 		10*time.Second,
 		90*time.Second,
 		p.httpClient,
@@ -202,13 +355,67 @@ func (p PiccoloServiceDiscover) Sync(ctx context.Context, keys []string) error {
 	return nil
 }
 
+func (p PiccoloServiceDiscover) SyncDelta(ctx context.Context, baseGeneration, generation uint64, added, removed []string) error {
+	log := logr.FromContextOrDiscard(ctx)
+	log.Info("Sync delta...", "added", len(added), "removed", len(removed), "baseGeneration", baseGeneration)
+	url := p.piccoloAddress
+	url.Path = path.Join(url.Path, "api", "v1", "distribution", "syncdelta")
+	request := model.SyncDeltaRequest{
+		Holder:         p.piAddr,
+		Group:          p.group,
+		BaseGeneration: baseGeneration,
+		Generation:     generation,
+		Added:          added,
+		Removed:        removed,
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := httputils.DoRequestWithRetry(ctx,
+		"POST",
+		url.String(),
+		body,
+		p.headers(map[string]string{
+			"Content-Type": "application/json",
+			"Accept":       "application/json",
+		}),
+		10*time.Second,
+		60*time.Second,
+		p.httpClient,
+	)
+	// Piccolo versions without deltas do not know the endpoint.
+	if errors.Is(err, httputils.ErrConflict) || errors.Is(err, httputils.ErrNotFound) {
+		return errors.Join(ErrFullSyncRequired, err)
+	}
+	if err != nil {
+		log.Error(err, "Sync delta error")
+		return err
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Error(err, "Failed to read response body")
+		return err
+	}
+	log.Info("Sync delta done", "response", string(responseBody))
+
+	return nil
+}
+
 func (p PiccoloServiceDiscover) DoKeepAlive(ctx context.Context) error {
 	log := logr.FromContextOrDiscard(ctx)
 	url := p.piccoloAddress
 	url.Path = path.Join(url.Path, "api", "v1", "keepalive")
 	request := model.KeepAliveRequest{
 		HostAddr: p.piAddr,
-		Group: p.group,
+		Group:    p.group,
+		Labels:   p.labels,
+	}
+	if p.load != nil {
+		load := p.load()
+		request.Load = &load
 	}
 	body, err := json.Marshal(request)
 	if err != nil {
@@ -218,10 +425,10 @@ func (p PiccoloServiceDiscover) DoKeepAlive(ctx context.Context) error {
 		"POST",
 		url.String(),
 		body,
-		map[string]string{
+		p.headers(map[string]string{
 			"Content-Type": "application/json",
 			"Accept":       "application/json",
-		},
+		}),
 		1*time.Second,
 		10*time.Second,
 		p.httpClient,
@@ -242,3 +449,242 @@ func (p PiccoloServiceDiscover) DoKeepAlive(ctx context.Context) error {
 
 	return nil
 }
+
+func (p PiccoloServiceDiscover) ReportLoad(ctx context.Context) error {
+	if p.load == nil {
+		return nil
+	}
+	log := logr.FromContextOrDiscard(ctx)
+	url := p.piccoloAddress
+	url.Path = path.Join(url.Path, "api", "v1", "load")
+	request := model.ReportLoadRequest{
+		HostAddr: p.piAddr,
+		Group:    p.group,
+		Load:     p.load(),
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := httputils.DoRequestWithRetry(ctx,
+		"POST",
+		url.String(),
+		body,
+		p.headers(map[string]string{
+			"Content-Type": "application/json",
+			"Accept":       "application/json",
+		}),
+		1*time.Second,
+		10*time.Second,
+		p.httpClient,
+	)
+	if err != nil {
+		log.Error(err, "Report load error", "requestBody", body)
+		return err
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
+
+func (p PiccoloServiceDiscover) Withdraw(ctx context.Context, keys []string) error {
+	log := logr.FromContextOrDiscard(ctx)
+	log.Info("Withdraw keys...", "keys", keys)
+	url := p.piccoloAddress
+	url.Path = path.Join(url.Path, "api", "v1", "distribution", "withdraw")
+	request := model.WithdrawRequest{
+		Holder: p.piAddr,
+		Keys:   keys,
+		Group:  p.group,
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := httputils.DoRequestWithRetry(ctx,
+		"POST",
+		url.String(),
+		body,
+		p.headers(map[string]string{
+			"Content-Type": "application/json",
+			"Accept":       "application/json",
+		}),
+		10*time.Second,
+		60*time.Second,
+		p.httpClient,
+	)
+	if err != nil {
+		log.Error(err, "Withdraw error")
+		return err
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Error(err, "Failed to read response body")
+		return err
+	}
+	log.Info("Withdraw done", "response", string(responseBody))
+
+	return nil
+}
+
+// ReportBadHolder tells piccolo that the holder served content which does
+// not match the key, so that it is no longer returned for the key.
+func (p PiccoloServiceDiscover) ReportBadHolder(ctx context.Context, key string, holder netip.AddrPort) error {
+	log := logr.FromContextOrDiscard(ctx)
+	url := p.piccoloAddress
+	url.Path = path.Join(url.Path, "api", "v1", "distribution", "report")
+	request := model.ReportBadHolderRequest{
+		Key:      key,
+		Holder:   holder.String(),
+		Group:    p.group,
+		Reporter: p.piAddr,
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := httputils.DoRequestWithRetry(ctx,
+		"POST",
+		url.String(),
+		body,
+		p.headers(map[string]string{
+			"Content-Type": "application/json",
+			"Accept":       "application/json",
+		}),
+		1*time.Second,
+		5*time.Second,
+		p.httpClient,
+	)
+	if err != nil {
+		log.Error(err, "Report bad holder error", "requestBody", body)
+		return err
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Error(err, "Failed to read response body")
+		return err
+	}
+	log.Info("Report bad holder done", "key", key, "holder", holder, "response", string(responseBody))
+
+	return nil
+}
+
+func (p PiccoloServiceDiscover) PendingPrepulls(ctx context.Context) ([]model.Prepull, error) {
+	log := logr.FromContextOrDiscard(ctx)
+	u := p.piccoloAddress
+	u.Path = path.Join(u.Path, "api", "v1", "prepull", "pending")
+	params := url.Values{}
+	params.Add("group", p.group)
+	params.Add("host", p.piAddr)
+	u.RawQuery = params.Encode()
+	resp, err := httputils.DoRequestWithRetry(ctx,
+		"GET",
+		u.String(),
+		nil,
+		p.headers(map[string]string{
+			"Accept": "application/json",
+		}),
+		5*time.Second,
+		15*time.Second,
+		p.httpClient,
+	)
+	if err != nil {
+		log.Error(err, "Pending prepulls error", "requestAddress", u.String())
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var pendingResp model.PendingPrepullsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&pendingResp); err != nil {
+		return nil, err
+	}
+	return pendingResp.Prepulls, nil
+}
+
+// ReportPrepull records the progress of the prepull on this host.
+func (p PiccoloServiceDiscover) ReportPrepull(ctx context.Context, id uint, status, message string) error {
+	log := logr.FromContextOrDiscard(ctx)
+	url := p.piccoloAddress
+	url.Path = path.Join(url.Path, "api", "v1", "prepull", "status")
+	request := model.PrepullStatusRequest{
+		PrepullID: id,
+		Host:      p.piAddr,
+		Group:     p.group,
+		Status:    status,
+		Message:   message,
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := httputils.DoRequestWithRetry(ctx,
+		"POST",
+		url.String(),
+		body,
+		p.headers(map[string]string{
+			"Content-Type": "application/json",
+			"Accept":       "application/json",
+		}),
+		5*time.Second,
+		30*time.Second,
+		p.httpClient,
+	)
+	if err != nil {
+		log.Error(err, "Report prepull error", "requestBody", body)
+		return err
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Error(err, "Failed to read response body")
+		return err
+	}
+	log.Info("Report prepull done", "id", id, "status", status, "response", string(responseBody))
+
+	return nil
+}
+
+func (p PiccoloServiceDiscover) Deregister(ctx context.Context) error {
+	log := logr.FromContextOrDiscard(ctx)
+	url := p.piccoloAddress
+	url.Path = path.Join(url.Path, "api", "v1", "deregister")
+	request := model.DeregisterRequest{
+		HostAddr: p.piAddr,
+		Group:    p.group,
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := httputils.DoRequestWithRetry(ctx,
+		"POST",
+		url.String(),
+		body,
+		p.headers(map[string]string{
+			"Content-Type": "application/json",
+			"Accept":       "application/json",
+		}),
+		5*time.Second,
+		15*time.Second,
+		p.httpClient,
+	)
+	if err != nil {
+		log.Error(err, "Deregister error", "requestBody", body)
+		return err
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Error(err, "Failed to read response body")
+		return err
+	}
+	log.Info("Deregister done", "response", string(responseBody))
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var indexBucket = []byte("images")
+
+// imageIndex maps the name of every local image to the keys advertised for
+// it. Containerd does not tell the digest of a deleted image, the index
+// tells which keys are no longer referenced by any image instead. The index
+// is persisted across restarts when a path is set.
+type imageIndex struct {
+	mx     sync.Mutex
+	images map[string][]string
+	db     *bolt.DB
+}
+
+func openImageIndex(path string) (*imageIndex, error) {
+	idx := &imageIndex{images: map[string][]string{}}
+	if path == "" {
+		return idx, nil
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open image index %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(indexBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var keys []string
+			if err := json.Unmarshal(v, &keys); err != nil {
+				return err
+			}
+			idx.images[string(k)] = keys
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not load image index %s: %w", path, err)
+	}
+	idx.db = db
+	return idx, nil
+}
+
+func (i *imageIndex) Close() error {
+	if i.db == nil {
+		return nil
+	}
+	return i.db.Close()
+}
+
+func (i *imageIndex) put(name string, keys []string) error {
+	i.mx.Lock()
+	defer i.mx.Unlock()
+
+	i.images[name] = keys
+	if i.db == nil {
+		return nil
+	}
+	v, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	return i.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(indexBucket).Put([]byte(name), v)
+	})
+}
+
+// replace replaces the index with the images of a full listing.
+func (i *imageIndex) replace(images map[string][]string) error {
+	i.mx.Lock()
+	defer i.mx.Unlock()
+
+	i.images = images
+	if i.db == nil {
+		return nil
+	}
+	return i.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(indexBucket); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucket(indexBucket)
+		if err != nil {
+			return err
+		}
+		for name, keys := range images {
+			v, err := json.Marshal(keys)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(name), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// remove removes the image and returns its keys which no other image
+// references, false if the image is not in the index.
+func (i *imageIndex) remove(name string) ([]string, bool, error) {
+	i.mx.Lock()
+	defer i.mx.Unlock()
+
+	keys, ok := i.images[name]
+	if !ok {
+		return nil, false, nil
+	}
+	delete(i.images, name)
+	if i.db != nil {
+		err := i.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(indexBucket).Delete([]byte(name))
+		})
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	referenced := map[string]struct{}{}
+	for _, other := range i.images {
+		for _, key := range other {
+			referenced[key] = struct{}{}
+		}
+	}
+	unreferenced := []string{}
+	for _, key := range keys {
+		if _, ok := referenced[key]; !ok {
+			unreferenced = append(unreferenced, key)
+		}
+	}
+	return unreferenced, true, nil
+}
@@ -0,0 +1,44 @@
+package state
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestImageIndex(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "index.db")
+	idx, err := openImageIndex(path)
+	require.NoError(t, err)
+	err = idx.replace(map[string][]string{
+		"docker.io/library/foo:1": {"docker.io/library/foo:1", "sha256:a", "sha256:shared"},
+		"docker.io/library/bar:1": {"docker.io/library/bar:1", "sha256:b", "sha256:shared"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, idx.put("docker.io/library/baz:1", []string{"docker.io/library/baz:1", "sha256:a"}))
+
+	keys, ok, err := idx.remove("docker.io/library/foo:1")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []string{"docker.io/library/foo:1"}, keys)
+	_, ok, err = idx.remove("docker.io/library/foo:1")
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.NoError(t, idx.Close())
+
+	// The index survives a restart.
+	idx, err = openImageIndex(path)
+	require.NoError(t, err)
+	defer idx.Close()
+	keys, ok, err = idx.remove("docker.io/library/bar:1")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.ElementsMatch(t, []string{"docker.io/library/bar:1", "sha256:b", "sha256:shared"}, keys)
+	keys, ok, err = idx.remove("docker.io/library/baz:1")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.ElementsMatch(t, []string{"docker.io/library/baz:1", "sha256:a"}, keys)
+}
@@ -0,0 +1,39 @@
+package state
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/laixintao/piccolo/internal/randduration"
+	"github.com/laixintao/piccolo/pkg/sd"
+)
+
+// ReportLoad reports the upload load of this host to piccolo every interval,
+// keepalive is too rare for piccolo to balance findkey by recent load.
+func ReportLoad(ctx context.Context, sd sd.ServiceDiscover, interval time.Duration) error {
+	log := logr.FromContextOrDiscard(ctx)
+	log.Info("Start reporting load", "interval", interval)
+
+	// random delay avoid all same Pi reporting at the same time
+	select {
+	case <-time.After(randduration.RandomDuration(interval)):
+	case <-ctx.Done():
+		return nil
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := sd.ReportLoad(ctx); err != nil {
+			log.Error(err, "could not report load")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
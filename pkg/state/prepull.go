@@ -0,0 +1,78 @@
+package state
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/laixintao/piccolo/internal/randduration"
+	"github.com/laixintao/piccolo/pkg/distributionapi/model"
+	"github.com/laixintao/piccolo/pkg/metrics"
+	"github.com/laixintao/piccolo/pkg/oci"
+	"github.com/laixintao/piccolo/pkg/sd"
+)
+
+const PREPULL_TIMEOUT = 30 * time.Minute
+
+// Prepull polls piccolo for images to pull ahead of time and pulls them one
+// after another through containerd, reporting the progress back to piccolo.
+func Prepull(ctx context.Context, ociClient oci.Client, sd sd.ServiceDiscover, interval time.Duration) error {
+	log := logr.FromContextOrDiscard(ctx)
+	log.Info("Start polling prepulls", "interval", interval)
+
+	// random delay avoid all same Pi polling at the same time
+	select {
+	case <-time.After(randduration.RandomDuration(interval)):
+	case <-ctx.Done():
+		return nil
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		prepulls, err := sd.PendingPrepulls(ctx)
+		if err != nil {
+			log.Error(err, "could not get pending prepulls")
+		}
+		for _, p := range prepulls {
+			if ctx.Err() != nil {
+				return nil
+			}
+			prepull(ctx, ociClient, sd, p.ID, p.Image)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func prepull(ctx context.Context, ociClient oci.Client, sd sd.ServiceDiscover, id uint, image string) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("id", id, "image", image)
+	log.Info("Prepull image")
+	if err := sd.ReportPrepull(ctx, id, model.PrepullStatusPulling, ""); err != nil {
+		log.Error(err, "could not report prepull progress")
+	}
+
+	pullCtx, cancel := context.WithTimeout(ctx, PREPULL_TIMEOUT)
+	err := ociClient.Pull(pullCtx, image)
+	cancel()
+	if ctx.Err() != nil {
+		// Shutting down, the prepull is picked up again after a restart.
+		return
+	}
+	status, message := model.PrepullStatusDone, ""
+	if err != nil {
+		log.Error(err, "prepull failed")
+		status, message = model.PrepullStatusFailed, err.Error()
+	} else {
+		log.Info("Prepull done")
+	}
+	metrics.PrepullsTotal.WithLabelValues(status).Inc()
+	if err := sd.ReportPrepull(ctx, id, status, message); err != nil {
+		log.Error(err, "could not report prepull result")
+	}
+}
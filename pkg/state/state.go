@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
@@ -22,17 +23,38 @@ const (
 
 func Track(ctx context.Context, ociClient oci.Client, sd sd.ServiceDiscover,
 	fullRefreshMinutes int64,
-	resolveLatestTag bool) error {
+	resolveLatestTag bool,
+	indexPath string) error {
 	log := logr.FromContextOrDiscard(ctx)
 
+	index, err := openImageIndex(indexPath)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+	syncer := newKeySyncer(sd)
+
 	log.Info("Start periodic updates channel.", "durationMinutes", fullRefreshMinutes)
 
 	fullUpdatesCh := make(chan string, 10)
-	go fullUpdateProcessor(fullUpdatesCh, ctx, ociClient, sd, resolveLatestTag)
+	// The index is closed only after the background goroutines stopped.
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		fullUpdateProcessor(fullUpdatesCh, ctx, ociClient, index, syncer, resolveLatestTag)
+	}()
 
 	// random delay avoid all same Pi updates at the same time
-	go startIntervalSync(ctx, fullRefreshMinutes, fullUpdatesCh)
-	go startKeepAlive(ctx, sd)
+	go func() {
+		defer wg.Done()
+		startIntervalSync(ctx, fullRefreshMinutes, fullUpdatesCh)
+	}()
+	go func() {
+		defer wg.Done()
+		startKeepAlive(ctx, sd)
+	}()
 
 	for {
 		ociCtx, calcenOciClient := context.WithCancel(ctx)
@@ -49,6 +71,7 @@ func Track(ctx context.Context, ociClient oci.Client, sd sd.ServiceDiscover,
 			for {
 				select {
 				case <-ctx.Done():
+					calcenOciClient()
 					return nil
 
 				case event, ok := <-eventCh:
@@ -56,16 +79,28 @@ func Track(ctx context.Context, ociClient oci.Client, sd sd.ServiceDiscover,
 						log.Info("eventCh closed, restart the subscriber")
 						break SubscribeLoop
 					}
-					log.Info("received image event", "image", event.Image.String(), "type", event.Type)
 					metrics.ContainerdSubscribeEventTotal.WithLabelValues(string(event.Type)).Add(1)
+					// Content removed by garbage collection can no longer be served.
+					if event.Type == oci.ContentDeleteEvent {
+						log.Info("received content delete event", "digest", event.Digest)
+						if err := syncer.withdraw(ctx, []string{event.Digest.String()}); err != nil {
+							log.Error(err, "could not withdraw deleted content", "digest", event.Digest)
+						}
+						continue
+					}
+					log.Info("received image event", "image", event.Image.String(), "type", event.Type)
 
-					// Delete event will trigger full upates...
+					// Delete events withdraw the keys no other image references,
+					// a full update is triggered if they are not known.
 					if event.Type == oci.DeleteEvent {
-						fullUpdatesCh <- "deleteEvent"
+						if err := remove(ctx, index, syncer, event.ImageName); err != nil {
+							log.Info("could not withdraw keys of deleted image, trigger full update", "image", event.ImageName, "reason", err.Error())
+							triggerFullUpdate(ctx, fullUpdatesCh, "deleteEvent")
+						}
 						continue
 					}
 
-					if _, err := update(ctx, ociClient, sd, event, false, resolveLatestTag); err != nil {
+					if _, err := update(ctx, ociClient, syncer, index, event, false, resolveLatestTag); err != nil {
 						log.Error(err, "received error when updating image")
 						continue
 					}
@@ -105,7 +140,7 @@ func Track(ctx context.Context, ociClient oci.Client, sd sd.ServiceDiscover,
 
 // if full updates triggered (less than) MAX_DELETION_EVENTS in FULLUPDATE_WAITTIME
 // the full update will only be called once.
-func fullUpdateProcessor(events <-chan string, ctx context.Context, ociClient oci.Client, sd sd.ServiceDiscover, resolveLatestTag bool) {
+func fullUpdateProcessor(events <-chan string, ctx context.Context, ociClient oci.Client, index *imageIndex, syncer *keySyncer, resolveLatestTag bool) {
 	var buffer []string
 	log := logr.FromContextOrDiscard(ctx)
 	timer := time.NewTimer(FULLUPDATE_WAITTIME)
@@ -113,7 +148,7 @@ func fullUpdateProcessor(events <-chan string, ctx context.Context, ociClient oc
 
 	flush := func() {
 		if len(buffer) > 0 {
-			all(ctx, ociClient, sd, resolveLatestTag)
+			all(ctx, ociClient, index, syncer, resolveLatestTag)
 			buffer = nil
 			timer.Stop()
 		}
@@ -133,11 +168,22 @@ func fullUpdateProcessor(events <-chan string, ctx context.Context, ociClient oc
 		case <-timer.C:
 			log.Info("Full updated triggered due to wait time passed since last event", "lenBuffer", len(buffer), "waitTime", FULLUPDATE_WAITTIME, "buffer", buffer)
 			flush()
+		case <-ctx.Done():
+			timer.Stop()
+			return
 		}
 	}
 }
 
-func all(ctx context.Context, ociClient oci.Client, sd sd.ServiceDiscover, resolveLatestTag bool) error {
+// triggerFullUpdate queues a full update unless the tracker is stopping.
+func triggerFullUpdate(ctx context.Context, fullUpdatesCh chan<- string, reason string) {
+	select {
+	case fullUpdatesCh <- reason:
+	case <-ctx.Done():
+	}
+}
+
+func all(ctx context.Context, ociClient oci.Client, index *imageIndex, syncer *keySyncer, resolveLatestTag bool) error {
 	log := logr.FromContextOrDiscard(ctx).V(4)
 	imgs, err := ociClient.ListImages(ctx)
 	log.Info("Exeucte a full updates, list images: ", "imgs", imgs)
@@ -151,44 +197,51 @@ func all(ctx context.Context, ociClient oci.Client, sd sd.ServiceDiscover, resol
 	metrics.AdvertisedImageTags.Reset()
 	metrics.AdvertisedImageDigests.Reset()
 	errs := []error{}
-	targets := map[string]interface{}{}
+	// Digests of the images already walked.
+	walked := map[string][]string{}
 	keys := map[string]string{}
+	imageKeys := map[string][]string{}
 	for _, img := range imgs {
-		_, skipDigests := targets[img.Digest.String()]
-
+		imgKeys := []string{}
 		if !(!resolveLatestTag && img.IsLatestTag()) {
 			if tagName, ok := img.TagName(); ok {
 				keys[tagName] = img.Registry
+				imgKeys = append(imgKeys, tagName)
 				metrics.AdvertisedImageDigests.WithLabelValues(img.Registry).Add(1)
 			}
 		}
 
-		if !skipDigests {
-			dgsts, err := oci.WalkImage(ctx, ociClient, img)
+		dgsts, ok := walked[img.Digest.String()]
+		if !ok {
+			dgsts, err = oci.WalkImage(ctx, ociClient, img)
 			if err != nil {
 				errs = append(errs, err)
 			}
 			for _, d := range dgsts {
 				keys[d] = img.Registry
 			}
+			walked[img.Digest.String()] = dgsts
 		}
-		targets[img.Digest.String()] = img.Registry
+		imageKeys[img.Name] = append(imgKeys, dgsts...)
 		metrics.AdvertisedImages.WithLabelValues(img.Registry).Add(1)
 	}
+	if err := index.replace(imageKeys); err != nil {
+		errs = append(errs, fmt.Errorf("could not update image index: %w", err))
+	}
 	keyList := []string{}
 	for key, reg := range keys {
 		keyList = append(keyList, key)
 		metrics.AdvertisedKeys.WithLabelValues(reg).Add(1)
 	}
 	log.Info("Sync all images", "totalKeys", len(keyList))
-	err = sd.Sync(ctx, keyList)
+	err = syncer.sync(ctx, keyList)
 	if err != nil {
 		return err
 	}
 	return errors.Join(errs...)
 }
 
-func update(ctx context.Context, ociClient oci.Client, sd sd.ServiceDiscover, event oci.ImageEvent, skipDigests, resolveLatestTag bool) (int, error) {
+func update(ctx context.Context, ociClient oci.Client, syncer *keySyncer, index *imageIndex, event oci.ImageEvent, skipDigests, resolveLatestTag bool) (int, error) {
 	keys := []string{}
 	if !(!resolveLatestTag && event.Image.IsLatestTag()) {
 		if tagName, ok := event.Image.TagName(); ok {
@@ -207,7 +260,12 @@ func update(ctx context.Context, ociClient oci.Client, sd sd.ServiceDiscover, ev
 		}
 		keys = append(keys, dgsts...)
 	}
-	err := sd.Advertise(ctx, keys)
+	if !skipDigests {
+		if err := index.put(event.Image.Name, keys); err != nil {
+			return 0, fmt.Errorf("could not index image %s: %w", event.Image.String(), err)
+		}
+	}
+	err := syncer.advertise(ctx, keys)
 	if err != nil {
 		return 0, fmt.Errorf("could not advertise image %s: %w", event.Image.String(), err)
 	}
@@ -224,6 +282,22 @@ func update(ctx context.Context, ociClient oci.Client, sd sd.ServiceDiscover, ev
 	return len(keys), nil
 }
 
+// remove withdraws the keys of the deleted image which no other image references.
+func remove(ctx context.Context, index *imageIndex, syncer *keySyncer, name string) error {
+	keys, ok, err := index.remove(name)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("image %s is not in the index", name)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	logr.FromContextOrDiscard(ctx).Info("Withdraw keys of deleted image", "image", name, "keys", len(keys))
+	return syncer.withdraw(ctx, keys)
+}
+
 func startIntervalSync(ctx context.Context, intervalMinutes int64, fullUpdatesCh chan<- string) {
 	log := logr.FromContextOrDiscard(ctx)
 	interval := time.Duration(intervalMinutes) * time.Minute
@@ -238,7 +312,7 @@ func startIntervalSync(ctx context.Context, intervalMinutes int64, fullUpdatesCh
 	}
 
 	log.Info("Interval update first trigger full sync, then trigger for every", "minutes", intervalMinutes)
-	fullUpdatesCh <- "ticker"
+	triggerFullUpdate(ctx, fullUpdatesCh, "ticker")
 
 	// update for const interval
 	expirationTicker := time.NewTicker(interval)
@@ -248,7 +322,7 @@ func startIntervalSync(ctx context.Context, intervalMinutes int64, fullUpdatesCh
 		select {
 		case <-expirationTicker.C:
 			log.Info("By Ticker: Running scheduled image state update")
-			fullUpdatesCh <- "ticker"
+			triggerFullUpdate(ctx, fullUpdatesCh, "ticker")
 		case <-ctx.Done():
 			return
 		}
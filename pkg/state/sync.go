@@ -0,0 +1,107 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/laixintao/piccolo/pkg/sd"
+)
+
+// keySyncer sends the keys of this host to piccolo. After the first full
+// sync only the keys added and removed since the generation piccolo
+// acknowledged last are sent, piccolo asks for a full sync when its
+// generation diverged, e.g. after the host was evicted.
+type keySyncer struct {
+	mx         sync.Mutex
+	sd         sd.ServiceDiscover
+	generation uint64
+	// keys acknowledged by piccolo with generation, nil before the first sync.
+	keys map[string]struct{}
+}
+
+func newKeySyncer(sd sd.ServiceDiscover) *keySyncer {
+	return &keySyncer{
+		sd: sd,
+		// Generations of earlier runs must not match, so that a restarted pi starts with a full sync.
+		generation: uint64(time.Now().UnixNano()),
+	}
+}
+
+func (s *keySyncer) sync(ctx context.Context, keys []string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	log := logr.FromContextOrDiscard(ctx)
+	current := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		current[key] = struct{}{}
+	}
+	next := s.generation + 1
+
+	if s.keys != nil {
+		added, removed := []string{}, []string{}
+		for key := range current {
+			if _, ok := s.keys[key]; !ok {
+				added = append(added, key)
+			}
+		}
+		for key := range s.keys {
+			if _, ok := current[key]; !ok {
+				removed = append(removed, key)
+			}
+		}
+		// An empty delta is still sent, it tells whether piccolo lost the keys of this host.
+		err := s.sd.SyncDelta(ctx, s.generation, next, added, removed)
+		if err == nil {
+			s.keys, s.generation = current, next
+			return nil
+		}
+		if !errors.Is(err, sd.ErrFullSyncRequired) {
+			return err
+		}
+		log.Info("Generation diverged from piccolo, sync all keys", "generation", s.generation)
+	}
+
+	if err := s.sd.Sync(ctx, keys, next); err != nil {
+		return err
+	}
+	s.keys, s.generation = current, next
+	return nil
+}
+
+// advertise adds the keys to piccolo without listing all images. The
+// generation does not change, the keys are added to the keys acknowledged by
+// piccolo so that the next delta removes them once they are gone. They are
+// added even if advertising failed, piccolo could have stored them anyway.
+func (s *keySyncer) advertise(ctx context.Context, keys []string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	err := s.sd.Advertise(ctx, keys)
+	if s.keys != nil {
+		for _, key := range keys {
+			s.keys[key] = struct{}{}
+		}
+	}
+	return err
+}
+
+// withdraw removes the keys from piccolo without listing all images. The
+// generation does not change, the keys are only dropped from the keys
+// acknowledged by piccolo.
+func (s *keySyncer) withdraw(ctx context.Context, keys []string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if err := s.sd.Withdraw(ctx, keys); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		delete(s.keys, key)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/laixintao/piccolo/internal/httputils"
+	"github.com/laixintao/piccolo/pkg/sd"
+)
+
+type syncCall struct {
+	full           bool
+	baseGeneration uint64
+	generation     uint64
+	keys           []string
+	added          []string
+	removed        []string
+}
+
+type fakeSyncSD struct {
+	sd.ServiceDiscover
+	deltaErr     error
+	advertiseErr error
+	calls        []syncCall
+}
+
+func (f *fakeSyncSD) Advertise(ctx context.Context, keys []string) error {
+	return f.advertiseErr
+}
+
+func (f *fakeSyncSD) Sync(ctx context.Context, keys []string, generation uint64) error {
+	f.calls = append(f.calls, syncCall{full: true, generation: generation, keys: slices.Sorted(slices.Values(keys))})
+	return nil
+}
+
+func (f *fakeSyncSD) SyncDelta(ctx context.Context, baseGeneration, generation uint64, added, removed []string) error {
+	f.calls = append(f.calls, syncCall{
+		baseGeneration: baseGeneration,
+		generation:     generation,
+		added:          slices.Sorted(slices.Values(added)),
+		removed:        slices.Sorted(slices.Values(removed)),
+	})
+	return f.deltaErr
+}
+
+func TestKeySyncer(t *testing.T) {
+	t.Parallel()
+
+	errFailed := errors.New("connection refused")
+	tests := []struct {
+		name           string
+		acknowledged   []string
+		deltaErr       error
+		keys           []string
+		expectedCalls  []syncCall
+		expectedErr    error
+		expectedGen    uint64
+		expectedKeySet []string
+	}{
+		{
+			name:           "first sync is full",
+			keys:           []string{"b", "a"},
+			expectedCalls:  []syncCall{{full: true, generation: 11, keys: []string{"a", "b"}}},
+			expectedGen:    11,
+			expectedKeySet: []string{"a", "b"},
+		},
+		{
+			name:           "delta",
+			acknowledged:   []string{"a", "b"},
+			keys:           []string{"b", "c"},
+			expectedCalls:  []syncCall{{baseGeneration: 10, generation: 11, added: []string{"c"}, removed: []string{"a"}}},
+			expectedGen:    11,
+			expectedKeySet: []string{"b", "c"},
+		},
+		{
+			name:           "empty delta",
+			acknowledged:   []string{"a"},
+			keys:           []string{"a"},
+			expectedCalls:  []syncCall{{baseGeneration: 10, generation: 11}},
+			expectedGen:    11,
+			expectedKeySet: []string{"a"},
+		},
+		{
+			name:         "generation diverged",
+			acknowledged: []string{"a"},
+			deltaErr:     errors.Join(sd.ErrFullSyncRequired, httputils.ErrConflict),
+			keys:         []string{"b"},
+			expectedCalls: []syncCall{
+				{baseGeneration: 10, generation: 11, added: []string{"b"}, removed: []string{"a"}},
+				{full: true, generation: 11, keys: []string{"b"}},
+			},
+			expectedGen:    11,
+			expectedKeySet: []string{"b"},
+		},
+		{
+			name:         "piccolo without deltas",
+			acknowledged: []string{"a"},
+			deltaErr:     errors.Join(sd.ErrFullSyncRequired, httputils.ErrNotFound),
+			keys:         []string{"a", "b"},
+			expectedCalls: []syncCall{
+				{baseGeneration: 10, generation: 11, added: []string{"b"}},
+				{full: true, generation: 11, keys: []string{"a", "b"}},
+			},
+			expectedGen:    11,
+			expectedKeySet: []string{"a", "b"},
+		},
+		{
+			name:           "other error keeps the generation",
+			acknowledged:   []string{"a"},
+			deltaErr:       errFailed,
+			keys:           []string{"b"},
+			expectedCalls:  []syncCall{{baseGeneration: 10, generation: 11, added: []string{"b"}, removed: []string{"a"}}},
+			expectedErr:    errFailed,
+			expectedGen:    10,
+			expectedKeySet: []string{"a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			fake := &fakeSyncSD{deltaErr: tt.deltaErr}
+			s := newKeySyncer(fake)
+			s.generation = 10
+			if tt.acknowledged != nil {
+				s.keys = map[string]struct{}{}
+				for _, key := range tt.acknowledged {
+					s.keys[key] = struct{}{}
+				}
+			}
+
+			err := s.sync(context.Background(), tt.keys)
+			require.ErrorIs(t, err, tt.expectedErr)
+			require.Equal(t, tt.expectedCalls, fake.calls)
+			require.Equal(t, tt.expectedGen, s.generation)
+			keySet := []string{}
+			for key := range s.keys {
+				keySet = append(keySet, key)
+			}
+			require.ElementsMatch(t, tt.expectedKeySet, keySet)
+		})
+	}
+}
+
+func TestKeySyncerAdvertise(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fake := &fakeSyncSD{advertiseErr: errors.New("connection refused")}
+	s := newKeySyncer(fake)
+	s.generation = 10
+	require.NoError(t, s.sync(ctx, []string{"a"}))
+
+	// Keys are tracked even if advertising them failed, the next delta
+	// removes them.
+	require.Error(t, s.advertise(ctx, []string{"b", "c"}))
+	require.NoError(t, s.sync(ctx, []string{"a"}))
+	require.Equal(t, syncCall{baseGeneration: 11, generation: 12, removed: []string{"b", "c"}}, fake.calls[1])
+}